@@ -0,0 +1,269 @@
+/*
+Copyright © 2023 Dataflows
+*/
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/k0sproject/k0sctl/pkg/apis/k0sctl.k0sproject.io/v1beta1/cluster"
+	rigLog "github.com/k0sproject/rig/log"
+	"github.com/spf13/cobra"
+	"github.com/thedataflows/go-commons/pkg/config"
+	"github.com/thedataflows/go-commons/pkg/file"
+	"github.com/thedataflows/go-commons/pkg/log"
+	"github.com/thedataflows/kubestrap/pkg/constants"
+	"github.com/thedataflows/kubestrap/pkg/kubestrap"
+)
+
+type ClusterCp struct {
+	cmd           *cobra.Command
+	parent        *Cluster
+	hostSelection *HostSelection
+}
+
+var (
+	_ = NewClusterCp(mycluster)
+)
+
+func init() {
+
+}
+
+func NewClusterCp(parent *Cluster) *ClusterCp {
+	cc := &ClusterCp{
+		parent: parent,
+	}
+
+	cc.cmd = &cobra.Command{
+		Use:   "cp",
+		Short: "Copy files between the local host and cluster hosts, in parallel. Exits with error if the copy failed on any host",
+		Long: `Either the source or the destination is remote, in the form host:path.
+The host can be a pattern, and is combined with the host selection flags. When empty, only the host selection flags apply.
+When downloading from multiple hosts, files are copied into a subdirectory of the destination for each host address.`,
+		Example: parent.parent.cmd.Use + " " + parent.cmd.Use + " --context mycontext cp -r ./manifests 'node-*:/tmp/'\n" +
+			parent.parent.cmd.Use + " " + parent.cmd.Use + " --context mycontext cp --role controller --sudo :/var/lib/k0s/pki/ca.crt ./pki/",
+		Args:          cobra.ExactArgs(2),
+		RunE:          cc.RunClusterCpCommand,
+		SilenceErrors: parent.Cmd().SilenceErrors,
+		SilenceUsage:  parent.Cmd().SilenceUsage,
+	}
+
+	parent.Cmd().AddCommand(cc.cmd)
+
+	cc.hostSelection = NewHostSelection(cc.cmd)
+
+	cc.cmd.Flags().BoolP(
+		cc.KeyRecursive(),
+		"r",
+		false,
+		"Copy directories recursively",
+	)
+
+	cc.cmd.Flags().Bool(
+		cc.KeySudo(),
+		false,
+		"Use sudo on the hosts, e.g. for root owned paths",
+	)
+
+	cc.cmd.Flags().IntP(
+		cc.KeyParallel(),
+		"P",
+		10,
+		"Maximum number of hosts to copy to or from concurrently",
+	)
+
+	// Bind flags to config
+	config.ViperBindPFlagSet(cc.cmd, nil)
+
+	rigLog.Log = &log.Log
+
+	return cc
+}
+
+func (c *ClusterCp) RunClusterCpCommand(cmd *cobra.Command, args []string) error {
+	if err := c.CheckRequiredFlags(); err != nil {
+		return err
+	}
+
+	srcHost, srcPath, srcRemote := splitRemotePath(args[0])
+	dstHost, dstPath, dstRemote := splitRemotePath(args[1])
+	if srcRemote == dstRemote {
+		return fmt.Errorf("exactly one of source or destination must be remote, in the form host:path")
+	}
+	upload := dstRemote
+	hostPattern, remotePath, localArg := srcHost, srcPath, dstPath
+	if upload {
+		hostPattern, remotePath, localArg = dstHost, dstPath, srcPath
+	}
+	// local paths are relative to the current directory, not to the cluster bootstrap path
+	localPath, err := filepath.Abs(localArg)
+	if err != nil {
+		return err
+	}
+	if strings.HasSuffix(localArg, string(os.PathSeparator)) {
+		localPath += string(os.PathSeparator)
+	}
+
+	// Load cluster spec
+	cl, err := kubestrap.NewK0sCluster(c.parent.ClusterContext(), c.parent.ClusterBootstrapPath())
+	if err != nil {
+		return err
+	}
+
+	patterns := []string{}
+	if hostPattern != "" {
+		patterns = append(patterns, hostPattern)
+	}
+	hosts, err := c.hostSelection.Select(cl.GetClusterSpec().Spec.Hosts, patterns...)
+	if err != nil {
+		return err
+	}
+
+	knownHosts, err := c.parent.parent.KnownHosts(c.parent.ClusterBootstrapPath())
+	if err != nil {
+		return err
+	}
+
+	currentDir := file.WorkingDirectory()
+	if err := os.Chdir(c.parent.ClusterBootstrapPath()); err != nil {
+		return err
+	}
+	defer func() { _ = os.Chdir(currentDir) }()
+
+	parallel := c.Parallel()
+	if parallel < 1 {
+		parallel = 1
+	}
+
+	results := make([]copyResult, len(hosts))
+	semaphore := make(chan struct{}, parallel)
+	wg := sync.WaitGroup{}
+	for i := range hosts {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			semaphore <- struct{}{}
+			defer func() { <-semaphore }()
+			dst := localPath
+			if !upload && len(hosts) > 1 {
+				dst = filepath.Join(localPath, hosts[i].Address()) + string(os.PathSeparator)
+			}
+			results[i] = c.copyOnHost(knownHosts, hosts[i], upload, localPath, remotePath, dst)
+		}(i)
+	}
+	wg.Wait()
+
+	// Summary
+	failed := 0
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "HOST\tFILES\tDURATION\tERROR")
+	for _, r := range results {
+		errMessage := ""
+		if r.err != nil {
+			failed++
+			errMessage = r.err.Error()
+		}
+		fmt.Fprintf(w, "%s\t%d\t%s\t%s\n", r.host, r.files, r.duration.Round(time.Millisecond), errMessage)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("copy failed on %d of %d hosts", failed, len(hosts))
+	}
+	return nil
+}
+
+type copyResult struct {
+	host     string
+	files    int
+	duration time.Duration
+	err      error
+}
+
+// copyOnHost connects to the host and uploads localPath to remotePath, or downloads remotePath to dst
+func (c *ClusterCp) copyOnHost(knownHosts *kubestrap.KnownHosts, h *cluster.Host, upload bool, localPath, remotePath, dst string) copyResult {
+	start := time.Now()
+	result := copyResult{
+		host: h.Address(),
+	}
+
+	if err := knownHosts.Connect(h); err != nil {
+		log.Errorf("[%s] Failed to connect: %v", h.Address(), err)
+		result.err = fmt.Errorf("failed to connect: %v", err)
+		result.duration = time.Since(start)
+		return result
+	}
+	defer h.Disconnect()
+
+	if upload {
+		log.Infof("[%s] Uploading '%s' to '%s'", h.Address(), localPath, remotePath)
+		result.files, result.err = kubestrap.UploadPath(h, localPath, remotePath, c.Recursive(), c.Sudo())
+	} else {
+		log.Infof("[%s] Downloading '%s' to '%s'", h.Address(), remotePath, dst)
+		result.files, result.err = kubestrap.DownloadPath(h, remotePath, dst, c.Recursive(), c.Sudo())
+	}
+	if result.err != nil {
+		log.Errorf("[%s] Failed to copy: %v", h.Address(), result.err)
+	}
+	result.duration = time.Since(start)
+	return result
+}
+
+// splitRemotePath splits host:path, where host can also be a /regex/.
+// Otherwise, paths containing a separator before the colon, and windows drive letters, are local
+func splitRemotePath(arg string) (host, p string, remote bool) {
+	i := strings.Index(arg, ":")
+	if strings.HasPrefix(arg, "/") {
+		j := strings.Index(arg[1:], "/:")
+		if j < 0 {
+			return "", arg, false
+		}
+		i = j + 2
+	} else if i < 0 || strings.ContainsAny(arg[:i], `/\`) || (runtime.GOOS == constants.Windows && i == 1) {
+		return "", arg, false
+	}
+	host, p = arg[:i], arg[i+1:]
+	if p == "" {
+		p = "."
+	}
+	return host, p, true
+}
+
+func (c *ClusterCp) CheckRequiredFlags() error {
+	return c.parent.CheckRequiredFlags()
+}
+
+// Flags keys, defaults and value getters
+func (c *ClusterCp) KeyRecursive() string {
+	return "recursive"
+}
+
+func (c *ClusterCp) Recursive() bool {
+	return config.ViperGetBool(c.cmd, c.KeyRecursive())
+}
+
+func (c *ClusterCp) KeySudo() string {
+	return "sudo"
+}
+
+func (c *ClusterCp) Sudo() bool {
+	return config.ViperGetBool(c.cmd, c.KeySudo())
+}
+
+func (c *ClusterCp) KeyParallel() string {
+	return "parallel"
+}
+
+func (c *ClusterCp) Parallel() int {
+	return config.ViperGetInt(c.cmd, c.KeyParallel())
+}
@@ -0,0 +1,184 @@
+/*
+Copyright © 2023 Dataflows
+*/
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+
+	rigLog "github.com/k0sproject/rig/log"
+	"github.com/spf13/cobra"
+	"github.com/thedataflows/go-commons/pkg/config"
+	"github.com/thedataflows/go-commons/pkg/file"
+	"github.com/thedataflows/go-commons/pkg/log"
+	"github.com/thedataflows/kubestrap/pkg/kubestrap"
+)
+
+type ClusterInstallTool struct {
+	cmd           *cobra.Command
+	parent        *Cluster
+	hostSelection *HostSelection
+}
+
+var (
+	_ = NewClusterInstallTool(mycluster)
+)
+
+func init() {
+
+}
+
+func NewClusterInstallTool(parent *Cluster) *ClusterInstallTool {
+	ci := &ClusterInstallTool{
+		parent: parent,
+	}
+
+	ci.cmd = &cobra.Command{
+		Use:           "install-tool",
+		Short:         "Install one or more of the predefined raw utilities on the cluster hosts",
+		Example:       parent.parent.cmd.Use + " " + parent.cmd.Use + " --context mycontext install-tool --hosts node1,node2 kubectl velero",
+		Long:          ``,
+		RunE:          ci.RunClusterInstallToolCommand,
+		Aliases:       []string{"it"},
+		SilenceErrors: parent.Cmd().SilenceErrors,
+		SilenceUsage:  parent.Cmd().SilenceUsage,
+	}
+
+	parent.Cmd().AddCommand(ci.cmd)
+
+	ci.hostSelection = NewHostSelection(ci.cmd)
+
+	ci.cmd.Flags().StringP(
+		ci.KeyDirectory(),
+		"d",
+		"/usr/local/bin",
+		"Directory on the hosts where the utilities are installed",
+	)
+
+	// Bind flags to config
+	config.ViperBindPFlagSet(ci.cmd, nil)
+
+	rigLog.Log = &log.Log
+
+	return ci
+}
+
+func (c *ClusterInstallTool) RunClusterInstallToolCommand(cmd *cobra.Command, args []string) error {
+	if err := c.CheckRequiredFlags(); err != nil {
+		return err
+	}
+
+	if len(args) == 0 {
+		return fmt.Errorf("no utilities to install")
+	}
+
+	// Load cluster spec
+	cl, err := kubestrap.NewK0sCluster(c.parent.ClusterContext(), c.parent.ClusterBootstrapPath())
+	if err != nil {
+		return err
+	}
+
+	hosts, err := c.hostSelection.Select(cl.GetClusterSpec().Spec.Hosts)
+	if err != nil {
+		return err
+	}
+
+	knownHosts, err := c.parent.parent.KnownHosts(c.parent.ClusterBootstrapPath())
+	if err != nil {
+		return err
+	}
+
+	currentDir := file.WorkingDirectory()
+	if err := os.Chdir(c.parent.ClusterBootstrapPath()); err != nil {
+		return err
+	}
+	defer func() { _ = os.Chdir(currentDir) }()
+
+	// fetched files by utility and platform, shared by the hosts of the same platform
+	fetched := make(map[string][]string)
+	failed := 0
+	for _, h := range hosts {
+		if err := knownHosts.Connect(h); err != nil {
+			log.Errorf("[%s] Failed to connect: %v", h.Address(), err)
+			failed++
+			continue
+		}
+		goos, goarch, err := kubestrap.HostPlatform(h)
+		if err != nil {
+			log.Errorf("[%s] Failed to determine platform: %v", h.Address(), err)
+			h.Disconnect()
+			failed++
+			continue
+		}
+		log.Debugf("[%s] platform: %s/%s", h.Address(), goos, goarch)
+		for _, name := range args {
+			// the definition and registry fallbacks depend on the host platform, not the local one
+			t, err := raw.PlatformUtility(name, goos, goarch)
+			if err != nil {
+				log.Errorf("[%s] %v", h.Address(), err)
+				failed++
+				continue
+			}
+			files, err := c.platformFiles(t, goos, goarch, fetched)
+			if err != nil {
+				log.Errorf("[%s] Failed to fetch '%s': %v", h.Address(), t.Name, err)
+				failed++
+				continue
+			}
+			for _, f := range files {
+				dst := path.Join(c.Directory(), filepath.Base(f))
+				uploaded, err := kubestrap.UploadFileIfChanged(h, f, dst, 0755)
+				if err != nil {
+					log.Errorf("[%s] Failed to install '%s': %v", h.Address(), dst, err)
+					failed++
+					continue
+				}
+				if !uploaded {
+					log.Infof("[%s] '%s' is up to date", h.Address(), dst)
+					continue
+				}
+				log.Infof("[%s] Installed '%s' release '%s'", h.Address(), dst, t.Release)
+			}
+		}
+		h.Disconnect()
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d installation(s) failed", failed)
+	}
+	return nil
+}
+
+// platformFiles returns the local executables of the utility for the given target os and arch.
+// They are fetched, and their checksum verified, once per run and platform
+func (c *ClusterInstallTool) platformFiles(t *kubestrap.RawCommand, goos, goarch string, fetched map[string][]string) ([]string, error) {
+	key := fmt.Sprintf("%s/%s/%s/%s", t.Name, t.Release, goos, goarch)
+	if files, ok := fetched[key]; ok {
+		return files, nil
+	}
+	dir, err := t.PlatformDir(goos, goarch)
+	if err != nil {
+		return nil, err
+	}
+	files, err := t.Fetch(goos, goarch, dir)
+	if err != nil {
+		return nil, err
+	}
+	fetched[key] = files
+	return files, nil
+}
+
+func (c *ClusterInstallTool) CheckRequiredFlags() error {
+	return c.parent.CheckRequiredFlags()
+}
+
+func (c *ClusterInstallTool) KeyDirectory() string {
+	return "directory"
+}
+
+func (c *ClusterInstallTool) Directory() string {
+	return config.ViperGetString(c.cmd, c.KeyDirectory())
+}
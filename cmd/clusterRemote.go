@@ -4,22 +4,47 @@ Copyright © 2023 Dataflows
 package cmd
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
+	"io"
 	"os"
+	"path/filepath"
+	"sort"
 	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
 
+	"github.com/goccy/go-yaml"
 	"github.com/k0sproject/k0sctl/pkg/apis/k0sctl.k0sproject.io/v1beta1/cluster"
+	"github.com/k0sproject/rig/exec"
 	rigLog "github.com/k0sproject/rig/log"
 	"github.com/spf13/cobra"
 	"github.com/thedataflows/go-commons/pkg/config"
 	"github.com/thedataflows/go-commons/pkg/file"
 	"github.com/thedataflows/go-commons/pkg/log"
 	"github.com/thedataflows/kubestrap/pkg/kubestrap"
+	"golang.org/x/exp/slices"
+)
+
+const (
+	remoteOutputText    = "text"
+	remoteOutputGrouped = "grouped"
+	remoteOutputJson    = "json"
+	remoteOutputYaml    = "yaml"
+	remoteOutputJsonl   = "jsonl"
+)
+
+var (
+	remoteOutputs           = []string{remoteOutputText, remoteOutputGrouped, remoteOutputJson, remoteOutputYaml, remoteOutputJsonl}
+	remoteStructuredOutputs = []string{remoteOutputJson, remoteOutputYaml, remoteOutputJsonl}
 )
 
 type ClusterRemote struct {
-	cmd    *cobra.Command
-	parent *Cluster
+	cmd           *cobra.Command
+	parent        *Cluster
+	hostSelection *HostSelection
 }
 
 var (
@@ -36,9 +61,18 @@ func NewClusterRemote(parent *Cluster) *ClusterRemote {
 	}
 
 	cr.cmd = &cobra.Command{
-		Use:           "remote",
-		Short:         "Execute command remotely on the cluster",
-		Long:          ``,
+		Use:   "remote",
+		Short: "Execute command remotely on the cluster hosts, in parallel. Exits with error if the command failed on any host",
+		Long:  ``,
+		Example: parent.parent.cmd.Use + " " + parent.cmd.Use + " --context mycontext remote --role worker -- uptime\n" +
+			parent.parent.cmd.Use + " " + parent.cmd.Use + " --context mycontext remote --sudo --script scripts/cleanup.sh --env DRY_RUN=1 -- arg1 arg2",
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			output := cr.Output()
+			if !slices.Contains(remoteOutputs, output) {
+				return fmt.Errorf("invalid output: %s. Valid: %v", output, remoteOutputs)
+			}
+			return nil
+		},
 		RunE:          cr.RunClusterRemoteCommand,
 		Aliases:       []string{"r"},
 		SilenceErrors: parent.Cmd().SilenceErrors,
@@ -47,10 +81,45 @@ func NewClusterRemote(parent *Cluster) *ClusterRemote {
 
 	parent.Cmd().AddCommand(cr.cmd)
 
-	cr.cmd.Flags().StringSlice(
-		cr.KeyClusterRemoteHosts(),
+	cr.hostSelection = NewHostSelection(cr.cmd)
+
+	cr.cmd.Flags().IntP(
+		cr.KeyParallel(),
+		"P",
+		10,
+		"Maximum number of hosts to run the command on concurrently",
+	)
+
+	cr.cmd.Flags().StringP(
+		cr.KeyScript(),
+		"s",
+		"",
+		"Local script to upload and run on the hosts, with the arguments as positional parameters. It is removed afterwards",
+	)
+
+	cr.cmd.Flags().StringArrayP(
+		cr.KeyEnv(),
+		"e",
 		[]string{},
-		"List of hosts defined in the cluster to run the command on. If not specified, will execute on all hosts",
+		"Environment variables for the script, as KEY=VAL",
+	)
+
+	cr.cmd.Flags().StringP(
+		cr.KeyOutput(),
+		"o",
+		remoteOutputText,
+		fmt.Sprintf(
+			"Output mode: %s streams output lines prefixed with the host, %s prints each distinct output once with the hosts that produced it and the differences from the majority output, %v print the results to stdout and everything else to stderr",
+			remoteOutputText,
+			remoteOutputGrouped,
+			remoteStructuredOutputs,
+		),
+	)
+
+	cr.cmd.Flags().Bool(
+		cr.KeySudo(),
+		false,
+		"Run the command or script with elevated privileges, for non-root SSH users",
 	)
 
 	// Bind flags to config
@@ -66,11 +135,23 @@ func (c *ClusterRemote) RunClusterRemoteCommand(cmd *cobra.Command, args []strin
 		return err
 	}
 
-	if len(args) == 0 {
-		return fmt.Errorf("command to execute is not specified")
+	script := c.Script()
+	if len(args) == 0 && script == "" {
+		return fmt.Errorf("command or script to execute is not specified")
+	}
+	if len(c.Env()) > 0 && script == "" {
+		return fmt.Errorf("environment variables are supported only with a script")
+	}
+	if script != "" {
+		// the script is relative to the current directory, not to the cluster bootstrap path
+		var err error
+		if script, err = filepath.Abs(script); err != nil {
+			return err
+		}
+		if !file.IsFile(script) {
+			return fmt.Errorf("script '%s' does not exist", script)
+		}
 	}
-
-	clusterRemoteHosts := c.ClusterRemoteHosts()
 
 	// Load cluster spec
 	cl, err := kubestrap.NewK0sCluster(c.parent.ClusterContext(), c.parent.ClusterBootstrapPath())
@@ -78,16 +159,15 @@ func (c *ClusterRemote) RunClusterRemoteCommand(cmd *cobra.Command, args []strin
 		return err
 	}
 
-	hosts := cl.GetClusterSpec().Spec.Hosts.Filter(
-		func(h *cluster.Host) bool {
-			for _, filterHost := range clusterRemoteHosts {
-				if h.Address() == filterHost || h.Metadata.Hostname == filterHost || h.HostnameOverride == filterHost {
-					return true
-				}
-			}
-			return len(clusterRemoteHosts) == 0
-		},
-	)
+	hosts, err := c.hostSelection.Select(cl.GetClusterSpec().Spec.Hosts)
+	if err != nil {
+		return err
+	}
+
+	knownHosts, err := c.parent.parent.KnownHosts(c.parent.ClusterBootstrapPath())
+	if err != nil {
+		return err
+	}
 
 	currentDir := file.WorkingDirectory()
 	if err := os.Chdir(c.parent.ClusterBootstrapPath()); err != nil {
@@ -95,36 +175,258 @@ func (c *ClusterRemote) RunClusterRemoteCommand(cmd *cobra.Command, args []strin
 	}
 	defer func() { _ = os.Chdir(currentDir) }()
 
-	for i := 0; i < len(hosts); i += 1 {
-		err := hosts[i].Connect()
-		defer hosts[i].Disconnect()
-		if err != nil {
-			log.Errorf("[%s] Failed to connect: %v", hosts[i].Address(), err)
-			continue
+	remoteCommand := strings.Join(args, " ")
+	if script != "" {
+		remoteCommand = strings.TrimSpace(filepath.Base(script) + " " + remoteCommand)
+	}
+	timeout := config.ViperGetDuration(c.parent.Cmd(), c.parent.KeyTimeout())
+	parallel := c.Parallel()
+	if parallel < 1 {
+		parallel = 1
+	}
+
+	results := make([]remoteResult, len(hosts))
+	outputMutex := &sync.Mutex{}
+	semaphore := make(chan struct{}, parallel)
+	wg := sync.WaitGroup{}
+	for i := range hosts {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			semaphore <- struct{}{}
+			defer func() { <-semaphore }()
+			results[i] = c.runOnHost(knownHosts, hosts[i], remoteCommand, script, args, timeout, outputMutex)
+			if c.Output() == remoteOutputJsonl {
+				outputMutex.Lock()
+				defer outputMutex.Unlock()
+				encoder := json.NewEncoder(os.Stdout)
+				encoder.SetEscapeHTML(false)
+				if err := encoder.Encode(results[i]); err != nil {
+					log.Errorf("[%s] Failed to encode result: %v", hosts[i].Address(), err)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	// structured results go to stdout, everything else to stderr
+	summaryWriter := os.Stdout
+	switch c.Output() {
+	case remoteOutputGrouped:
+		printGroupedResults(os.Stdout, results)
+	case remoteOutputJson:
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetEscapeHTML(false)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(results); err != nil {
+			return err
 		}
-		remoteCommand := strings.Join(args, " ")
-		o, err := hosts[i].ExecOutput(remoteCommand)
-		if err != nil {
-			log.Errorf("[%s] Failed to execute '%s': %v", hosts[i].Address(), remoteCommand, err)
-			continue
+		summaryWriter = os.Stderr
+	case remoteOutputYaml:
+		if err := yaml.NewEncoder(os.Stdout).Encode(results); err != nil {
+			return err
 		}
-		if len(o) == 0 {
-			log.Infof("[%s] Executed '%s'", hosts[i].Address(), remoteCommand)
-			continue
+		summaryWriter = os.Stderr
+	case remoteOutputJsonl:
+		summaryWriter = os.Stderr
+	}
+
+	// Summary
+	failed := 0
+	w := tabwriter.NewWriter(summaryWriter, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "HOST\tEXIT\tDURATION\tERROR")
+	for _, r := range results {
+		if r.err != nil {
+			failed++
 		}
-		log.Infof("[%s] Executed '%s':\n%v", hosts[i].Address(), remoteCommand, o)
+		fmt.Fprintf(w, "%s\t%d\t%s\t%s\n", r.Host, r.Exit, r.End.Sub(r.Start).Round(time.Millisecond), r.Error)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("'%s' failed on %d of %d hosts", remoteCommand, failed, len(hosts))
 	}
 	return nil
 }
 
+type remoteResult struct {
+	Host     string    `json:"host" yaml:"host"`
+	Hostname string    `json:"hostname,omitempty" yaml:"hostname,omitempty"`
+	Role     string    `json:"role" yaml:"role"`
+	Command  string    `json:"command" yaml:"command"`
+	Stdout   string    `json:"stdout" yaml:"stdout"`
+	Stderr   string    `json:"stderr" yaml:"stderr"`
+	Exit     int       `json:"exit" yaml:"exit"`
+	Start    time.Time `json:"start" yaml:"start"`
+	End      time.Time `json:"end" yaml:"end"`
+	Error    string    `json:"error,omitempty" yaml:"error,omitempty"`
+	err      error
+}
+
+// printGroupedResults prints each distinct pair of stdout and exit code once, with the hosts that produced it,
+// largest group first. Outliers are followed by the unified diff against the majority output
+func printGroupedResults(w io.Writer, results []remoteResult) {
+	type group struct {
+		exit   int
+		stdout string
+		hosts  []string
+	}
+	groups := []*group{}
+	for _, r := range results {
+		found := false
+		for _, g := range groups {
+			if g.exit == r.Exit && g.stdout == r.Stdout {
+				g.hosts = append(g.hosts, r.Host)
+				found = true
+				break
+			}
+		}
+		if !found {
+			groups = append(groups, &group{exit: r.Exit, stdout: r.Stdout, hosts: []string{r.Host}})
+		}
+	}
+	// on ties, successful outputs are the reference
+	sort.SliceStable(groups, func(i, j int) bool {
+		if len(groups[i].hosts) == len(groups[j].hosts) {
+			return groups[i].exit == 0 && groups[j].exit != 0
+		}
+		return len(groups[i].hosts) > len(groups[j].hosts)
+	})
+
+	for i, g := range groups {
+		fmt.Fprintf(w, "=== %d of %d hosts, exit %d: %s\n", len(g.hosts), len(results), g.exit, strings.Join(g.hosts, ", "))
+		fmt.Fprint(w, g.stdout)
+		if g.stdout != "" && !strings.HasSuffix(g.stdout, "\n") {
+			fmt.Fprintln(w)
+		}
+		if i > 0 {
+			fmt.Fprint(w, kubestrap.UnifiedDiff(groups[0].stdout, g.stdout, "majority", g.hosts[0], 3))
+		}
+	}
+	fmt.Fprintln(w)
+}
+
+// runOnHost connects to the host and runs the command, or uploads and runs the script with args.
+// Output is captured and, depending on the output mode, streamed with lines prefixed with the host address
+func (c *ClusterRemote) runOnHost(knownHosts *kubestrap.KnownHosts, h *cluster.Host, remoteCommand, script string, args []string, timeout time.Duration, outputMutex *sync.Mutex) (result remoteResult) {
+	result = remoteResult{
+		Host:     h.Address(),
+		Hostname: h.HostnameOverride,
+		Role:     h.Role,
+		Command:  remoteCommand,
+		Exit:     kubestrap.RemoteExitUnknown,
+		Start:    time.Now(),
+	}
+	defer func() {
+		result.End = time.Now()
+		if result.err != nil {
+			result.Error = result.err.Error()
+		}
+	}()
+
+	if err := knownHosts.Connect(h); err != nil {
+		log.Errorf("[%s] Failed to connect: %v", h.Address(), err)
+		result.err = fmt.Errorf("failed to connect: %v", err)
+		return result
+	}
+	defer h.Disconnect()
+
+	if result.Hostname == "" {
+		if hostname, err := h.ExecOutput("hostname"); err == nil {
+			result.Hostname = strings.TrimSpace(hostname)
+		}
+	}
+
+	command := remoteCommand
+	if script != "" {
+		remoteScript, scriptCommand, err := kubestrap.UploadScript(h, script, c.Env(), args)
+		if err != nil {
+			log.Errorf("[%s] Failed to upload script '%s': %v", h.Address(), script, err)
+			result.err = fmt.Errorf("failed to upload script: %v", err)
+			return result
+		}
+		defer func() {
+			// after a timeout the connection is closed
+			if !h.IsConnected() {
+				log.Warnf("[%s] Script '%s' was not removed", h.Address(), remoteScript)
+				return
+			}
+			if err := h.Fsys().Remove(remoteScript); err != nil {
+				log.Warnf("[%s] Failed to remove script '%s': %v", h.Address(), remoteScript, err)
+			}
+		}()
+		command = scriptCommand
+	}
+	opts := []exec.Option{}
+	if c.Sudo() {
+		opts = append(opts, exec.Sudo(h))
+	}
+
+	prefix := fmt.Sprintf("[%s] ", h.Address())
+	stdoutBuffer, stderrBuffer := &bytes.Buffer{}, &bytes.Buffer{}
+	stdoutPrefixed := kubestrap.NewPrefixWriter(os.Stdout, prefix, outputMutex)
+	stderrPrefixed := kubestrap.NewPrefixWriter(os.Stderr, prefix, outputMutex)
+	var stdout, stderr io.Writer = stdoutBuffer, stderrBuffer
+	switch c.Output() {
+	case remoteOutputText:
+		stdout = io.MultiWriter(stdoutBuffer, stdoutPrefixed)
+		stderr = io.MultiWriter(stderrBuffer, stderrPrefixed)
+	case remoteOutputGrouped:
+		stderr = io.MultiWriter(stderrBuffer, stderrPrefixed)
+	}
+	result.Exit, result.err = kubestrap.RemoteExec(h, command, nil, stdout, stderr, timeout, opts...)
+	_ = stdoutPrefixed.Flush()
+	_ = stderrPrefixed.Flush()
+	result.Stdout = stdoutBuffer.String()
+	result.Stderr = stderrBuffer.String()
+	if result.err != nil {
+		log.Errorf("[%s] Failed to execute '%s': %v", h.Address(), remoteCommand, result.err)
+	}
+	return result
+}
+
 func (c *ClusterRemote) CheckRequiredFlags() error {
 	return c.parent.CheckRequiredFlags()
 }
 
-func (c *ClusterRemote) KeyClusterRemoteHosts() string {
-	return "hosts"
+func (c *ClusterRemote) KeyParallel() string {
+	return "parallel"
+}
+
+func (c *ClusterRemote) Parallel() int {
+	return config.ViperGetInt(c.cmd, c.KeyParallel())
+}
+
+func (c *ClusterRemote) KeyScript() string {
+	return "script"
+}
+
+func (c *ClusterRemote) Script() string {
+	return config.ViperGetString(c.cmd, c.KeyScript())
+}
+
+func (c *ClusterRemote) KeyEnv() string {
+	return "env"
+}
+
+func (c *ClusterRemote) Env() []string {
+	return config.ViperGetStringSlice(c.cmd, c.KeyEnv())
+}
+
+func (c *ClusterRemote) KeyOutput() string {
+	return "output"
+}
+
+func (c *ClusterRemote) Output() string {
+	return config.ViperGetString(c.cmd, c.KeyOutput())
+}
+
+func (c *ClusterRemote) KeySudo() string {
+	return "sudo"
 }
 
-func (c *ClusterRemote) ClusterRemoteHosts() []string {
-	return config.ViperGetStringSlice(c.cmd, c.KeyClusterRemoteHosts())
+func (c *ClusterRemote) Sudo() bool {
+	return config.ViperGetBool(c.cmd, c.KeySudo())
 }
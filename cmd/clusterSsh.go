@@ -0,0 +1,115 @@
+/*
+Copyright © 2023 Dataflows
+*/
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+
+	rigLog "github.com/k0sproject/rig/log"
+	"github.com/spf13/cobra"
+	"github.com/thedataflows/go-commons/pkg/config"
+	"github.com/thedataflows/go-commons/pkg/file"
+	"github.com/thedataflows/go-commons/pkg/log"
+	"github.com/thedataflows/kubestrap/pkg/kubestrap"
+	"golang.org/x/term"
+)
+
+type ClusterSsh struct {
+	cmd    *cobra.Command
+	parent *Cluster
+}
+
+var (
+	_ = NewClusterSsh(mycluster)
+)
+
+func init() {
+
+}
+
+func NewClusterSsh(parent *Cluster) *ClusterSsh {
+	cs := &ClusterSsh{
+		parent: parent,
+	}
+
+	cs.cmd = &cobra.Command{
+		Use:           "ssh",
+		Short:         "Open an interactive session on a cluster host, using the SSH settings from the cluster spec",
+		Example:       parent.parent.cmd.Use + " " + parent.cmd.Use + " --context mycontext ssh node1 [-- command [args]]",
+		Long:          ``,
+		Args:          cobra.MinimumNArgs(1),
+		RunE:          cs.RunClusterSshCommand,
+		SilenceErrors: parent.Cmd().SilenceErrors,
+		SilenceUsage:  parent.Cmd().SilenceUsage,
+	}
+
+	parent.Cmd().AddCommand(cs.cmd)
+
+	// Bind flags to config
+	config.ViperBindPFlagSet(cs.cmd, nil)
+
+	rigLog.Log = &log.Log
+
+	return cs
+}
+
+func (c *ClusterSsh) RunClusterSshCommand(cmd *cobra.Command, args []string) error {
+	if err := c.CheckRequiredFlags(); err != nil {
+		return err
+	}
+
+	remoteCommand := strings.Join(args[1:], " ")
+	interactive := term.IsTerminal(int(os.Stdin.Fd()))
+	if !interactive && remoteCommand == "" {
+		return fmt.Errorf("an interactive shell requires a terminal. Specify a command to run instead")
+	}
+
+	// Load cluster spec
+	cl, err := kubestrap.NewK0sCluster(c.parent.ClusterContext(), c.parent.ClusterBootstrapPath())
+	if err != nil {
+		return err
+	}
+
+	h, err := kubestrap.SelectHost(cl.GetClusterSpec().Spec.Hosts, args[0])
+	if err != nil {
+		return err
+	}
+
+	knownHosts, err := c.parent.parent.KnownHosts(c.parent.ClusterBootstrapPath())
+	if err != nil {
+		return err
+	}
+
+	currentDir := file.WorkingDirectory()
+	if err := os.Chdir(c.parent.ClusterBootstrapPath()); err != nil {
+		return err
+	}
+	defer func() { _ = os.Chdir(currentDir) }()
+
+	if err := knownHosts.Connect(h); err != nil {
+		return fmt.Errorf("[%s] failed to connect: %v", h.Address(), err)
+	}
+	defer h.Disconnect()
+
+	if interactive {
+		// rig requests a pty, relays window size changes and forwards interrupt and suspend
+		err = h.ExecInteractive(remoteCommand)
+	} else {
+		_, err = kubestrap.RemoteExec(h, remoteCommand, bytes.NewReader(stdInBytes), os.Stdout, os.Stderr, 0)
+	}
+	if err != nil {
+		if exit := kubestrap.RemoteExitCode(err); exit != kubestrap.RemoteExitUnknown {
+			return fmt.Errorf("[%s] session terminated with exit code %d", h.Address(), exit)
+		}
+		return fmt.Errorf("[%s] %v", h.Address(), err)
+	}
+	return nil
+}
+
+func (c *ClusterSsh) CheckRequiredFlags() error {
+	return c.parent.CheckRequiredFlags()
+}
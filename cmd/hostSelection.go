@@ -0,0 +1,98 @@
+/*
+Copyright © 2023 Dataflows
+*/
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/k0sproject/k0sctl/pkg/apis/k0sctl.k0sproject.io/v1beta1/cluster"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"github.com/thedataflows/go-commons/pkg/config"
+	"github.com/thedataflows/kubestrap/pkg/kubestrap"
+)
+
+// HostSelection holds the host selection flags shared by the commands running on cluster hosts
+type HostSelection struct {
+	cmd *cobra.Command
+}
+
+// NewHostSelection adds the host selection flags to cmd. Must be called before binding the flags to config
+func NewHostSelection(cmd *cobra.Command) *HostSelection {
+	hs := &HostSelection{
+		cmd: cmd,
+	}
+
+	cmd.Flags().StringSlice(
+		hs.KeyHosts(),
+		[]string{},
+		"List of hosts defined in the cluster, by address or hostname. Globs (node-*) and regular expressions enclosed in slashes (/^node-[0-9]+$/) are accepted. If hosts and groups are not specified, all hosts are selected",
+	)
+
+	cmd.Flags().StringSlice(
+		hs.KeyRoles(),
+		[]string{},
+		fmt.Sprintf("Select only hosts with any of the roles: %v", kubestrap.HostRoles),
+	)
+
+	cmd.Flags().StringSlice(
+		hs.KeyGroups(),
+		[]string{},
+		fmt.Sprintf("List of named host groups, defined as lists of host patterns under '%s' in config", hs.KeyHostGroups()),
+	)
+
+	return hs
+}
+
+// Select returns the selected hosts, including the ones matching any of the additional patterns. It is an error if no host is selected
+func (hs *HostSelection) Select(hosts cluster.Hosts, patterns ...string) (cluster.Hosts, error) {
+	selector := &kubestrap.HostSelector{
+		Hosts:            append(hs.Hosts(), patterns...),
+		Groups:           hs.Groups(),
+		Roles:            hs.Roles(),
+		GroupDefinitions: hs.HostGroups(),
+	}
+	selected, err := selector.Select(hosts)
+	if err != nil {
+		return nil, err
+	}
+	if len(selected) == 0 {
+		return nil, fmt.Errorf("no cluster hosts match the selection")
+	}
+	return selected, nil
+}
+
+// Flags keys, defaults and value getters
+func (hs *HostSelection) KeyHosts() string {
+	return "hosts"
+}
+
+func (hs *HostSelection) Hosts() []string {
+	return config.ViperGetStringSlice(hs.cmd, hs.KeyHosts())
+}
+
+func (hs *HostSelection) KeyRoles() string {
+	return "role"
+}
+
+func (hs *HostSelection) Roles() []string {
+	return config.ViperGetStringSlice(hs.cmd, hs.KeyRoles())
+}
+
+func (hs *HostSelection) KeyGroups() string {
+	return "group"
+}
+
+func (hs *HostSelection) Groups() []string {
+	return config.ViperGetStringSlice(hs.cmd, hs.KeyGroups())
+}
+
+// KeyHostGroups is the top level config key holding the named host groups
+func (hs *HostSelection) KeyHostGroups() string {
+	return "host-groups"
+}
+
+func (hs *HostSelection) HostGroups() map[string][]string {
+	return viper.GetStringMapStringSlice(hs.KeyHostGroups())
+}
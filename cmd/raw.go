@@ -6,6 +6,7 @@ package cmd
 import (
 	"fmt"
 	"io"
+	"runtime"
 	"strings"
 	"time"
 
@@ -23,6 +24,8 @@ type Raw struct {
 	cmd    *cobra.Command
 	parent *Root
 	stdin  io.Reader
+	// registries are loaded once, and only when needed
+	registries []*kubestrap.Registry
 }
 
 var (
@@ -65,16 +68,68 @@ func NewRaw(parent *Root) *Raw {
 		"Commands output should be buffered or streamed",
 	)
 
+	r.cmd.PersistentFlags().StringSlice(
+		r.KeyRegistries(),
+		[]string{},
+		"Registry index files, local or http(s), with utilities definitions. Utilities in the config with neither a url for the platform nor a cache path inherit missing fields from the first registry defining them. Cached remote indexes are used when refreshing fails",
+	)
+
+	defaultRegistryMaxAge, _ := time.ParseDuration("24h0m0s")
+	r.cmd.PersistentFlags().Duration(
+		r.KeyRegistryMaxAge(),
+		defaultRegistryMaxAge,
+		"Maximum age of the locally cached remote registry indexes, before downloading them again",
+	)
+
 	// Bind flags to config
 	config.ViperBindPFlagSet(r.cmd, nil)
+	config.ViperBindPFlagSet(r.cmd, r.cmd.PersistentFlags())
 
 	return r
 }
 
 func (r *Raw) RunRawCommand(cmd *cobra.Command, args []string) error {
+	if len(args) == 0 {
+		commands, err := r.configUtilities()
+		if err != nil {
+			return err
+		}
+		_ = cmd.Help()
+		fmt.Printf("\nAvailable utilities:\n")
+		for _, c := range commands {
+			fmt.Printf("  - %s %s\n", c.Name, c.Release)
+		}
+		return nil
+	}
+	// Config allows for duplicates, but here we stop at the first match
+	c, err := r.Utility(args[0])
+	if err != nil {
+		return err
+	}
+	timeout := r.Timeout()
+	log.Debugf("execution timeout: %s", timeout)
+	c.Command = args
+	status, err := c.ExecuteCommand(timeout, r.BufferedOutput(), r.stdin)
+	if err != nil {
+		return fmt.Errorf("error running '%s': %v", c.Command, err)
+	}
+	if len(status.Stdout) > 0 {
+		fmt.Println(strings.Join(status.Stdout, "\n"))
+	}
+	if status.Exit != 0 {
+		if len(status.Stderr) > 0 {
+			return fmt.Errorf("command '%s' failed with exit code %d:\n%s", strings.Join(c.Command, " "), status.Exit, strings.Join(status.Stderr, "\n"))
+		}
+		return fmt.Errorf("command '%s' failed with exit code %d", strings.Join(c.Command, " "), status.Exit)
+	}
+	return nil
+}
+
+// configUtilities returns the raw utilities as defined in the config, without registry fields
+func (r *Raw) configUtilities() ([]kubestrap.RawCommand, error) {
 	var commands []kubestrap.RawCommand
 	if err := viper.UnmarshalKey(
-		config.PrefixKey(cmd, r.KeyRawUtilities()),
+		config.PrefixKey(r.cmd, r.KeyRawUtilities()),
 		&commands,
 		func(config *mapstructure.DecoderConfig) {
 			config.TagName = "yaml"
@@ -82,40 +137,90 @@ func (r *Raw) RunRawCommand(cmd *cobra.Command, args []string) error {
 			// config.ErrorUnset = true
 		},
 	); err != nil {
-		return err
+		return nil, err
 	}
-	if len(args) == 0 {
-		_ = cmd.Help()
-		fmt.Printf("\nAvailable utilities:\n")
-		for _, c := range commands {
-			fmt.Printf("  - %s %s\n", c.Name, c.Release)
-		}
-		return nil
+	return commands, nil
+}
+
+// Utilities returns the raw utilities defined in the config. Those with neither a url for the platform nor a cache path
+// inherit the missing fields from the registries, which are not loaded otherwise
+func (r *Raw) Utilities() ([]kubestrap.RawCommand, error) {
+	return r.platformUtilities(runtime.GOOS, runtime.GOARCH)
+}
+
+func (r *Raw) platformUtilities(goos, goarch string) ([]kubestrap.RawCommand, error) {
+	commands, err := r.configUtilities()
+	if err != nil {
+		return nil, err
 	}
-	for _, c := range commands {
-		if c.Name == args[0] || slices.Contains(c.Additional, args[0]) {
-			timeout := r.Timeout()
-			log.Debugf("execution timeout: %s", timeout)
-			c.Command = args
-			status, err := c.ExecuteCommand(timeout, r.BufferedOutput(), r.stdin)
-			if err != nil {
-				return fmt.Errorf("error running '%s': %v", c.Command, err)
-			}
-			if len(status.Stdout) > 0 {
-				fmt.Println(strings.Join(status.Stdout, "\n"))
-			}
-			if status.Exit != 0 {
-				if len(status.Stderr) > 0 {
-					return fmt.Errorf("command '%s' failed with exit code %d:\n%s", strings.Join(c.Command, " "), status.Exit, strings.Join(status.Stderr, "\n"))
-				}
-				return fmt.Errorf("command '%s' failed with exit code %d", strings.Join(c.Command, " "), status.Exit)
+	for i := range commands {
+		if commands[i].IsComplete(goos, goarch) {
+			continue
+		}
+		registries, err := r.LoadRegistries()
+		if err != nil {
+			return nil, err
+		}
+		for _, registry := range registries {
+			if found := registry.Find(commands[i].Name); found != nil {
+				commands[i].Inherit(found)
+				break
 			}
-			// Config allows for duplicates, but here we stop at the first match
-			return nil
 		}
 	}
-	// If we get here, the command is not in the config, do not allow that
-	return fmt.Errorf("command '%s' is not supported, perhaps add it to the config?", args[0])
+	return commands, nil
+}
+
+// LoadRegistries returns the configured registry indexes, in order
+func (r *Raw) LoadRegistries() ([]*kubestrap.Registry, error) {
+	if r.registries != nil {
+		return r.registries, nil
+	}
+	locations := r.Registries()
+	registries := make([]*kubestrap.Registry, 0, len(locations))
+	for _, location := range locations {
+		registry, err := kubestrap.LoadRegistry(location, r.RegistryMaxAge())
+		if err != nil {
+			return nil, err
+		}
+		registries = append(registries, registry)
+	}
+	r.registries = registries
+	return registries, nil
+}
+
+// Utility returns the first raw utility matching name, either by name or by one of the additional executables
+func (r *Raw) Utility(name string) (*kubestrap.RawCommand, error) {
+	return r.PlatformUtility(name, runtime.GOOS, runtime.GOARCH)
+}
+
+// PlatformUtility returns the first raw utility matching name for goos and goarch. The registries are only loaded
+// when name is not defined in the config, as it can be an additional executable of a registry definition,
+// or when its definition has neither a url for the platform nor a cache path
+func (r *Raw) PlatformUtility(name, goos, goarch string) (*kubestrap.RawCommand, error) {
+	commands, err := r.configUtilities()
+	if err != nil {
+		return nil, err
+	}
+	if c := findUtility(commands, name); c != nil && c.IsComplete(goos, goarch) {
+		return c, nil
+	}
+	if commands, err = r.platformUtilities(goos, goarch); err != nil {
+		return nil, err
+	}
+	if c := findUtility(commands, name); c != nil {
+		return c, nil
+	}
+	return nil, fmt.Errorf("command '%s' is not supported, perhaps add it to the config?", name)
+}
+
+func findUtility(commands []kubestrap.RawCommand, name string) *kubestrap.RawCommand {
+	for i := range commands {
+		if commands[i].Name == name || slices.Contains(commands[i].Additional, name) {
+			return &commands[i]
+		}
+	}
+	return nil
 }
 
 func (r *Raw) RunRawCommandCaptureStdout(cmd *cobra.Command, args []string) (string, error) {
@@ -156,6 +261,22 @@ func (r *Raw) KeyRawUtilities() string {
 	return "utilities"
 }
 
+func (r *Raw) KeyRegistries() string {
+	return "registries"
+}
+
+func (r *Raw) Registries() []string {
+	return config.ViperGetStringSlice(r.cmd, r.KeyRegistries())
+}
+
+func (r *Raw) KeyRegistryMaxAge() string {
+	return "registry-max-age"
+}
+
+func (r *Raw) RegistryMaxAge() time.Duration {
+	return config.ViperGetDuration(r.cmd, r.KeyRegistryMaxAge())
+}
+
 func (r *Raw) KeyBufferedOutput() string {
 	return "buffered-output"
 }
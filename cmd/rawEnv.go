@@ -0,0 +1,123 @@
+/*
+Copyright © 2023 Dataflows
+*/
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+	"github.com/thedataflows/go-commons/pkg/config"
+	"github.com/thedataflows/kubestrap/pkg/kubestrap"
+	"golang.org/x/exp/slices"
+)
+
+type RawEnv struct {
+	cmd    *cobra.Command
+	parent *Raw
+}
+
+var (
+	_ = NewRawEnv(raw)
+)
+
+func init() {
+
+}
+
+func NewRawEnv(parent *Raw) *RawEnv {
+	re := &RawEnv{
+		parent: parent,
+	}
+
+	re.cmd = &cobra.Command{
+		Use:     "env",
+		Short:   "Print shell statements adding the pinned releases of the predefined utilities to the PATH",
+		Example: "eval \"$(" + parent.parent.cmd.Use + " " + parent.cmd.Use + " env --shell bash)\"",
+		Long:    ``,
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			shell := re.Shell()
+			if !slices.Contains(kubestrap.Shells, shell) {
+				return fmt.Errorf("invalid shell: %s. Valid: %v", shell, kubestrap.Shells)
+			}
+			return nil
+		},
+		RunE:          re.RunRawEnvCommand,
+		SilenceErrors: parent.Cmd().SilenceErrors,
+		SilenceUsage:  parent.Cmd().SilenceUsage,
+	}
+
+	parent.Cmd().AddCommand(re.cmd)
+
+	re.cmd.Flags().StringP(
+		re.KeyShell(),
+		"s",
+		kubestrap.DefaultShell(),
+		fmt.Sprintf("Shell syntax. Valid values: %v", kubestrap.Shells),
+	)
+
+	re.cmd.Flags().Bool(
+		re.KeyEnsure(),
+		false,
+		"Download the pinned releases that are not available yet",
+	)
+
+	// Bind flags to config
+	config.ViperBindPFlagSet(re.cmd, nil)
+
+	return re
+}
+
+func (r *RawEnv) RunRawEnvCommand(cmd *cobra.Command, args []string) error {
+	commands, err := r.parent.Utilities()
+	if err != nil {
+		return err
+	}
+
+	dirs := make([]string, 0, len(commands))
+	for _, c := range commands {
+		if len(args) > 0 && !slices.Contains(args, c.Name) {
+			continue
+		}
+		dir, err := c.ExeDir()
+		if err != nil {
+			return err
+		}
+		if r.Ensure() {
+			if err := c.CheckCommand(r.parent.Timeout()); err != nil {
+				return err
+			}
+		}
+		dirs = append(dirs, dir)
+	}
+
+	out, err := kubestrap.EnvPath(r.Shell(), dirs)
+	if err != nil {
+		return err
+	}
+	if out != "" {
+		fmt.Println(out)
+	}
+
+	return nil
+}
+
+func (r *RawEnv) Cmd() *cobra.Command {
+	return r.cmd
+}
+
+func (r *RawEnv) KeyShell() string {
+	return "shell"
+}
+
+func (r *RawEnv) Shell() string {
+	return config.ViperGetString(r.cmd, r.KeyShell())
+}
+
+func (r *RawEnv) KeyEnsure() string {
+	return "ensure"
+}
+
+func (r *RawEnv) Ensure() bool {
+	return config.ViperGetBool(r.cmd, r.KeyEnsure())
+}
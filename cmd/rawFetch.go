@@ -0,0 +1,120 @@
+/*
+Copyright © 2023 Dataflows
+*/
+package cmd
+
+import (
+	"fmt"
+	"runtime"
+
+	"github.com/spf13/cobra"
+	"github.com/thedataflows/go-commons/pkg/config"
+	"github.com/thedataflows/go-commons/pkg/log"
+)
+
+type RawFetch struct {
+	cmd    *cobra.Command
+	parent *Raw
+}
+
+var (
+	_ = NewRawFetch(raw)
+)
+
+func init() {
+
+}
+
+func NewRawFetch(parent *Raw) *RawFetch {
+	rf := &RawFetch{
+		parent: parent,
+	}
+
+	rf.cmd = &cobra.Command{
+		Use:           "fetch",
+		Short:         "Download one or more of the predefined utilities for a target platform, without adding them to the PATH",
+		Example:       parent.parent.cmd.Use + " " + parent.cmd.Use + " fetch --os linux --arch arm64 --output bin k0s kubectl",
+		Long:          ``,
+		Aliases:       []string{"f"},
+		RunE:          rf.RunRawFetchCommand,
+		SilenceErrors: parent.Cmd().SilenceErrors,
+		SilenceUsage:  parent.Cmd().SilenceUsage,
+	}
+
+	parent.Cmd().AddCommand(rf.cmd)
+
+	rf.cmd.Flags().String(
+		rf.KeyOs(),
+		runtime.GOOS,
+		"Target operating system",
+	)
+
+	rf.cmd.Flags().String(
+		rf.KeyArch(),
+		runtime.GOARCH,
+		"Target architecture",
+	)
+
+	rf.cmd.Flags().StringP(
+		rf.KeyOutput(),
+		"o",
+		".",
+		"Output directory",
+	)
+
+	// Bind flags to config
+	config.ViperBindPFlagSet(rf.cmd, nil)
+
+	return rf
+}
+
+func (r *RawFetch) RunRawFetchCommand(cmd *cobra.Command, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("no utilities to fetch")
+	}
+
+	for _, name := range args {
+		c, err := r.parent.PlatformUtility(name, r.Os(), r.Arch())
+		if err != nil {
+			return err
+		}
+		files, err := c.Fetch(r.Os(), r.Arch(), r.Output())
+		if err != nil {
+			return fmt.Errorf("error fetching '%s': %v", name, err)
+		}
+		for _, f := range files {
+			log.Infof("fetched: %s", f)
+		}
+	}
+
+	return nil
+}
+
+func (r *RawFetch) Cmd() *cobra.Command {
+	return r.cmd
+}
+
+// Flags keys, defaults and value getters
+func (r *RawFetch) KeyOs() string {
+	return "os"
+}
+
+func (r *RawFetch) Os() string {
+	return config.ViperGetString(r.cmd, r.KeyOs())
+}
+
+func (r *RawFetch) KeyArch() string {
+	return "arch"
+}
+
+func (r *RawFetch) Arch() string {
+	return config.ViperGetString(r.cmd, r.KeyArch())
+}
+
+func (r *RawFetch) KeyOutput() string {
+	return "output"
+}
+
+func (r *RawFetch) Output() string {
+	return config.ViperGetString(r.cmd, r.KeyOutput())
+}
@@ -0,0 +1,85 @@
+/*
+Copyright © 2023 Dataflows
+*/
+package cmd
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/thedataflows/go-commons/pkg/config"
+)
+
+type RawSearch struct {
+	cmd    *cobra.Command
+	parent *Raw
+}
+
+var (
+	_ = NewRawSearch(raw)
+)
+
+func init() {
+
+}
+
+func NewRawSearch(parent *Raw) *RawSearch {
+	rs := &RawSearch{
+		parent: parent,
+	}
+
+	rs.cmd = &cobra.Command{
+		Use:           "search",
+		Short:         "Search the registry indexes for utilities. Without a search term, lists all utilities",
+		Example:       parent.parent.cmd.Use + " " + parent.cmd.Use + " --registries https://example.com/registry.yaml search kube",
+		Long:          ``,
+		Aliases:       []string{"s"},
+		RunE:          rs.RunRawSearchCommand,
+		SilenceErrors: parent.Cmd().SilenceErrors,
+		SilenceUsage:  parent.Cmd().SilenceUsage,
+	}
+
+	parent.Cmd().AddCommand(rs.cmd)
+
+	// Bind flags to config
+	config.ViperBindPFlagSet(rs.cmd, nil)
+
+	return rs
+}
+
+func (r *RawSearch) RunRawSearchCommand(cmd *cobra.Command, args []string) error {
+	registries, err := r.parent.LoadRegistries()
+	if err != nil {
+		return err
+	}
+	if len(registries) == 0 {
+		return fmt.Errorf("no registries configured. Use --%s", r.parent.KeyRegistries())
+	}
+
+	term := strings.Join(args, " ")
+	locations := r.parent.Registries()
+	for i, registry := range registries {
+		found := registry.Search(term)
+		if len(found) == 0 {
+			continue
+		}
+		fmt.Printf("%s:\n", locations[i])
+		for _, c := range found {
+			line := fmt.Sprintf("  - %s %s", c.Name, c.Release)
+			if len(c.Additional) > 0 {
+				line += fmt.Sprintf(" (%s)", strings.Join(c.Additional, ", "))
+			}
+			if c.Help != "" {
+				line += ": " + c.Help
+			}
+			fmt.Println(line)
+		}
+	}
+
+	return nil
+}
+
+func (r *RawSearch) Cmd() *cobra.Command {
+	return r.cmd
+}
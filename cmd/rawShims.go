@@ -0,0 +1,130 @@
+/*
+Copyright © 2023 Dataflows
+*/
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"github.com/thedataflows/go-commons/pkg/config"
+	"github.com/thedataflows/go-commons/pkg/log"
+	"github.com/thedataflows/go-commons/pkg/process"
+	"github.com/thedataflows/kubestrap/pkg/kubestrap"
+	"golang.org/x/exp/slices"
+)
+
+type RawShims struct {
+	cmd    *cobra.Command
+	parent *Raw
+}
+
+var (
+	_ = NewRawShims(raw)
+)
+
+func init() {
+
+}
+
+func NewRawShims(parent *Raw) *RawShims {
+	rs := &RawShims{
+		parent: parent,
+	}
+
+	rs.cmd = &cobra.Command{
+		Use:           "shims",
+		Short:         "Generate wrapper executables that run the pinned release of the predefined utilities. Without arguments, all utilities are shimmed",
+		Example:       parent.parent.cmd.Use + " " + parent.cmd.Use + " shims --dir ~/.local/bin kubectl flux",
+		Long:          ``,
+		RunE:          rs.RunRawShimsCommand,
+		SilenceErrors: parent.Cmd().SilenceErrors,
+		SilenceUsage:  parent.Cmd().SilenceUsage,
+	}
+
+	parent.Cmd().AddCommand(rs.cmd)
+
+	rs.cmd.Flags().StringP(
+		rs.KeyDir(),
+		"d",
+		"",
+		"[Required] Directory where to write the shims. Should be in the PATH",
+	)
+
+	// Bind flags to config
+	config.ViperBindPFlagSet(rs.cmd, nil)
+
+	return rs
+}
+
+func (r *RawShims) RunRawShimsCommand(cmd *cobra.Command, args []string) error {
+	if err := r.CheckRequiredFlags(); err != nil {
+		return err
+	}
+
+	commands, err := r.parent.Utilities()
+	if err != nil {
+		return err
+	}
+
+	dir, err := filepath.Abs(r.Dir())
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+
+	kubestrapPath, err := process.CurrentProcessPathE()
+	if err != nil {
+		return err
+	}
+	kubestrapArgs := []string{kubestrapPath}
+	if configFile := viper.ConfigFileUsed(); configFile != "" {
+		configFile, err = filepath.Abs(configFile)
+		if err != nil {
+			return err
+		}
+		kubestrapArgs = append(kubestrapArgs, "--config", configFile)
+	}
+	kubestrapArgs = append(kubestrapArgs, "--log-level", "error", r.parent.Cmd().Use)
+
+	shimmed := 0
+	for _, c := range commands {
+		for _, name := range append([]string{c.Name}, c.Additional...) {
+			if len(args) > 0 && !slices.Contains(args, name) && !slices.Contains(args, c.Name) {
+				continue
+			}
+			shimPath, err := kubestrap.WriteShim(dir, name, append(kubestrapArgs, "which", name))
+			if err != nil {
+				return err
+			}
+			log.Infof("wrote: %s", shimPath)
+			shimmed++
+		}
+	}
+	if shimmed == 0 {
+		return fmt.Errorf("none of %v is supported, perhaps add them to the config?", args)
+	}
+
+	return nil
+}
+
+func (r *RawShims) Cmd() *cobra.Command {
+	return r.cmd
+}
+
+func (r *RawShims) CheckRequiredFlags() error {
+	return config.CheckRequiredFlags(r.cmd, []string{r.KeyDir()})
+}
+
+func (r *RawShims) KeyDir() string {
+	return "dir"
+}
+
+func (r *RawShims) Dir() string {
+	return config.ViperGetString(r.cmd, r.KeyDir())
+}
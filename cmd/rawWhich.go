@@ -0,0 +1,94 @@
+/*
+Copyright © 2023 Dataflows
+*/
+package cmd
+
+import (
+	"fmt"
+	"os/exec"
+	"path/filepath"
+
+	"github.com/spf13/cobra"
+	"github.com/thedataflows/go-commons/pkg/config"
+	"github.com/thedataflows/go-commons/pkg/file"
+	"github.com/thedataflows/kubestrap/pkg/kubestrap"
+)
+
+type RawWhich struct {
+	cmd    *cobra.Command
+	parent *Raw
+}
+
+var (
+	_ = NewRawWhich(raw)
+)
+
+func init() {
+
+}
+
+func NewRawWhich(parent *Raw) *RawWhich {
+	rw := &RawWhich{
+		parent: parent,
+	}
+
+	rw.cmd = &cobra.Command{
+		Use:           "which",
+		Short:         "Ensure the pinned release of a utility is available and print its path",
+		Long:          ``,
+		Aliases:       []string{"w"},
+		RunE:          rw.RunRawWhichCommand,
+		SilenceErrors: parent.Cmd().SilenceErrors,
+		SilenceUsage:  parent.Cmd().SilenceUsage,
+	}
+
+	parent.Cmd().AddCommand(rw.cmd)
+
+	// Bind flags to config
+	config.ViperBindPFlagSet(rw.cmd, nil)
+
+	return rw
+}
+
+func (r *RawWhich) RunRawWhichCommand(cmd *cobra.Command, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("exactly one utility must be specified")
+	}
+
+	c, err := r.parent.Utility(args[0])
+	if err != nil {
+		return err
+	}
+	// shims run this command, so they must not be found instead of the executable
+	if err := kubestrap.RemoveShimDirsFromPath(args[0]); err != nil {
+		return err
+	}
+	if c.Name != args[0] {
+		if err := kubestrap.RemoveShimDirsFromPath(c.Name); err != nil {
+			return err
+		}
+	}
+	// Set PATH and ensure the pinned release
+	exeDir, err := c.ExeDir()
+	if err != nil {
+		return err
+	}
+	if err := c.CheckCommand(r.parent.Timeout()); err != nil {
+		return err
+	}
+	exePath := filepath.Join(exeDir, file.AppendExtension(args[0]))
+	if !file.IsFile(exePath) {
+		// the pinned release is installed elsewhere in the PATH
+		if exePath, err = exec.LookPath(args[0]); err != nil {
+			return err
+		}
+	}
+
+	fmt.Println(exePath)
+
+	return nil
+}
+
+func (r *RawWhich) Cmd() *cobra.Command {
+	return r.cmd
+}
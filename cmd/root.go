@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"path/filepath"
 	"strings"
 
 	"github.com/thedataflows/go-commons/pkg/config"
@@ -14,6 +15,7 @@ import (
 	"github.com/thedataflows/go-commons/pkg/log"
 	"github.com/thedataflows/go-commons/pkg/process"
 	"github.com/thedataflows/kubestrap/pkg/constants"
+	"github.com/thedataflows/kubestrap/pkg/kubestrap"
 
 	"github.com/spf13/cobra"
 )
@@ -84,6 +86,12 @@ func NewRoot() *Root {
 		"Project root directory",
 	)
 
+	configOpts.Flags.String(
+		r.KeyKnownHosts(),
+		r.DefaultKnownHosts(),
+		fmt.Sprintf("SSH host key verification mode against the known_hosts file in the cluster path. One of: %v. In 'tofu' mode, keys of new hosts are recorded on first connection; in 'strict' mode, unknown hosts are refused", kubestrap.KnownHostsModes),
+	)
+
 	r.cmd.PersistentFlags().AddFlagSet(configOpts.Flags)
 	config.ViperBindPFlagSet(r.cmd, configOpts.Flags)
 	_ = r.cmd.ParseFlags(os.Args[1:])
@@ -111,3 +119,28 @@ func (r *Root) DefaultProjectRoot() string {
 func (r *Root) ProjectRoot() string {
 	return config.ViperGetString(r.cmd, r.KeyProjectRoot())
 }
+
+func (r *Root) KeyKnownHosts() string {
+	return "known-hosts"
+}
+
+func (r *Root) DefaultKnownHosts() string {
+	return kubestrap.KnownHostsTofu
+}
+
+func (r *Root) KnownHostsMode() string {
+	return config.ViperGetString(r.cmd, r.KeyKnownHosts())
+}
+
+// KnownHosts returns the host key verification backed by the known_hosts file in the cluster bootstrap path, and enables it for all rig connections
+func (r *Root) KnownHosts(clusterBootstrapPath string) (*kubestrap.KnownHosts, error) {
+	kh, err := kubestrap.NewKnownHosts(
+		filepath.Join(clusterBootstrapPath, constants.DefaultClusterKnownHostsFileName),
+		r.KnownHostsMode(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	kh.UseForRig()
+	return kh, nil
+}
@@ -10,11 +10,13 @@ import (
 	"github.com/thedataflows/go-commons/pkg/config"
 	"github.com/thedataflows/go-commons/pkg/defaults"
 	"github.com/thedataflows/kubestrap/pkg/kubernetes"
+	"github.com/thedataflows/kubestrap/pkg/kubestrap"
 )
 
 type Secrets struct {
-	cmd    *cobra.Command
-	parent *Root
+	cmd              *cobra.Command
+	parent           *Root
+	passphraseSource *kubestrap.PassphraseSource
 }
 
 var (
@@ -75,6 +77,42 @@ func NewSecrets(parent *Root) *Secrets {
 		"Kubernetes cluster directory",
 	)
 
+	s.cmd.PersistentFlags().String(
+		s.KeySshCa(),
+		s.DefaultSshCa(),
+		"SSH certificate authority private key, encrypted with age. The public key has the same path with the '.pub' suffix",
+	)
+
+	s.cmd.PersistentFlags().String(
+		s.KeyVaultFile(),
+		s.DefaultVaultFile(),
+		"Vault of generated passphrases, encrypted with age",
+	)
+
+	s.cmd.PersistentFlags().String(
+		s.KeyPassphraseEnv(),
+		"",
+		"Environment variable holding the passphrase of the age and SSH keys, instead of prompting",
+	)
+
+	s.cmd.PersistentFlags().Int(
+		s.KeyPassphraseFd(),
+		-1,
+		"File descriptor to read the passphrase of the age and SSH keys from, instead of prompting. 0 is the standard input",
+	)
+
+	s.cmd.PersistentFlags().String(
+		s.KeyPassphraseFile(),
+		"",
+		"File to read the passphrase of the age and SSH keys from, instead of prompting",
+	)
+
+	s.cmd.PersistentFlags().String(
+		s.KeyPassphraseCommand(),
+		"",
+		"Command printing the passphrase of the age and SSH keys on the first line, instead of prompting. E.g. 'pass show kubestrap/mycontext'",
+	)
+
 	// Bind flags to config
 	config.ViperBindPFlagSet(s.cmd, s.cmd.PersistentFlags())
 
@@ -86,7 +124,10 @@ func (s *Secrets) Cmd() *cobra.Command {
 }
 
 func (s *Secrets) CheckRequiredFlags() error {
-	return config.CheckRequiredFlags(s.cmd, []string{s.KeySecretsContext()})
+	if err := config.CheckRequiredFlags(s.cmd, []string{s.KeySecretsContext()}); err != nil {
+		return err
+	}
+	return s.PassphraseSource().Validate()
 }
 
 // KeySecretsContext returns key for SecretsContext
@@ -172,3 +213,70 @@ func (s *Secrets) KubeClusterDir() string {
 	}
 	return secretsEncryptKubeClusterDir
 }
+
+func (s *Secrets) KeySshCa() string {
+	return "ssh-ca-key"
+}
+
+func (s *Secrets) DefaultSshCa() string {
+	return "secrets/" + defaults.Undefined + ".ssh-ca.age"
+}
+
+func (s *Secrets) SshCa() string {
+	sshCa := config.ViperGetString(s.cmd, s.KeySshCa())
+	if sshCa == s.DefaultSshCa() {
+		sshCa = s.SecretsDir() + "/" + s.SecretsContext() + ".ssh-ca.age"
+	}
+	return sshCa
+}
+
+func (s *Secrets) KeyVaultFile() string {
+	return "vault-file"
+}
+
+func (s *Secrets) DefaultVaultFile() string {
+	return "secrets/" + defaults.Undefined + ".vault.age"
+}
+
+func (s *Secrets) VaultFile() string {
+	vaultFile := config.ViperGetString(s.cmd, s.KeyVaultFile())
+	if vaultFile == s.DefaultVaultFile() {
+		vaultFile = s.SecretsDir() + "/" + s.SecretsContext() + ".vault.age"
+	}
+	return vaultFile
+}
+
+// AgePrivateKeyPath returns the default age private key path of the context. The public key has the same path with the '.pub' suffix
+func (s *Secrets) AgePrivateKeyPath() string {
+	return s.SecretsDir() + "/" + s.SecretsContext() + ".age"
+}
+
+func (s *Secrets) KeyPassphraseEnv() string {
+	return "passphrase-env"
+}
+
+func (s *Secrets) KeyPassphraseFd() string {
+	return "passphrase-fd"
+}
+
+func (s *Secrets) KeyPassphraseFile() string {
+	return "passphrase-file"
+}
+
+func (s *Secrets) KeyPassphraseCommand() string {
+	return "passphrase-command"
+}
+
+// PassphraseSource returns the non-interactive source of the age and SSH keys passphrase. It is read once per run
+func (s *Secrets) PassphraseSource() *kubestrap.PassphraseSource {
+	if s.passphraseSource == nil {
+		s.passphraseSource = &kubestrap.PassphraseSource{
+			Env:     config.ViperGetString(s.cmd, s.KeyPassphraseEnv()),
+			Fd:      config.ViperGetInt(s.cmd, s.KeyPassphraseFd()),
+			File:    config.ViperGetString(s.cmd, s.KeyPassphraseFile()),
+			Command: config.ViperGetString(s.cmd, s.KeyPassphraseCommand()),
+			Stdin:   stdInBytes,
+		}
+	}
+	return s.passphraseSource
+}
@@ -11,6 +11,7 @@ import (
 	"crypto/elliptic"
 	"crypto/rand"
 	"encoding/pem"
+	"errors"
 	"fmt"
 	"os"
 	"slices"
@@ -23,6 +24,7 @@ import (
 	"github.com/thedataflows/go-commons/pkg/log"
 	"github.com/thedataflows/go-commons/pkg/search"
 	"github.com/thedataflows/kubestrap/pkg/constants"
+	"github.com/thedataflows/kubestrap/pkg/kubestrap"
 	"golang.org/x/crypto/ssh"
 	"golang.org/x/term"
 )
@@ -109,8 +111,9 @@ func (s *SecretsBootstrap) RunBootstrapSecretsCommand(cmd *cobra.Command, args [
 	}
 
 	log.Info("generating source files encryption keys")
+	// the sops config and the vault storing generated passphrases depend on the age key
 	if err := s.GenerateAgeKeys(); err != nil {
-		log.Errorf("error generating source files encryption keys: %s", err)
+		return fmt.Errorf("error generating source files encryption keys: %s", err)
 	}
 
 	if err := s.PatchSopsConfig(); err != nil {
@@ -133,21 +136,14 @@ func (s *SecretsBootstrap) GenerateAgeKeys() error {
 	}
 
 	privateKeyPath := s.PrivateKeyPath()
-	plainKeyFile := privateKeyPath + ".plain"
-	encrypt := false
+	// the unencrypted identity stays in memory
+	var identity []byte
 	if !file.IsAccessible(privateKeyPath) || s.Force() {
-		// Create the private key
-		if err := raw.RunRawCommand(
-			raw.Cmd(),
-			[]string{
-				"age-keygen",
-				"--output",
-				plainKeyFile,
-			},
-		); err != nil {
+		var err error
+		identity, _, err = kubestrap.GenerateAgeIdentity()
+		if err != nil {
 			return err
 		}
-		encrypt = true
 	} else {
 		finder := search.TextFinder{
 			Text: []byte("-----BEGIN AGE ENCRYPTED FILE-----"),
@@ -159,76 +155,152 @@ func (s *SecretsBootstrap) GenerateAgeKeys() error {
 			if len(found.Results) > 0 {
 				return fmt.Errorf("'%s' exists. Use --force flag to override", privateKeyPath)
 			}
-			if err := os.Rename(privateKeyPath, plainKeyFile); err != nil {
+			var err error
+			if identity, err = os.ReadFile(privateKeyPath); err != nil {
 				return err
 			}
-			encrypt = true
 		}
 	}
-	if encrypt {
-		// Encrypt the private key in place
-		if err := raw.RunRawCommand(
-			raw.Cmd(),
-			[]string{
-				"age",
-				"--encrypt",
-				"--armor",
-				"--passphrase",
-				"--output",
-				privateKeyPath,
-				plainKeyFile,
-			},
-		); err != nil {
-			return err
-		}
+	if identity == nil {
+		return nil
 	}
 
-	if !file.IsAccessible(s.PublicKeyPath()) || s.Force() {
-		// try to create the public key
-		if err := raw.RunRawCommand(
-			raw.Cmd(),
-			[]string{
-				"age-keygen",
-				"-y",
-				"--output",
-				s.PublicKeyPath(),
-				plainKeyFile,
-			},
-		); err != nil {
+	ownRecipients, err := kubestrap.AgeRecipients(identity)
+	if err != nil {
+		return err
+	}
+	publicKeys := slices.Clone(ownRecipients)
+	publicKeyData := []byte(strings.Join(ownRecipients, "\n") + "\n")
+	// other recipients already listed, like a recovery key, are kept unless forced
+	if file.IsAccessible(s.PublicKeyPath()) && !s.Force() {
+		listed, err := readPublicKeys(s.PublicKeyPath())
+		if err != nil {
+			return err
+		}
+		data, err := os.ReadFile(s.PublicKeyPath())
+		if err != nil {
 			return err
 		}
+		if slices.ContainsFunc(ownRecipients, func(r string) bool { return !slices.Contains(listed, r) }) {
+			publicKeyData = append(publicKeyData, data...)
+		} else {
+			publicKeyData = nil
+		}
+		for _, pk := range listed {
+			if !slices.Contains(publicKeys, pk) {
+				publicKeys = append(publicKeys, pk)
+			}
+		}
+	}
+	// read before anything is written, as it may be missing
+	passphrase, generated, err := readAgeKeyPassphrase(s.PublicKeyPath(), publicKeys, ownRecipients)
+	if err != nil {
+		return err
 	}
 
-	if file.IsAccessible(plainKeyFile) {
-		if err := os.Remove(plainKeyFile); err != nil {
-			log.Errorf("failed to remove unencrypted '%s': %s", plainKeyFile, err)
+	// the public key goes first, as the vault storing a generated passphrase is encrypted to it
+	if publicKeyData != nil {
+		if err := os.WriteFile(s.PublicKeyPath(), publicKeyData, 0600); err != nil {
+			return fmt.Errorf("error writing public key: %s", err)
 		}
+		log.Infof("wrote: %s", s.PublicKeyPath())
 	}
 
-	return nil
+	if err := encryptAgeIdentity(identity, passphrase, generated, privateKeyPath, privateKeyPath, s.PublicKeyPath()); err != nil {
+		return err
+	}
+	log.Infof("wrote: %s", privateKeyPath)
+	// later vault updates use the key from memory, as a generated passphrase is never shown
+	return os.Setenv("SOPS_AGE_KEY", string(identity))
 }
 
-// PatchSopsConfig patches sops config file with age public key
-func (s *SecretsBootstrap) PatchSopsConfig() error {
-	sopsConfigPath := s.parent.SopsConfig()
-	log.Infof("patching sops config: %s", sopsConfigPath)
-	if !file.IsAccessible(sopsConfigPath) {
-		return fmt.Errorf("'%s' is not accessible", sopsConfigPath)
+// readAgeKeyPassphrase returns the passphrase of a new age key. It is only generated when the recipients of the vault storing it,
+// listed in publicKeyPath, include one able to recover it, other than the excluded ones, like the age key itself
+func readAgeKeyPassphrase(publicKeyPath string, publicKeys, exclude []string) ([]byte, bool, error) {
+	recoverable := slices.ContainsFunc(publicKeys, func(pk string) bool { return !slices.Contains(exclude, pk) })
+	passphrase, generated, err := readOrGeneratePassphrase("age key", 32, recoverable)
+	if errors.Is(err, errPassphraseRequired) {
+		return nil, false, fmt.Errorf("%w: a generated one would be stored in a vault no recovery recipient decrypts. Add a recovery recipient to '%s', or set one of --%s, --%s, --%s or --%s",
+			err, publicKeyPath, secrets.KeyPassphraseEnv(), secrets.KeyPassphraseFd(), secrets.KeyPassphraseFile(), secrets.KeyPassphraseCommand())
+	}
+	return passphrase, generated, err
+}
+
+// encryptAgeIdentity encrypts the identity from memory with the passphrase, replacing privateKeyPath only once encrypted.
+// A generated passphrase is stored first in the vault, decrypted with vaultPrivateKeyPath and encrypted to the recipients in vaultPublicKeyPath
+func encryptAgeIdentity(identity, passphrase []byte, generated bool, privateKeyPath, vaultPrivateKeyPath, vaultPublicKeyPath string) error {
+	if generated {
+		vaultFile := secrets.VaultFile()
+		entryName := vaultEntryName(privateKeyPath)
+		if err := updateVault(vaultFile, vaultPrivateKeyPath, vaultPublicKeyPath, func(entries map[string]string) {
+			entries[entryName] = string(passphrase)
+		}); err != nil {
+			return fmt.Errorf("error storing generated age key passphrase in vault: %v", err)
+		}
+		log.Infof("stored generated age key passphrase in vault '%s' as '%s'", vaultFile, entryName)
 	}
-	pubKeysData, err := os.ReadFile(s.PublicKeyPath())
+	out, err := kubestrap.AgeEncryptWithPassphrase(identity, passphrase)
 	if err != nil {
 		return err
 	}
+	newPrivateKeyPath := privateKeyPath + ".new"
+	if err := os.WriteFile(newPrivateKeyPath, out, 0600); err != nil {
+		_ = os.Remove(newPrivateKeyPath)
+		return err
+	}
+	return os.Rename(newPrivateKeyPath, privateKeyPath)
+}
+
+// readPublicKeys returns the age and SSH public keys in a public key file, without comments
+func readPublicKeys(publicKeyPath string) ([]string, error) {
+	pubKeysData, err := os.ReadFile(publicKeyPath)
+	if err != nil {
+		return nil, err
+	}
 	pubKeys := strings.Split(string(pubKeysData), "\n")
 	filteredPubKeys := make([]string, 0, len(pubKeys))
 	for _, pk := range pubKeys {
 		pk = strings.TrimSpace(pk)
-		if len(pk) > 0 {
-			filteredPubKeys = append(filteredPubKeys, "\""+pk+"\"")
+		if len(pk) == 0 || strings.HasPrefix(pk, "#") {
+			continue
 		}
+		// SSH public keys are returned without their comment, as age ignores it
+		recipient, _, err := kubestrap.ParseRecipient(pk)
+		if err != nil {
+			return nil, fmt.Errorf("'%s': %v", publicKeyPath, err)
+		}
+		filteredPubKeys = append(filteredPubKeys, recipient)
+	}
+	return filteredPubKeys, nil
+}
+
+// PatchSopsConfig patches sops config file with the age and SSH public keys in the public key file
+func (s *SecretsBootstrap) PatchSopsConfig() error {
+	filteredPubKeys, err := readPublicKeys(s.PublicKeyPath())
+	if err != nil {
+		return err
 	}
 	if len(filteredPubKeys) == 0 {
-		return fmt.Errorf("'%s' contains empty lines", s.PublicKeyPath())
+		return fmt.Errorf("'%s' contains no public keys", s.PublicKeyPath())
+	}
+	return patchSopsConfig(s.parent.SopsConfig(), filteredPubKeys, nil)
+}
+
+// patchSopsConfig adds and removes age recipients in all key groups of the sops config file
+func patchSopsConfig(sopsConfigPath string, add, remove []string) error {
+	log.Infof("patching sops config: %s", sopsConfigPath)
+	if !file.IsAccessible(sopsConfigPath) {
+		return fmt.Errorf("'%s' is not accessible", sopsConfigPath)
+	}
+	if _, err := sopsConfigKeyGroups(sopsConfigPath); err != nil {
+		return err
+	}
+	quote := func(recipients []string) string {
+		quoted := make([]string, 0, len(recipients))
+		for _, r := range recipients {
+			quoted = append(quoted, "\""+r+"\"")
+		}
+		return strings.Join(quoted, ",")
 	}
 	const yqExpr = `.creation_rules[].key_groups[].age`
 	if err := raw.RunRawCommand(
@@ -237,7 +309,7 @@ func (s *SecretsBootstrap) PatchSopsConfig() error {
 			"yq",
 			"--inplace",
 			"--prettyPrint",
-			fmt.Sprintf("%s += [%s] | %s  = (%s | unique)", yqExpr, strings.Join(filteredPubKeys, ","), yqExpr, yqExpr),
+			fmt.Sprintf("%s += [%s] | %s -= [%s] | %s  = (%s | unique)", yqExpr, quote(add), yqExpr, quote(remove), yqExpr, yqExpr),
 			sopsConfigPath,
 		},
 	); err != nil {
@@ -261,10 +333,25 @@ func (s *SecretsBootstrap) GenerateSshKeys(keyBaseFileName string) error {
 	if file.IsFile(privateKeyFile) && !s.Force() {
 		return fmt.Errorf("'%s' exists. Use --force flag to override", privateKeyFile)
 	}
-	sshPubKey, sshPrivKey, err := GenerateEncodedKeyPair(s.SshKeyType())
+	passphrase, generated, err := readOrGeneratePassphrase("SSH key", 32, true)
+	if err != nil {
+		return err
+	}
+	sshPubKey, sshPrivKey, err := GenerateEncodedKeyPair(s.SshKeyType(), passphrase)
 	if err != nil {
 		return fmt.Errorf("failed: %s. Perhaps try with ssh-keygen?", err)
 	}
+	if generated {
+		// stored before the key is written, so it can always be decrypted
+		vaultFile := s.parent.VaultFile()
+		entryName := vaultEntryName(privateKeyFile)
+		if err := updateVault(vaultFile, s.PrivateKeyPath(), s.PublicKeyPath(), func(entries map[string]string) {
+			entries[entryName] = string(passphrase)
+		}); err != nil {
+			return fmt.Errorf("error storing generated SSH key passphrase in vault: %v", err)
+		}
+		log.Infof("stored generated SSH key passphrase in vault '%s' as '%s'", vaultFile, entryName)
+	}
 
 	if err := os.WriteFile(
 		privateKeyFile,
@@ -289,11 +376,16 @@ func (s *SecretsBootstrap) GenerateSshKeys(keyBaseFileName string) error {
 	return nil
 }
 
-func GenerateEncodedKeyPair(keyType string) (pubKeyBytes, privKeyBytes []byte, err error) {
-	var (
-		privateKeyRaw crypto.PrivateKey
-		publicKeySsh  ssh.PublicKey
-	)
+func GenerateEncodedKeyPair(keyType string, passphrase []byte) (pubKeyBytes, privKeyBytes []byte, err error) {
+	privateKeyRaw, publicKeySsh, err := generateKeyPair(keyType)
+	if err != nil {
+		return nil, nil, err
+	}
+	return encodeKeyPair(privateKeyRaw, publicKeySsh, passphrase)
+}
+
+// generateKeyPair generates a private key of keyType and its SSH public key
+func generateKeyPair(keyType string) (privateKeyRaw crypto.PrivateKey, publicKeySsh ssh.PublicKey, err error) {
 	switch keyType {
 	// "ecdsa-P256":
 	case sshKeyTypes[0]:
@@ -318,15 +410,15 @@ func GenerateEncodedKeyPair(keyType string) (pubKeyBytes, privKeyBytes []byte, e
 	if err != nil {
 		return nil, nil, err
 	}
+	return privateKeyRaw, publicKeySsh, nil
+}
 
+// encodeKeyPair encodes the public key in authorized keys format and the private key as PEM, encrypted with passphrase
+func encodeKeyPair(privateKeyRaw crypto.PrivateKey, publicKeySsh ssh.PublicKey, passphrase []byte) (pubKeyBytes, privKeyBytes []byte, err error) {
 	// encode public key
 	pubKeyBytes = ssh.MarshalAuthorizedKey(publicKeySsh)
 
 	// encrypt private key with passphrase
-	passphrase, err := readOrGeneratePassphrase("SSH key", 32)
-	if err != nil {
-		return nil, nil, err
-	}
 	var privBlock *pem.Block
 	if privBlock, err = ssh.MarshalPrivateKeyWithPassphrase(privateKeyRaw, "", passphrase); err != nil {
 		return nil, nil, err
@@ -353,28 +445,43 @@ func generateEcdsaKey(curve elliptic.Curve) (ssh.PublicKey, *ecdsa.PrivateKey, e
 	return publicKeySsh, privateKeyRaw, nil
 }
 
-func readOrGeneratePassphrase(subject string, length int) ([]byte, error) {
-	fmt.Fprintf(os.Stderr, "Enter passphrase for %s or leave blank to generate: ", subject)
+// errPassphraseRequired is returned when a passphrase is left blank but can not be generated
+var errPassphraseRequired = errors.New("passphrase required")
+
+// readOrGeneratePassphrase returns the passphrase from the configured source, or reads it from the terminal and, if allowed by generate,
+// generates one if left blank. A generated passphrase is not shown: callers store it in the vault
+func readOrGeneratePassphrase(subject string, length int, generate bool) (passphrase []byte, generated bool, err error) {
+	if source := secrets.PassphraseSource(); source.IsSet() {
+		log.Infof("using %s passphrase from %s", subject, source)
+		passphrase, err = source.Read()
+		return passphrase, false, err
+	}
+	if generate {
+		fmt.Fprintf(os.Stderr, "Enter passphrase for %s or leave blank to generate: ", subject)
+	} else {
+		fmt.Fprintf(os.Stderr, "Enter passphrase for %s: ", subject)
+	}
 	password1, err := term.ReadPassword(int(os.Stdin.Fd()))
 	fmt.Fprintln(os.Stderr)
 	if err != nil {
-		return nil, err
+		return nil, false, err
 	}
 	if len(password1) == 0 {
-		password1 = []byte(randomBytes(length))
-		fmt.Printf("%s generated passphrase: %s\n", subject, string(password1))
-	} else {
-		fmt.Fprintf(os.Stderr, "Confirm %s passphrase: ", subject)
-		password2, err := term.ReadPassword(int(os.Stdin.Fd()))
-		fmt.Fprintln(os.Stderr)
-		if err != nil {
-			return nil, err
-		}
-		if !bytes.Equal(password1, password2) {
-			return nil, fmt.Errorf("%s passphrases do not match", subject)
+		if !generate {
+			return nil, false, fmt.Errorf("%w for %s", errPassphraseRequired, subject)
 		}
+		return randomBytes(length), true, nil
+	}
+	fmt.Fprintf(os.Stderr, "Confirm %s passphrase: ", subject)
+	password2, err := term.ReadPassword(int(os.Stdin.Fd()))
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return nil, false, err
+	}
+	if !bytes.Equal(password1, password2) {
+		return nil, false, fmt.Errorf("%s passphrases do not match", subject)
 	}
-	return password1, nil
+	return password1, false, nil
 }
 
 // randomBytes generates random bytes of given length from an existing charset
@@ -0,0 +1,203 @@
+/*
+Copyright © 2023 Dataflows
+*/
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/thedataflows/go-commons/pkg/file"
+	"github.com/thedataflows/go-commons/pkg/log"
+	"github.com/thedataflows/kubestrap/pkg/constants"
+)
+
+type SecretsCheckStaged struct {
+	cmd    *cobra.Command
+	parent *Secrets
+}
+
+// stagedSecret is a staged secret file and the sops config next to it
+type stagedSecret struct {
+	path       string
+	sopsConfig string
+}
+
+var (
+	_ = NewSecretsCheckStaged(secrets)
+)
+
+func init() {
+
+}
+
+func NewSecretsCheckStaged(parent *Secrets) *SecretsCheckStaged {
+	sc := &SecretsCheckStaged{
+		parent: parent,
+	}
+
+	sc.cmd = &cobra.Command{
+		Use:   "check-staged [PATTERN]...",
+		Short: "Fails when a secret file staged for commit is not encrypted with sops. Called by the pre-commit hook",
+		Long: `Staged files are checked when a '.sops.yaml' is found in their directory or a parent one, like the one of each Kubernetes cluster directory.
+A file is a secret file when its path, relative to that directory, matches any of the patterns, by default '` + constants.DefaultSecretFilesPattern + `',
+or the path_regex of a creation rule of the sops config. Its staged content must have sops metadata, whatever is in the working tree.
+It needs neither the context nor a remote, only a local git repository.`,
+		Example:       parent.parent.cmd.Use + " " + parent.cmd.Use + " check-staged",
+		Aliases:       []string{"cs"},
+		RunE:          sc.RunSecretsCheckStagedCommand,
+		SilenceErrors: parent.Cmd().SilenceErrors,
+		SilenceUsage:  parent.Cmd().SilenceUsage,
+	}
+
+	parent.Cmd().AddCommand(sc.cmd)
+
+	return sc
+}
+
+func (s *SecretsCheckStaged) RunSecretsCheckStagedCommand(cmd *cobra.Command, args []string) error {
+	if len(args) == 0 {
+		args = []string{constants.DefaultSecretFilesPattern}
+	}
+	patterns := make([]*regexp.Regexp, 0, len(args))
+	for _, arg := range args {
+		pattern, err := regexp.Compile(arg)
+		if err != nil {
+			return err
+		}
+		patterns = append(patterns, pattern)
+	}
+
+	out, err := runGit("", "rev-parse", "--show-toplevel")
+	if err != nil {
+		return err
+	}
+	repoRoot := strings.TrimSpace(string(out))
+	// added, copied, modified and renamed files, as deleted ones can not leak anything
+	out, err = runGit(repoRoot, "diff", "--cached", "--name-only", "--diff-filter=ACMR", "-z")
+	if err != nil {
+		return err
+	}
+
+	plain := []stagedSecret{}
+	checked := 0
+	for _, stagedPath := range strings.Split(strings.TrimRight(string(out), "\x00"), "\x00") {
+		if stagedPath == "" {
+			continue
+		}
+		secret, err := s.stagedSecret(repoRoot, stagedPath, patterns)
+		if err != nil {
+			return err
+		}
+		if secret == nil {
+			continue
+		}
+		checked++
+		data, err := runGit(repoRoot, "show", ":"+stagedPath)
+		if err != nil {
+			return err
+		}
+		if !isSopsEncrypted(stagedPath, data) {
+			plain = append(plain, *secret)
+		}
+	}
+	log.Infof("checked %d staged secret files", checked)
+
+	if len(plain) == 0 {
+		return nil
+	}
+	message := &strings.Builder{}
+	fmt.Fprintf(message, "%d staged secret files are not encrypted with sops:\n", len(plain))
+	for _, p := range plain {
+		fmt.Fprintf(message, "  %s\n", p.path)
+	}
+	message.WriteString("Encrypt and stage them again with:\n")
+	for _, p := range plain {
+		fmt.Fprintf(message, "  sops --config %s --encrypt --in-place %s && git add %s\n", p.sopsConfig, p.path, p.path)
+	}
+	message.WriteString("Or unstage them with 'git rm --cached'. 'git commit --no-verify' skips this check")
+	return fmt.Errorf("%s", message.String())
+}
+
+// stagedSecret returns the staged file with its sops config when it is a secret file, or nil otherwise
+func (s *SecretsCheckStaged) stagedSecret(repoRoot, stagedPath string, patterns []*regexp.Regexp) (*stagedSecret, error) {
+	// git paths are slash separated and relative to the repository root
+	for dir := path.Dir(stagedPath); ; dir = path.Dir(dir) {
+		sopsConfig := path.Join(dir, ".sops.yaml")
+		if file.IsFile(filepath.Join(repoRoot, filepath.FromSlash(sopsConfig))) {
+			relPath := strings.TrimPrefix(stagedPath, dir+"/")
+			if dir == "." {
+				relPath = stagedPath
+			}
+			if stagedPath == sopsConfig {
+				return nil, nil
+			}
+			for _, pattern := range patterns {
+				if pattern.MatchString(relPath) {
+					return &stagedSecret{path: stagedPath, sopsConfig: sopsConfig}, nil
+				}
+			}
+			rules, err := readSopsCreationRules(filepath.Join(repoRoot, filepath.FromSlash(sopsConfig)))
+			if err != nil {
+				return nil, err
+			}
+			for _, rule := range rules {
+				if rule.PathRegex == "" {
+					// a rule for all files is a default for sops, it does not make every file a secret
+					continue
+				}
+				matched, err := regexp.MatchString(rule.PathRegex, relPath)
+				if err != nil {
+					return nil, fmt.Errorf("invalid path_regex '%s' in %s: %v", rule.PathRegex, sopsConfig, err)
+				}
+				if matched {
+					return &stagedSecret{path: stagedPath, sopsConfig: sopsConfig}, nil
+				}
+			}
+			return nil, nil
+		}
+		if dir == "." {
+			return nil, nil
+		}
+	}
+}
+
+// isSopsEncrypted returns whether the content has sops metadata. dotenv and INI files keep it in plain keys
+func isSopsEncrypted(name string, data []byte) bool {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".env", ".ini":
+		return bytes.Contains(data, []byte("sops_mac"))
+	}
+	metadata, err := parseSopsMetadata(data)
+	return err == nil && metadata != nil
+}
+
+// runGit runs git in dir, or the current directory when empty, returning its standard output
+func runGit(dir string, args ...string) ([]byte, error) {
+	if dir != "" {
+		args = append([]string{"-C", dir}, args...)
+	}
+	c := exec.Command("git", args...)
+	stderr := &bytes.Buffer{}
+	c.Stderr = stderr
+	out, err := c.Output()
+	if err != nil {
+		return nil, fmt.Errorf("git %s: %v\n%s", strings.Join(args, " "), err, strings.TrimSpace(stderr.String()))
+	}
+	return out, nil
+}
+
+func (s *SecretsCheckStaged) Cmd() *cobra.Command {
+	return s.cmd
+}
+
+// CheckRequiredFlags does not require the context, so the hook works for every cluster in the repository
+func (s *SecretsCheckStaged) CheckRequiredFlags() error {
+	return nil
+}
@@ -5,13 +5,17 @@ package cmd
 
 import (
 	"bufio"
+	"bytes"
+	"encoding/base64"
 	"fmt"
-	"io"
 	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/k0sproject/k0sctl/pkg/apis/k0sctl.k0sproject.io/v1beta1/cluster"
+	"github.com/k0sproject/rig"
 	"github.com/spf13/cobra"
 	"github.com/thedataflows/go-commons/pkg/config"
 	"github.com/thedataflows/go-commons/pkg/defaults"
@@ -33,8 +37,9 @@ import (
 // var defaultSecretsCopySshIdPrivateKeyFile = fmt.Sprintf("bootstrap/cluster-%s/%s", defaults.Undefined, constants.DefaultClusterSshKeyFileName)
 
 type SecretsCopySshId struct {
-	cmd    *cobra.Command
-	parent *Secrets
+	cmd           *cobra.Command
+	parent        *Secrets
+	hostSelection *HostSelection
 }
 
 // SecretsCopySshIdCmd represents the SecretsCopySshId command
@@ -63,10 +68,12 @@ func NewSecretsCopySshId(parent *Secrets) *SecretsCopySshId {
 
 	parent.Cmd().AddCommand(sc.cmd)
 
-	sc.cmd.Flags().StringSlice(
-		sc.KeyHosts(),
-		[]string{},
-		"List of hosts defined in the cluster. If not specified, will run on all hosts",
+	sc.hostSelection = NewHostSelection(sc.cmd)
+
+	sc.cmd.Flags().String(
+		sc.KeyLoginUser(),
+		"",
+		"User to connect as, that can install the identity for the SSH user of the host with passwordless sudo. If not specified, connects as the SSH user of the host",
 	)
 
 	sc.cmd.Flags().StringP(
@@ -95,17 +102,10 @@ func (s *SecretsCopySshId) RunSecretsCopySshIdCommand(cmd *cobra.Command, args [
 	if err != nil {
 		return err
 	}
-	filterHosts := s.Hosts()
-	hosts := cl.GetClusterSpec().Spec.Hosts.Filter(
-		func(h *cluster.Host) bool {
-			for _, filterHost := range filterHosts {
-				if h.Address() == filterHost || h.Metadata.Hostname == filterHost || h.HostnameOverride == filterHost {
-					return true
-				}
-			}
-			return len(filterHosts) == 0
-		},
-	)
+	hosts, err := s.hostSelection.Select(cl.GetClusterSpec().Spec.Hosts)
+	if err != nil {
+		return err
+	}
 
 	// read private key
 	privateKeyFile := s.PrivateKeyFile()
@@ -114,93 +114,116 @@ func (s *SecretsCopySshId) RunSecretsCopySshIdCommand(cmd *cobra.Command, args [
 		log.Errorf("error reading private key file %s: %v", privateKeyFile, err)
 	}
 
-	for i := 0; i < len(hosts); i += 1 {
-		host := lang.If(
-			len(hosts[i].HostnameOverride) > 0,
-			hosts[i].HostnameOverride,
-			hosts[i].Address(),
-		)
-		log.Infof("[%s] connecting", host)
-		// connect
-		sshClient, err := connectToHost("root", hosts[i].Address(), 22, identity)
-		if err != nil {
-			log.Errorf("[%s] error connecting: %v", host, err)
-			continue
-		}
-		defer sshClient.Close()
-		log.Infof("[%s] connected: %s", host, string(sshClient.ServerVersion()))
-		// get remote authorized_keys
-		remoteAuthKeysFile := "~/.ssh/authorized_keys"
-		stdoutPipe, stderrPipe, err := sshRunCommand(
-			sshClient,
-			fmt.Sprintf("[ -r %s ] && cat %s || true", remoteAuthKeysFile, remoteAuthKeysFile),
-		)
-		if err != nil {
-			stderrBytes, _ := io.ReadAll(stderrPipe)
-			log.Errorf("[%s] error running remote command: %v: %s", host, err, string(stderrBytes))
-			continue
-		}
-		// get local pubkey
-		pubKey, err := getPubKey(*hosts[i].SSH.KeyPath, clusterBootstrapPath)
-		if err != nil {
-			log.Errorf("[%s] error reading ssh pubkey: %v", host, err)
-			continue
-		}
-		log.Debugf("[%s] using ssh pubkey '%s'", host, pubKey)
-		pubKeyFound := false
-		// check if pubkey already exists
-		stdoutScanner := bufio.NewScanner(stdoutPipe)
-		for stdoutScanner.Scan() {
-			output := strings.Split(string(stdoutScanner.Bytes()), " ")
-			if len(output) > 1 && strings.Contains(pubKey, output[1]) {
-				log.Warnf("[%s] ssh identity '%s' already exists", host, pubKey)
-				pubKeyFound = true
-				break
-			}
-		}
-		if !pubKeyFound {
-			log.Infof("[%s] copying ssh identity", host)
-			c := fmt.Sprintf(
-				"P=%s; [ ! -d ${P%%/*} ] && mkdir -p ${P%%/*}; echo '%s' >> $P",
-				remoteAuthKeysFile,
-				pubKey,
-			)
-			_, stderrPipe, err = sshRunCommand(sshClient, c)
-			if err != nil {
-				stderrBytes, _ := io.ReadAll(stderrPipe)
-				log.Errorf("[%s] error running remote command '%s': %v: %s", host, c, err, string(stderrBytes))
-				// Try to run ssh-copy-id script if the above failed
-				if err := runSshCopyIdScript(host, clusterBootstrapPath); err != nil {
-					log.Errorf("error running ssh-copy-id script: %v", err)
-					continue
-				}
-			}
+	// key paths in the cluster spec are relative to it
+	clusterBootstrapPath, err = filepath.Abs(clusterBootstrapPath)
+	if err != nil {
+		return err
+	}
+	knownHosts, err := s.parent.parent.KnownHosts(clusterBootstrapPath)
+	if err != nil {
+		return err
+	}
+	currentDir := file.WorkingDirectory()
+	if err := os.Chdir(clusterBootstrapPath); err != nil {
+		return err
+	}
+	defer func() { _ = os.Chdir(currentDir) }()
 
+	failed := 0
+	for _, h := range hosts {
+		if err := s.copySshIdToHost(knownHosts, h, identity, clusterBootstrapPath); err != nil {
+			log.Errorf("[%s] %v", hostLabel(h), err)
+			failed++
 		}
 	}
+	if failed > 0 {
+		return fmt.Errorf("copying ssh identity failed on %d of %d hosts", failed, len(hosts))
+	}
 
 	return nil
 }
 
-func sshRunCommand(sshClient *ssh.Client, command string) (io.Reader, io.Reader, error) {
-	log.Debugf("running remote command: %s", command)
-	session, err := sshClient.NewSession()
+// copySshIdToHost adds the public key of the host to the authorized keys of the host SSH user.
+// Connects with the login user, if set, otherwise with the host SSH user, through the host bastion if any
+func (s *SecretsCopySshId) copySshIdToHost(knownHosts *kubestrap.KnownHosts, h *cluster.Host, identity []byte, clusterBootstrapPath string) error {
+	host := hostLabel(h)
+	if h.SSH == nil {
+		return fmt.Errorf("host is not configured for SSH")
+	}
+	if h.SSH.KeyPath == nil {
+		return fmt.Errorf("ssh keyPath is not configured")
+	}
+	// get local pubkey
+	// keyPath can be the private key, with the public key next to it
+	pubKey, err := getPubKey(strings.TrimSuffix(*h.SSH.KeyPath, ".pub")+".pub", clusterBootstrapPath)
 	if err != nil {
-		return nil, nil, fmt.Errorf("error creating session: %v", err)
+		return fmt.Errorf("error reading ssh pubkey: %v", err)
+	}
+	log.Debugf("[%s] using ssh pubkey '%s'", host, pubKey)
+
+	sshUser := lang.If(h.SSH.User != "", h.SSH.User, "root")
+	loginSettings := &rig.SSH{
+		Address: h.SSH.Address,
+		User:    lang.If(s.LoginUser() != "", s.LoginUser(), sshUser),
+		Port:    h.SSH.Port,
+		KeyPath: h.SSH.KeyPath,
+		Bastion: h.SSH.Bastion,
 	}
-	defer session.Close()
 
-	// Run remote command
-	stdoutPipe, err := session.StdoutPipe()
+	log.Infof("[%s] connecting as '%s'", host, loginSettings.User)
+	sshClient, err := connectToHost(loginSettings, identity, knownHosts.HostKeyCallback())
 	if err != nil {
-		return nil, nil, fmt.Errorf("error creating stdout pipe: %v", err)
+		log.Errorf("[%s] error connecting: %v", host, err)
+		// Try to run ssh-copy-id script if connecting failed
+		if loginSettings.User != sshUser {
+			return err
+		}
+		return runSshCopyIdScript(h.SSH, *h.SSH.KeyPath, knownHosts)
+	}
+	defer sshClient.Close()
+	log.Infof("[%s] connected: %s", host, string(sshClient.ServerVersion()))
+
+	// installing for another user requires elevated privileges, and the key is always owned by the ssh user
+	sudo := lang.If(loginSettings.User != sshUser && loginSettings.User != "root", "sudo -n ", "")
+	c, err := addAuthorizedKeyScript(sshUser, pubKey, sudo)
+	if err != nil {
+		return err
+	}
+	stdout, stderr, err := sshRunCommand(sshClient, c)
+	if err != nil {
+		return fmt.Errorf("error installing ssh identity for '%s': %v: %s", sshUser, err, stderr)
+	}
+	if strings.TrimSpace(stdout) == "exists" {
+		log.Warnf("[%s] ssh identity '%s' already exists for '%s'", host, pubKey, sshUser)
+		return nil
 	}
-	stderrPipe, err := session.StderrPipe()
+	log.Infof("[%s] copied ssh identity for '%s'", host, sshUser)
+	return nil
+}
+
+// hostLabel returns the hostname override of the host, if set, otherwise its address
+func hostLabel(h *cluster.Host) string {
+	return lang.If(
+		len(h.HostnameOverride) > 0,
+		h.HostnameOverride,
+		h.Address(),
+	)
+}
+
+// sshRunCommand runs a command in a new session and returns its stdout and stderr
+func sshRunCommand(sshClient *ssh.Client, command string) (string, string, error) {
+	log.Debugf("running remote command: %s", command)
+	session, err := sshClient.NewSession()
 	if err != nil {
-		return nil, nil, fmt.Errorf("error creating stderr pipe: %v", err)
+		return "", "", fmt.Errorf("error creating session: %v", err)
 	}
+	defer session.Close()
+
+	stdout, stderr := &bytes.Buffer{}, &bytes.Buffer{}
+	session.Stdout = stdout
+	session.Stderr = stderr
 	err = session.Run(command)
-	return stdoutPipe, stderrPipe, err
+	return stdout.String(), stderr.String(), err
 }
 
 func getPubKey(keyPath, clusterBootstrapPath string) (string, error) {
@@ -227,6 +250,15 @@ func getPubKey(keyPath, clusterBootstrapPath string) (string, error) {
 	return "", fmt.Errorf("error parsing ssh pubkey")
 }
 
+// readPassphrase returns the key passphrase from the configured source, or reads it with the prompt
+func readPassphrase(prompt string) ([]byte, error) {
+	if source := secrets.PassphraseSource(); source.IsSet() {
+		log.Debugf("using passphrase from %s", source)
+		return source.Read()
+	}
+	return readInPassword(prompt)
+}
+
 func readInPassword(prompt string) ([]byte, error) {
 	fmt.Fprint(os.Stderr, prompt)
 	if term.IsTerminal(int(os.Stdin.Fd())) {
@@ -243,39 +275,158 @@ func readInPassword(prompt string) ([]byte, error) {
 	return []byte(passphrase), nil
 }
 
-func connectToHost(user, host string, port int, rawPrivateKey []byte) (*ssh.Client, error) {
-	authMethods := []ssh.AuthMethod{}
-	// try private key first
-	if len(rawPrivateKey) > 0 {
-		signer, err := signerFromPrivateKey(rawPrivateKey)
-		if err != nil {
-			log.Errorf("error parsing private key: %v", err)
-		} else {
-			authMethods = append(authMethods, ssh.PublicKeys(signer))
-		}
+// authorizedKeyScript returns the shell script preamble setting the authorized keys file F of user U, in directory D,
+// and the type T and base64 blob B of the public key
+func authorizedKeyScript(user, pubKey string) ([]string, error) {
+	key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(pubKey))
+	if err != nil {
+		return nil, fmt.Errorf("error parsing ssh pubkey: %v", err)
 	}
-	// try password auth after
-	authMethods = append(authMethods, ssh.PasswordCallback(
-		func() (string, error) {
-			password, err := readInPassword("Enter password: ")
+	return []string{
+		"set -e",
+		fmt.Sprintf("U=%s", kubestrap.ShellQuote(user)),
+		fmt.Sprintf("T=%s", kubestrap.ShellQuote(key.Type())),
+		fmt.Sprintf("B=%s", kubestrap.ShellQuote(base64.StdEncoding.EncodeToString(key.Marshal()))),
+		`H="$(getent passwd "$U" | cut -d: -f6)"`,
+		`[ -n "$H" ] || H="$(eval echo "~$U")"`,
+		`D="$H/.ssh"; F="$D/authorized_keys"`,
+	}, nil
+}
+
+// matchAuthorizedKey is an awk condition matching authorized keys lines with key type t and blob b, regardless of options and comment
+const matchAuthorizedKey = `for (i = 1; i < NF; i++) if ($i == t && $(i + 1) == b)`
+
+// addAuthorizedKeyScript returns a shell script adding pubKey to the authorized keys of user, prefixing privileged commands with sudo.
+// Prints 'exists' if the key is already authorized
+func addAuthorizedKeyScript(user, pubKey, sudo string) (string, error) {
+	lines, err := authorizedKeyScript(user, pubKey)
+	if err != nil {
+		return "", err
+	}
+	return strings.Join(
+		append(
+			lines,
+			sudo+`mkdir -p "$D"`,
+			sudo+`touch "$F"`,
+			`if `+sudo+`awk -v t="$T" -v b="$B" '{ `+matchAuthorizedKey+` f = 1 } END { exit !f }' "$F"; then echo exists; else echo "$T $B" | `+sudo+`tee -a "$F" >/dev/null; fi`,
+			sudo+`chmod 0700 "$D"`,
+			sudo+`chmod 0600 "$F"`,
+			sudo+`chown "$U:$(id -gn "$U")" "$D" "$F"`,
+		),
+		"\n",
+	), nil
+}
+
+// removeAuthorizedKeyScript returns a shell script removing pubKey from the authorized keys of user, replacing the file atomically
+func removeAuthorizedKeyScript(user, pubKey string) (string, error) {
+	lines, err := authorizedKeyScript(user, pubKey)
+	if err != nil {
+		return "", err
+	}
+	return strings.Join(
+		append(
+			lines,
+			`[ -f "$F" ] || exit 0`,
+			`N="$(mktemp "$F.XXXXXX")"`,
+			`awk -v t="$T" -v b="$B" '{ `+matchAuthorizedKey+` next } 1' "$F" > "$N" || { rm -f "$N"; exit 1; }`,
+			`chmod 0600 "$N"`,
+			`chown "$U:$(id -gn "$U")" "$N"`,
+			`mv -f "$N" "$F"`,
+		),
+		"\n",
+	), nil
+}
+
+// sshAuthFunc returns the authentication methods for a hop of an SSH connection: the host or one of its bastions
+type sshAuthFunc func(settings *rig.SSH) ([]ssh.AuthMethod, error)
+
+// connectToHost connects to the host with the user and port from SSH settings, through the bastion if any.
+// Authenticates with rawPrivateKey if set, otherwise with a password. Bastions authenticate with their own key, if configured.
+// Host keys are verified with hostKeyCallback
+func connectToHost(settings *rig.SSH, rawPrivateKey []byte, hostKeyCallback ssh.HostKeyCallback) (*ssh.Client, error) {
+	return dialSSH(settings, identityAuth(settings, rawPrivateKey), hostKeyCallback)
+}
+
+// identityAuth authenticates target with rawPrivateKey and the other hops with their own key, if configured, otherwise with rawPrivateKey.
+// A certificate issued for the key, found next to the configured key path, is tried first. A password is prompted for if the key is not accepted
+func identityAuth(target *rig.SSH, rawPrivateKey []byte) sshAuthFunc {
+	return func(settings *rig.SSH) ([]ssh.AuthMethod, error) {
+		key := rawPrivateKey
+		if settings != target && settings.KeyPath != nil {
+			var err error
+			key, err = os.ReadFile(strings.TrimSuffix(*settings.KeyPath, ".pub"))
 			if err != nil {
-				return "", fmt.Errorf("error reading password from terminal: %v", err)
+				return nil, fmt.Errorf("error reading private key: %v", err)
 			}
-			return string(password), nil
-		},
-	))
+		}
 
-	/* #nosec */
+		authMethods := []ssh.AuthMethod{}
+		// try certificate and private key first
+		if len(key) > 0 {
+			signer, err := signerFromPrivateKey(key)
+			if err != nil {
+				log.Errorf("error parsing private key: %v", err)
+			} else {
+				if settings.KeyPath != nil {
+					if certSigner := kubestrap.CertificateSigner(signer, *settings.KeyPath); certSigner != nil {
+						authMethods = append(authMethods, ssh.PublicKeys(certSigner))
+					}
+				}
+				authMethods = append(authMethods, ssh.PublicKeys(signer))
+			}
+		}
+		// try password auth after
+		user := lang.If(settings.User != "", settings.User, "root")
+		address := kubestrap.SSHAddress(settings)
+		authMethods = append(authMethods, ssh.PasswordCallback(
+			func() (string, error) {
+				password, err := readInPassword(fmt.Sprintf("Enter password for %s@%s: ", user, address))
+				if err != nil {
+					return "", fmt.Errorf("error reading password from terminal: %v", err)
+				}
+				return string(password), nil
+			},
+		))
+		return authMethods, nil
+	}
+}
+
+// dialSSH connects to the host with the user and port from SSH settings, through the bastion if any, authenticating each hop with auth
+func dialSSH(settings *rig.SSH, auth sshAuthFunc, hostKeyCallback ssh.HostKeyCallback) (*ssh.Client, error) {
+	authMethods, err := auth(settings)
+	if err != nil {
+		return nil, err
+	}
+	address := kubestrap.SSHAddress(settings)
 	clientConfig := &ssh.ClientConfig{
-		User:            user,
+		User:            lang.If(settings.User != "", settings.User, "root"),
 		Auth:            authMethods,
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		HostKeyCallback: hostKeyCallback,
+	}
+
+	if settings.Bastion == nil {
+		return ssh.Dial("tcp", address, clientConfig)
 	}
 
-	client, err := ssh.Dial("tcp", fmt.Sprintf("%s:%d", host, port), clientConfig)
+	bastionClient, err := dialSSH(settings.Bastion, auth, hostKeyCallback)
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to bastion %s: %v", settings.Bastion.Address, err)
+	}
+	conn, err := bastionClient.Dial("tcp", address)
 	if err != nil {
+		bastionClient.Close()
+		return nil, fmt.Errorf("error dialing %s through bastion %s: %v", address, settings.Bastion.Address, err)
+	}
+	clientConn, chans, reqs, err := ssh.NewClientConn(conn, address, clientConfig)
+	if err != nil {
+		bastionClient.Close()
 		return nil, err
 	}
+	client := ssh.NewClient(clientConn, chans, reqs)
+	go func() {
+		_ = client.Wait()
+		bastionClient.Close()
+	}()
 
 	return client, nil
 }
@@ -285,13 +436,18 @@ func signerFromPrivateKey(privateKey []byte) (ssh.Signer, error) {
 		return nil, fmt.Errorf("private key is empty")
 	}
 	signer, err := ssh.ParsePrivateKey(privateKey)
-	switch err.(type) {
+	switch e := err.(type) {
 	case nil:
 		break
 	case *ssh.PassphraseMissingError:
-		passphrase, err := readInPassword("Enter passphrase to decrypt private key: ")
+		// loaded with 'secrets ssh-add', so no passphrase is needed
+		if agentSigner := kubestrap.AgentSigner(e.PublicKey); agentSigner != nil {
+			log.Debugf("using private key %s from ssh agent", ssh.FingerprintSHA256(e.PublicKey))
+			return agentSigner, nil
+		}
+		passphrase, err := readPassphrase("Enter passphrase to decrypt private key: ")
 		if err != nil {
-			return nil, fmt.Errorf("error reading passphrase from terminal: %v", err)
+			return nil, fmt.Errorf("error reading passphrase: %v", err)
 		}
 		signer, err = ssh.ParsePrivateKeyWithPassphrase(privateKey, passphrase)
 		if err != nil {
@@ -304,12 +460,30 @@ func signerFromPrivateKey(privateKey []byte) (ssh.Signer, error) {
 	return signer, nil
 }
 
-func runSshCopyIdScript(host, clusterBootstrapPath string) error {
-	exeName := "sh"
+// runSshCopyIdScript runs ssh-copy-id for the host SSH user, port and bastion, verifying host keys against the known hosts file
+func runSshCopyIdScript(settings *rig.SSH, keyPath string, knownHosts *kubestrap.KnownHosts) error {
+	exeName := "ssh-copy-id"
+	target := func(s *rig.SSH) string {
+		return lang.If(s.User != "", s.User, "root") + "@" + s.Address
+	}
 	sshCopyIdArgs := []string{
-		"-c",
-		"ssh-copy-id -i " + clusterBootstrapPath + "/" + constants.DefaultClusterSshKeyFileName + " root@" + host,
+		"-i",
+		keyPath,
+		"-p",
+		strconv.Itoa(lang.If(settings.Port > 0, settings.Port, 22)),
+		"-o",
+		"UserKnownHostsFile=" + knownHosts.Path(),
+		"-o",
+		"StrictHostKeyChecking=" + lang.If(knownHosts.Mode() == kubestrap.KnownHostsStrict, "yes", "accept-new"),
+	}
+	if settings.Bastion != nil {
+		sshCopyIdArgs = append(
+			sshCopyIdArgs,
+			"-o",
+			fmt.Sprintf("ProxyJump=%s:%d", target(settings.Bastion), lang.If(settings.Bastion.Port > 0, settings.Bastion.Port, 22)),
+		)
 	}
+	sshCopyIdArgs = append(sshCopyIdArgs, target(settings))
 	status, err := kubestrap.RunProcess(exeName, sshCopyIdArgs, 1*time.Minute, false, nil)
 	if err != nil {
 		return fmt.Errorf("error running '%s %s: %v'", exeName, strings.Join(sshCopyIdArgs, " "), err)
@@ -330,12 +504,12 @@ func (s *SecretsCopySshId) CheckRequiredFlags() error {
 }
 
 // Flags keys, defaults and value getters
-func (s *SecretsCopySshId) KeyHosts() string {
-	return "hosts"
+func (s *SecretsCopySshId) KeyLoginUser() string {
+	return "login-user"
 }
 
-func (s *SecretsCopySshId) Hosts() []string {
-	return config.ViperGetStringSlice(s.cmd, s.KeyHosts())
+func (s *SecretsCopySshId) LoginUser() string {
+	return config.ViperGetString(s.cmd, s.KeyLoginUser())
 }
 
 func (s *SecretsCopySshId) KeyPrivateKeyFile() string {
@@ -16,6 +16,7 @@ import (
 	"github.com/thedataflows/go-commons/pkg/log"
 	"github.com/thedataflows/go-commons/pkg/search"
 	"github.com/thedataflows/kubestrap/pkg/constants"
+	"github.com/thedataflows/kubestrap/pkg/kubestrap"
 )
 
 type SecretsDecrypt struct {
@@ -61,6 +62,12 @@ func NewSecretsDecrypt(parent *Secrets) *SecretsDecrypt {
 		"Private key path",
 	)
 
+	sd.cmd.Flags().String(
+		sd.KeySshPrivateKeyPath(),
+		"",
+		"SSH private key path, decrypting instead of the age private key when the secrets are encrypted to its ssh-ed25519 or ssh-rsa public key",
+	)
+
 	// Bind flags to config
 	config.ViperBindPFlagSet(sd.cmd, nil)
 
@@ -76,7 +83,7 @@ func (s *SecretsDecrypt) RunSecretsDecryptCommand(cmd *cobra.Command, args []str
 		args = []string{constants.DefaultSecretFilesPattern}
 	}
 
-	if err := loadAgePrivateKey(s.PrivateKeyPath()); err != nil {
+	if err := loadSopsIdentity(s.PrivateKeyPath(), s.SshPrivateKeyPath()); err != nil {
 		return err
 	}
 
@@ -125,25 +132,25 @@ func (s *SecretsDecrypt) findFiles(pattern string) *search.Results {
 	return search.FindFile(ctx, s.parent.KubeClusterDir(), fileFilter, finder, runtime.NumCPU())
 }
 
+// loadSopsIdentity makes sops decrypt with the SSH private key when set, otherwise with the age private key.
+// sops prompts for the passphrase of protected SSH keys
+func loadSopsIdentity(agePrivateKeyPath, sshPrivateKeyPath string) error {
+	if sshPrivateKeyPath == "" {
+		return loadAgePrivateKey(agePrivateKeyPath)
+	}
+	if !file.IsFile(sshPrivateKeyPath) {
+		return fmt.Errorf("SSH private key '%s' is not a file", sshPrivateKeyPath)
+	}
+	log.Infof("using SSH private key: %s", sshPrivateKeyPath)
+	return os.Setenv("SOPS_AGE_SSH_PRIVATE_KEY_FILE", sshPrivateKeyPath)
+}
+
 func loadAgePrivateKey(privateKeyPath string) error {
 	if os.Getenv("SOPS_AGE_KEY") == "" {
 		log.Infof("loading private key: %s", privateKeyPath)
-		out, err := raw.RunRawCommandCaptureStdout(
-			raw.Cmd(),
-			[]string{
-				"age",
-				"--decrypt",
-				privateKeyPath,
-			},
-		)
+		out, err := decryptAgeIdentity(privateKeyPath)
 		if err != nil {
-			if len(out) == 0 {
-				return err
-			}
-			return fmt.Errorf("%v\n%s", err, out)
-		}
-		if len(out) == 0 {
-			return fmt.Errorf("private key is empty")
+			return err
 		}
 
 		// set SOPS_AGE_KEY environment variable
@@ -155,6 +162,56 @@ func loadAgePrivateKey(privateKeyPath string) error {
 	return nil
 }
 
+// decryptAgeIdentity decrypts the passphrase protected age private key in memory
+func decryptAgeIdentity(privateKeyPath string) (string, error) {
+	data, err := os.ReadFile(privateKeyPath)
+	if err != nil {
+		return "", err
+	}
+	passphrase, err := readPassphrase(fmt.Sprintf("Enter passphrase for age key '%s': ", privateKeyPath))
+	if err != nil {
+		return "", err
+	}
+	identity, err := kubestrap.AgeDecryptWithPassphrase(data, passphrase)
+	if err != nil {
+		return "", fmt.Errorf("error decrypting '%s': %v", privateKeyPath, err)
+	}
+	if len(identity) == 0 {
+		return "", fmt.Errorf("private key is empty")
+	}
+	return string(identity), nil
+}
+
+// ageDecrypt decrypts the age file at path with the age private key, returning the plain text.
+// The decrypted age private key never touches the disk
+func ageDecrypt(path, agePrivateKeyPath string) (string, error) {
+	if err := loadAgePrivateKey(agePrivateKeyPath); err != nil {
+		return "", err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	out, err := kubestrap.AgeDecrypt(data, []byte(os.Getenv("SOPS_AGE_KEY")))
+	if err != nil {
+		return "", fmt.Errorf("error decrypting '%s': %v", path, err)
+	}
+	return string(out), nil
+}
+
+// ageEncrypt encrypts data from memory to the recipients listed in recipientsFile, writing the armored result to output
+func ageEncrypt(data []byte, recipientsFile, output string) error {
+	recipients, err := os.ReadFile(recipientsFile)
+	if err != nil {
+		return err
+	}
+	out, err := kubestrap.AgeEncrypt(data, recipients)
+	if err != nil {
+		return fmt.Errorf("error encrypting to recipients in '%s': %v", recipientsFile, err)
+	}
+	return os.WriteFile(output, out, 0600)
+}
+
 func (s *SecretsDecrypt) CheckRequiredFlags() error {
 	return s.parent.CheckRequiredFlags()
 }
@@ -185,3 +242,11 @@ func (s *SecretsDecrypt) PrivateKeyPath() string {
 	}
 	return privateKeyPath
 }
+
+func (s *SecretsDecrypt) KeySshPrivateKeyPath() string {
+	return "ssh-private-key"
+}
+
+func (s *SecretsDecrypt) SshPrivateKeyPath() string {
+	return config.ViperGetString(s.cmd, s.KeySshPrivateKeyPath())
+}
@@ -62,6 +62,12 @@ func NewSecretsDecryptValue(parent *Secrets) *SecretsDecryptValue {
 		"Private key path",
 	)
 
+	sd.cmd.Flags().String(
+		sd.KeySshPrivateKeyPath(),
+		"",
+		"SSH private key path, decrypting instead of the age private key when the secrets are encrypted to its ssh-ed25519 or ssh-rsa public key",
+	)
+
 	sd.cmd.Flags().StringP(
 		sd.KeyYqExpression(),
 		"y",
@@ -91,7 +97,7 @@ func (s *SecretsDecryptValue) RunSecretsDecryptValueCommand(cmd *cobra.Command,
 		return fmt.Errorf("no files to decrypt")
 	}
 
-	if err := loadAgePrivateKey(s.PrivateKeyPath()); err != nil {
+	if err := loadSopsIdentity(s.PrivateKeyPath(), s.SshPrivateKeyPath()); err != nil {
 		return err
 	}
 
@@ -208,3 +214,11 @@ func (s *SecretsDecryptValue) KeyRegex() string {
 func (s *SecretsDecryptValue) Regex() string {
 	return config.ViperGetString(s.cmd, s.KeyRegex())
 }
+
+func (s *SecretsDecryptValue) KeySshPrivateKeyPath() string {
+	return "ssh-private-key"
+}
+
+func (s *SecretsDecryptValue) SshPrivateKeyPath() string {
+	return config.ViperGetString(s.cmd, s.KeySshPrivateKeyPath())
+}
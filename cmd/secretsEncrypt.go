@@ -7,6 +7,7 @@ import (
 	"context"
 	"fmt"
 	"runtime"
+	"slices"
 
 	"github.com/spf13/cobra"
 	"github.com/thedataflows/go-commons/pkg/config"
@@ -114,6 +115,36 @@ func (s *SecretsEncrypt) findFiles(pattern string) *search.Results {
 	return search.FindFile(ctx, s.parent.KubeClusterDir(), fileFilter, finder, runtime.NumCPU())
 }
 
+// findSecretFiles returns the sorted files in dir matching any of the patterns, or the default secret files pattern
+func findSecretFiles(dir string, patterns []string) []string {
+	if len(patterns) == 0 {
+		patterns = []string{constants.DefaultSecretFilesPattern}
+	}
+	files := []string{}
+	for _, pattern := range patterns {
+		ctx, cancel := context.WithCancel(context.Background())
+		fileFilter := &search.FileFilterByPattern{
+			PlainPattern: "",
+			RegexPattern: pattern,
+			ApplyToDirs:  false,
+		}
+		results := search.FindFile(ctx, dir, fileFilter, &search.JustLister{OpenFile: false}, runtime.NumCPU())
+		cancel()
+		for _, result := range results.Results {
+			if result.Err != nil {
+				log.Errorf("error finding files: %s", result.Err)
+				continue
+			}
+			if file.IsDirectory(result.FilePath) || slices.Contains(files, result.FilePath) {
+				continue
+			}
+			files = append(files, result.FilePath)
+		}
+	}
+	slices.Sort(files)
+	return files
+}
+
 func (s *SecretsEncrypt) CheckRequiredFlags() error {
 	return s.parent.CheckRequiredFlags()
 }
@@ -0,0 +1,137 @@
+/*
+Copyright © 2023 Dataflows
+*/
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/thedataflows/go-commons/pkg/config"
+	"github.com/thedataflows/go-commons/pkg/file"
+	"github.com/thedataflows/go-commons/pkg/log"
+)
+
+// preCommitHookMarker identifies the hooks written by install-hooks, which can be replaced without --force
+const preCommitHookMarker = "# installed by kubestrap secrets install-hooks"
+
+type SecretsInstallHooks struct {
+	cmd    *cobra.Command
+	parent *Secrets
+}
+
+var (
+	_ = NewSecretsInstallHooks(secrets)
+)
+
+func init() {
+
+}
+
+func NewSecretsInstallHooks(parent *Secrets) *SecretsInstallHooks {
+	si := &SecretsInstallHooks{
+		parent: parent,
+	}
+
+	si.cmd = &cobra.Command{
+		Use:   "install-hooks",
+		Short: "Installs a git pre-commit hook blocking commits of secret files that are not encrypted with sops",
+		Long: `The hook runs 'check-staged' with the kubestrap binary running this command, or the one in PATH if it was moved.
+Set KUBESTRAP in the environment to use another one. The hooks directory is the one git uses, honoring core.hooksPath.
+An existing pre-commit hook not installed by kubestrap is only replaced with --force.`,
+		Example:       parent.parent.cmd.Use + " " + parent.cmd.Use + " install-hooks",
+		Aliases:       []string{"ih"},
+		Args:          cobra.NoArgs,
+		RunE:          si.RunSecretsInstallHooksCommand,
+		SilenceErrors: parent.Cmd().SilenceErrors,
+		SilenceUsage:  parent.Cmd().SilenceUsage,
+	}
+
+	parent.Cmd().AddCommand(si.cmd)
+
+	si.cmd.Flags().Bool(
+		si.KeyForce(),
+		false,
+		"Replace an existing pre-commit hook",
+	)
+
+	// Bind flags to config
+	config.ViperBindPFlagSet(si.cmd, nil)
+
+	return si
+}
+
+func (s *SecretsInstallHooks) RunSecretsInstallHooksCommand(cmd *cobra.Command, args []string) error {
+	projectRoot := s.parent.ProjectRoot()
+	out, err := runGit(projectRoot, "rev-parse", "--git-path", "hooks")
+	if err != nil {
+		return err
+	}
+	// relative to the directory git runs in
+	hooksDir := strings.TrimSpace(string(out))
+	if !filepath.IsAbs(hooksDir) {
+		hooksDir = filepath.Join(projectRoot, hooksDir)
+	}
+	if err := os.MkdirAll(hooksDir, 0755); err != nil {
+		return err
+	}
+
+	hookPath := filepath.Join(hooksDir, "pre-commit")
+	if file.IsFile(hookPath) && !s.Force() {
+		existing, err := os.ReadFile(hookPath)
+		if err != nil {
+			return err
+		}
+		if !strings.Contains(string(existing), preCommitHookMarker) {
+			return fmt.Errorf("'%s' exists and was not installed by kubestrap. Use --force flag to override, or call '%s %s check-staged' from it", hookPath, s.parent.parent.cmd.Use, s.parent.cmd.Use)
+		}
+	}
+
+	executable, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	hook := fmt.Sprintf(`#!/bin/sh
+%s
+KUBESTRAP="${KUBESTRAP:-%s}"
+command -v "$KUBESTRAP" >/dev/null 2>&1 || KUBESTRAP=%s
+exec "$KUBESTRAP" %s check-staged
+`,
+		preCommitHookMarker,
+		executable,
+		s.parent.parent.cmd.Use,
+		s.parent.cmd.Use,
+	)
+	// #nosec G306 -- git hooks must be executable
+	if err := os.WriteFile(hookPath, []byte(hook), 0755); err != nil {
+		return err
+	}
+	// the mode of an existing file is not changed by WriteFile
+	if err := os.Chmod(hookPath, 0755); err != nil {
+		return err
+	}
+	log.Infof("installed pre-commit hook: %s", hookPath)
+
+	return nil
+}
+
+func (s *SecretsInstallHooks) Cmd() *cobra.Command {
+	return s.cmd
+}
+
+// CheckRequiredFlags does not require the context, as the hook checks every cluster in the repository
+func (s *SecretsInstallHooks) CheckRequiredFlags() error {
+	return nil
+}
+
+// Flags keys, defaults and value getters
+func (s *SecretsInstallHooks) KeyForce() string {
+	return "force"
+}
+
+func (s *SecretsInstallHooks) Force() bool {
+	return config.ViperGetBool(s.cmd, s.KeyForce())
+}
@@ -0,0 +1,49 @@
+/*
+Copyright © 2023 Dataflows
+*/
+package cmd
+
+import (
+	"github.com/spf13/cobra"
+)
+
+type SecretsKnownHosts struct {
+	cmd    *cobra.Command
+	parent *Secrets
+}
+
+var (
+	secretsKnownHosts = NewSecretsKnownHosts(secrets)
+)
+
+func init() {
+
+}
+
+func NewSecretsKnownHosts(parent *Secrets) *SecretsKnownHosts {
+	sk := &SecretsKnownHosts{
+		parent: parent,
+	}
+
+	sk.cmd = &cobra.Command{
+		Use:   "known-hosts",
+		Short: "Manages the SSH host keys of the cluster hosts",
+		Long: `Host keys are recorded in the known_hosts file in the cluster path and verified on every SSH connection.
+With '--known-hosts strict', connections to hosts that are not recorded are refused, so they must be scanned first.`,
+		Aliases:       []string{"kh"},
+		SilenceErrors: parent.Cmd().SilenceErrors,
+		SilenceUsage:  parent.Cmd().SilenceUsage,
+	}
+
+	parent.Cmd().AddCommand(sk.cmd)
+
+	return sk
+}
+
+func (s *SecretsKnownHosts) Cmd() *cobra.Command {
+	return s.cmd
+}
+
+func (s *SecretsKnownHosts) CheckRequiredFlags() error {
+	return s.parent.CheckRequiredFlags()
+}
@@ -0,0 +1,197 @@
+/*
+Copyright © 2023 Dataflows
+*/
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"text/tabwriter"
+
+	"github.com/k0sproject/rig"
+	"github.com/spf13/cobra"
+	"github.com/thedataflows/go-commons/pkg/config"
+	"github.com/thedataflows/go-commons/pkg/defaults"
+	"github.com/thedataflows/go-commons/pkg/file"
+	"github.com/thedataflows/go-commons/pkg/log"
+	"github.com/thedataflows/kubestrap/pkg/constants"
+	"github.com/thedataflows/kubestrap/pkg/kubestrap"
+	"golang.org/x/crypto/ssh"
+)
+
+type SecretsKnownHostsScan struct {
+	cmd           *cobra.Command
+	parent        *SecretsKnownHosts
+	hostSelection *HostSelection
+}
+
+var (
+	_ = NewSecretsKnownHostsScan(secretsKnownHosts)
+)
+
+func init() {
+
+}
+
+func NewSecretsKnownHostsScan(parent *SecretsKnownHosts) *SecretsKnownHostsScan {
+	ss := &SecretsKnownHostsScan{
+		parent: parent,
+	}
+
+	ss.cmd = &cobra.Command{
+		Use:   "scan",
+		Short: "Records the SSH host keys of the cluster hosts and their bastions in the known_hosts file. Exits with error if any host could not be scanned or its key changed",
+		Long: `Hosts behind a bastion are scanned through it, authenticating to the bastion with its key or with the private key file.
+Keys already recorded are verified, and a changed key is reported as an error, never replaced.`,
+		Example:       parent.parent.parent.cmd.Use + " " + parent.parent.cmd.Use + " --context mycontext " + parent.cmd.Use + " scan --role controller",
+		RunE:          ss.RunSecretsKnownHostsScanCommand,
+		SilenceErrors: parent.Cmd().SilenceErrors,
+		SilenceUsage:  parent.Cmd().SilenceUsage,
+	}
+
+	parent.Cmd().AddCommand(ss.cmd)
+
+	ss.hostSelection = NewHostSelection(ss.cmd)
+
+	ss.cmd.Flags().StringP(
+		ss.KeyPrivateKeyFile(),
+		"k",
+		ss.DefaultPrivateKeyFile(),
+		"Private key file to authenticate to bastions without their own key",
+	)
+
+	// Bind flags to config
+	config.ViperBindPFlagSet(ss.cmd, nil)
+
+	return ss
+}
+
+func (s *SecretsKnownHostsScan) RunSecretsKnownHostsScanCommand(cmd *cobra.Command, args []string) error {
+	if err := s.CheckRequiredFlags(); err != nil {
+		return err
+	}
+
+	secrets := s.parent.parent
+	cl, err := kubestrap.NewK0sCluster(secrets.SecretsContext(), secrets.ClusterBootstrapPath())
+	if err != nil {
+		return err
+	}
+	hosts, err := s.hostSelection.Select(cl.GetClusterSpec().Spec.Hosts)
+	if err != nil {
+		return err
+	}
+
+	// only needed for bastions
+	identity, _ := os.ReadFile(s.PrivateKeyFile())
+
+	// key paths in the cluster spec are relative to it
+	clusterBootstrapPath, err := filepath.Abs(secrets.ClusterBootstrapPath())
+	if err != nil {
+		return err
+	}
+	knownHosts, err := secrets.parent.KnownHosts(clusterBootstrapPath)
+	if err != nil {
+		return err
+	}
+	currentDir := file.WorkingDirectory()
+	if err := os.Chdir(clusterBootstrapPath); err != nil {
+		return err
+	}
+	defer func() { _ = os.Chdir(currentDir) }()
+
+	failed := 0
+	scanned := map[string]bool{}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "HOST\tKEY\tSTATUS")
+	for _, h := range hosts {
+		if h.SSH == nil {
+			log.Warnf("[%s] host is not configured for SSH", hostLabel(h))
+			continue
+		}
+		for _, r := range scanHostKeys(knownHosts, h.SSH, identity, scanned) {
+			status := "known"
+			if r.err != nil {
+				failed++
+				status = r.err.Error()
+				log.Errorf("[%s] %v", r.address, r.err)
+			} else if r.added {
+				status = "added"
+			}
+			fingerprint := ""
+			if r.key != nil {
+				fingerprint = r.key.Type() + " " + ssh.FingerprintSHA256(r.key)
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\n", r.address, fingerprint, status)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("scanning host keys failed for %d hosts", failed)
+	}
+	return nil
+}
+
+type scanResult struct {
+	address string
+	key     ssh.PublicKey
+	added   bool
+	err     error
+}
+
+// scanHostKeys scans the bastions of the SSH settings, outermost first, then the host through them.
+// Addresses already in scanned are skipped
+func scanHostKeys(knownHosts *kubestrap.KnownHosts, settings *rig.SSH, identity []byte, scanned map[string]bool) []scanResult {
+	address := kubestrap.SSHAddress(settings)
+	if scanned[address] {
+		return nil
+	}
+	scanned[address] = true
+
+	if settings.Bastion == nil {
+		key, added, err := knownHosts.Scan(address, nil)
+		return []scanResult{{address: address, key: key, added: added, err: err}}
+	}
+
+	results := scanHostKeys(knownHosts, settings.Bastion, identity, scanned)
+	for _, r := range results {
+		if r.err != nil {
+			return append(results, scanResult{address: address, err: fmt.Errorf("bastion %s failed", r.address)})
+		}
+	}
+	bastionClient, err := dialSSH(settings.Bastion, identityAuth(nil, identity), knownHosts.HostKeyCallback())
+	if err != nil {
+		return append(results, scanResult{address: address, err: err})
+	}
+	defer bastionClient.Close()
+	key, added, err := knownHosts.Scan(address, bastionClient.Dial)
+	return append(results, scanResult{address: address, key: key, added: added, err: err})
+}
+
+func (s *SecretsKnownHostsScan) Cmd() *cobra.Command {
+	return s.cmd
+}
+
+func (s *SecretsKnownHostsScan) CheckRequiredFlags() error {
+	return s.parent.CheckRequiredFlags()
+}
+
+// Flags keys, defaults and value getters
+func (s *SecretsKnownHostsScan) KeyPrivateKeyFile() string {
+	return "private-key-file"
+}
+
+func (s *SecretsKnownHostsScan) DefaultPrivateKeyFile() string {
+	return fmt.Sprintf("bootstrap/cluster-%s/%s", defaults.Undefined, constants.DefaultClusterSshKeyFileName)
+}
+
+func (s *SecretsKnownHostsScan) PrivateKeyFile() string {
+	privateKeyFile := config.ViperGetString(s.cmd, s.KeyPrivateKeyFile())
+	if privateKeyFile == s.DefaultPrivateKeyFile() {
+		privateKeyFile = s.parent.parent.ClusterBootstrapPath() + "/" + constants.DefaultClusterSshKeyFileName
+	}
+	return privateKeyFile
+}
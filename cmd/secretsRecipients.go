@@ -0,0 +1,364 @@
+/*
+Copyright © 2023 Dataflows
+*/
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/goccy/go-yaml"
+	"github.com/spf13/cobra"
+	"github.com/thedataflows/go-commons/pkg/config"
+	"github.com/thedataflows/go-commons/pkg/defaults"
+	"github.com/thedataflows/go-commons/pkg/file"
+	"github.com/thedataflows/go-commons/pkg/log"
+	"github.com/thedataflows/kubestrap/pkg/kubestrap"
+)
+
+type SecretsRecipients struct {
+	cmd    *cobra.Command
+	parent *Secrets
+}
+
+// recipient is a named age recipient in the recipients file
+type recipient struct {
+	Name      string `yaml:"name"`
+	Recipient string `yaml:"recipient"`
+	Comment   string `yaml:"comment,omitempty"`
+}
+
+var (
+	secretsRecipients = NewSecretsRecipients(secrets)
+)
+
+func init() {
+
+}
+
+func NewSecretsRecipients(parent *Secrets) *SecretsRecipients {
+	sr := &SecretsRecipients{
+		parent: parent,
+	}
+
+	sr.cmd = &cobra.Command{
+		Use:   "recipients",
+		Short: "Manages the age recipients secrets are encrypted to",
+		Long: `Recipients are the age or SSH public keys in all key groups of the sops config, usually one per team member.
+Their names and comments are kept in the recipients file, next to the age key.
+After a change, the secret files are updated with 'sops updatekeys', so added recipients can decrypt them and removed ones can not.`,
+		Aliases:       []string{"r"},
+		SilenceErrors: parent.Cmd().SilenceErrors,
+		SilenceUsage:  parent.Cmd().SilenceUsage,
+	}
+
+	parent.Cmd().AddCommand(sr.cmd)
+
+	sr.cmd.PersistentFlags().String(
+		sr.KeyPrivateKeyPath(),
+		sr.DefaultPrivateKeyPath(),
+		"Age private key path, decrypting the secret files",
+	)
+
+	sr.cmd.PersistentFlags().String(
+		sr.KeySshPrivateKeyPath(),
+		"",
+		"SSH private key path, decrypting the secret files instead of the age private key",
+	)
+
+	sr.cmd.PersistentFlags().String(
+		sr.KeyRecipientsFile(),
+		sr.DefaultRecipientsFile(),
+		"Recipients file path, with the names and comments of the recipients",
+	)
+
+	// Bind flags to config
+	config.ViperBindPFlagSet(sr.cmd, sr.cmd.PersistentFlags())
+
+	return sr
+}
+
+// readRecipients reads the recipients file. A missing file has no recipients
+func readRecipients(recipientsFile string) ([]recipient, error) {
+	recipients := []recipient{}
+	if !file.IsAccessible(recipientsFile) {
+		return recipients, nil
+	}
+	data, err := os.ReadFile(recipientsFile)
+	if err != nil {
+		return nil, err
+	}
+	if err := yaml.Unmarshal(data, &recipients); err != nil {
+		return nil, fmt.Errorf("error parsing recipients file '%s': %v", recipientsFile, err)
+	}
+	return recipients, nil
+}
+
+func writeRecipients(recipientsFile string, recipients []recipient) error {
+	data, err := yaml.Marshal(recipients)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(recipientsFile), 0700); err != nil {
+		return err
+	}
+	return os.WriteFile(recipientsFile, data, 0600)
+}
+
+// sopsCreationRule is the part of a sops config creation rule kubestrap uses
+type sopsCreationRule struct {
+	PathRegex string `yaml:"path_regex"`
+	// Age is a comma separated list of recipients, used when there are no key groups
+	Age       string `yaml:"age"`
+	KeyGroups []struct {
+		Age []string `yaml:"age"`
+	} `yaml:"key_groups"`
+}
+
+// ageRecipients returns the unique age recipients of all key groups of the rule
+func (r *sopsCreationRule) ageRecipients() []string {
+	recipients := []string{}
+	add := func(recipient string) {
+		if recipient = strings.TrimSpace(recipient); recipient != "" && !slices.Contains(recipients, recipient) {
+			recipients = append(recipients, recipient)
+		}
+	}
+	for _, recipient := range strings.Split(r.Age, ",") {
+		add(recipient)
+	}
+	for _, group := range r.KeyGroups {
+		for _, recipient := range group.Age {
+			add(recipient)
+		}
+	}
+	return recipients
+}
+
+func readSopsCreationRules(sopsConfigPath string) ([]sopsCreationRule, error) {
+	data, err := os.ReadFile(sopsConfigPath)
+	if err != nil {
+		return nil, err
+	}
+	var sopsConfig struct {
+		CreationRules []sopsCreationRule `yaml:"creation_rules"`
+	}
+	if err := yaml.Unmarshal(data, &sopsConfig); err != nil {
+		return nil, fmt.Errorf("error parsing sops config '%s': %v", sopsConfigPath, err)
+	}
+	return sopsConfig.CreationRules, nil
+}
+
+// sopsConfigKeyGroups returns the age recipients of every key group of every creation rule in the sops config.
+// Rules listing age recipients outside of key groups are rejected, as they are not patched
+func sopsConfigKeyGroups(sopsConfigPath string) ([][]string, error) {
+	rules, err := readSopsCreationRules(sopsConfigPath)
+	if err != nil {
+		return nil, err
+	}
+	keyGroups := [][]string{}
+	for _, rule := range rules {
+		if strings.TrimSpace(rule.Age) != "" {
+			return nil, fmt.Errorf("the creation rule for '%s' in '%s' lists age recipients in 'age'. Only 'key_groups' are supported: move them to 'key_groups[].age'", rule.PathRegex, sopsConfigPath)
+		}
+		for _, group := range rule.KeyGroups {
+			keyGroups = append(keyGroups, group.Age)
+		}
+	}
+	return keyGroups, nil
+}
+
+// sopsConfigRecipients returns the unique age recipients of the sops config, in order of appearance
+func sopsConfigRecipients(sopsConfigPath string) ([]string, error) {
+	keyGroups, err := sopsConfigKeyGroups(sopsConfigPath)
+	if err != nil {
+		return nil, err
+	}
+	recipients := []string{}
+	for _, group := range keyGroups {
+		for _, r := range group {
+			if !slices.Contains(recipients, r) {
+				recipients = append(recipients, r)
+			}
+		}
+	}
+	return recipients, nil
+}
+
+// addRecipients names the recipients in the recipients file, adds the missing ones to the sops config and updates the secret files.
+// A name can not be reused for another recipient
+func (s *SecretsRecipients) addRecipients(added []recipient) error {
+	// read first, so an unsupported sops config changes nothing
+	sopsConfigPath := s.parent.SopsConfig()
+	sopsRecipients, err := sopsConfigRecipients(sopsConfigPath)
+	if err != nil {
+		return err
+	}
+	recipientsFile := s.RecipientsFile()
+	named, err := readRecipients(recipientsFile)
+	if err != nil {
+		return err
+	}
+	for _, a := range added {
+		if i := slices.IndexFunc(named, func(n recipient) bool { return n.Name == a.Name && n.Recipient != a.Recipient }); i >= 0 {
+			return fmt.Errorf("recipient '%s' exists with '%s'. Remove it first", a.Name, named[i].Recipient)
+		}
+		named = slices.DeleteFunc(named, func(n recipient) bool { return n.Recipient == a.Recipient })
+		named = append(named, a)
+	}
+	if err := writeRecipients(recipientsFile, named); err != nil {
+		return err
+	}
+
+	missing := []string{}
+	for _, a := range added {
+		if !slices.Contains(sopsRecipients, a.Recipient) && !slices.Contains(missing, a.Recipient) {
+			missing = append(missing, a.Recipient)
+		}
+	}
+	if len(missing) > 0 {
+		if err := patchSopsConfig(sopsConfigPath, missing, nil); err != nil {
+			return err
+		}
+	}
+	// files already encrypted to the recipients are left as is, so a failed update can be resumed by adding again
+	return s.updateSecretKeys(false)
+}
+
+// updateSecretKeys runs 'sops updatekeys' on the sops encrypted secret files, so they are encrypted to the recipients of the sops config.
+// With rotate, the data key is replaced as well, as removed recipients may have kept the current one
+func (s *SecretsRecipients) updateSecretKeys(rotate bool) error {
+	if err := loadSopsIdentity(s.PrivateKeyPath(), s.SshPrivateKeyPath()); err != nil {
+		return err
+	}
+
+	type updatedFile struct {
+		path   string
+		status string
+		err    error
+	}
+	files := []*updatedFile{}
+	failed := 0
+	for _, p := range findSecretFiles(s.parent.KubeClusterDir(), nil) {
+		f := &updatedFile{path: p, status: "updated"}
+		_, encrypted, err := sopsAgeRecipients(p)
+		switch {
+		case err != nil:
+			f.err = err
+		case !encrypted:
+			continue
+		default:
+			f.err = s.updateSecretFileKeys(p, rotate)
+		}
+		if f.err != nil {
+			failed++
+			f.status = "failed"
+			log.Errorf("%s: %v", p, f.err)
+		}
+		files = append(files, f)
+	}
+
+	// Summary
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "FILE\tSTATUS\tERROR")
+	for _, f := range files {
+		errMessage := ""
+		if f.err != nil {
+			errMessage = f.err.Error()
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\n", f.path, f.status, errMessage)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d files failed. Fix them and run 'sops updatekeys' on them", failed, len(files))
+	}
+	return nil
+}
+
+func (s *SecretsRecipients) updateSecretFileKeys(path string, rotate bool) error {
+	commands := [][]string{}
+	if rotate {
+		// before updating the keys, so it works when the local key is the one removed
+		commands = append(commands, []string{"sops", "--config", s.parent.SopsConfig(), "--rotate", "--in-place", path})
+	}
+	commands = append(commands, []string{"sops", "--config", s.parent.SopsConfig(), "updatekeys", "--yes", path})
+	for _, args := range commands {
+		out, err := raw.RunRawCommandCaptureStdout(raw.Cmd(), args)
+		if err != nil {
+			if len(out) == 0 {
+				return err
+			}
+			return fmt.Errorf("%v\n%s", err, out)
+		}
+	}
+	return nil
+}
+
+// localRecipients returns the recipients of the local age key, from its public key file
+func (s *SecretsRecipients) localRecipients() []string {
+	recipients := []string{}
+	data, err := os.ReadFile(s.PrivateKeyPath() + ".pub")
+	if err != nil {
+		return recipients
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if r, _, err := kubestrap.ParseRecipient(line); err == nil {
+			recipients = append(recipients, r)
+		}
+	}
+	return recipients
+}
+
+func (s *SecretsRecipients) Cmd() *cobra.Command {
+	return s.cmd
+}
+
+func (s *SecretsRecipients) CheckRequiredFlags() error {
+	return s.parent.CheckRequiredFlags()
+}
+
+// Flags keys, defaults and value getters
+func (s *SecretsRecipients) KeyPrivateKeyPath() string {
+	return "private-key"
+}
+
+func (s *SecretsRecipients) DefaultPrivateKeyPath() string {
+	return "secrets/" + defaults.Undefined + ".age"
+}
+
+func (s *SecretsRecipients) PrivateKeyPath() string {
+	privateKeyPath := config.ViperGetString(s.cmd, s.KeyPrivateKeyPath())
+	if privateKeyPath == s.DefaultPrivateKeyPath() {
+		privateKeyPath = s.parent.AgePrivateKeyPath()
+	}
+	return privateKeyPath
+}
+
+func (s *SecretsRecipients) KeySshPrivateKeyPath() string {
+	return "ssh-private-key"
+}
+
+func (s *SecretsRecipients) SshPrivateKeyPath() string {
+	return config.ViperGetString(s.cmd, s.KeySshPrivateKeyPath())
+}
+
+func (s *SecretsRecipients) KeyRecipientsFile() string {
+	return "recipients-file"
+}
+
+func (s *SecretsRecipients) DefaultRecipientsFile() string {
+	return "secrets/" + defaults.Undefined + ".recipients.yaml"
+}
+
+func (s *SecretsRecipients) RecipientsFile() string {
+	recipientsFile := config.ViperGetString(s.cmd, s.KeyRecipientsFile())
+	if recipientsFile == s.DefaultRecipientsFile() {
+		recipientsFile = s.parent.SecretsDir() + "/" + s.parent.SecretsContext() + ".recipients.yaml"
+	}
+	return recipientsFile
+}
@@ -0,0 +1,96 @@
+/*
+Copyright © 2023 Dataflows
+*/
+package cmd
+
+import (
+	"github.com/spf13/cobra"
+	"github.com/thedataflows/go-commons/pkg/config"
+	"github.com/thedataflows/go-commons/pkg/log"
+	"github.com/thedataflows/kubestrap/pkg/kubestrap"
+)
+
+type SecretsRecipientsAdd struct {
+	cmd    *cobra.Command
+	parent *SecretsRecipients
+}
+
+var (
+	_ = NewSecretsRecipientsAdd(secretsRecipients)
+)
+
+func init() {
+
+}
+
+func NewSecretsRecipientsAdd(parent *SecretsRecipients) *SecretsRecipientsAdd {
+	sa := &SecretsRecipientsAdd{
+		parent: parent,
+	}
+
+	sa.cmd = &cobra.Command{
+		Use:   "add NAME RECIPIENT",
+		Short: "Adds an age recipient to the sops config and updates the secret files, so it can decrypt them",
+		Long: `The recipient is an age public key, or an 'ssh-ed25519' or 'ssh-rsa' public key, whose comment is used when --comment is not set.
+Adding an existing recipient again updates its name and comment, and the secret files not encrypted to it yet.`,
+		Example: parent.parent.parent.cmd.Use + " " + parent.parent.cmd.Use + " --context mycontext " + parent.cmd.Use +
+			" add alice age1ql3z7hjy54pw3hyww5ayyfg7zqgvc7w3j2elw8zmrj2kg5sfn9aqmcac8p --comment 'laptop'\n" +
+			parent.parent.parent.cmd.Use + " " + parent.parent.cmd.Use + " --context mycontext " + parent.cmd.Use + " add bob \"$(cat ~/.ssh/id_ed25519.pub)\"",
+		Args:          cobra.ExactArgs(2),
+		RunE:          sa.RunSecretsRecipientsAddCommand,
+		SilenceErrors: parent.Cmd().SilenceErrors,
+		SilenceUsage:  parent.Cmd().SilenceUsage,
+	}
+
+	parent.Cmd().AddCommand(sa.cmd)
+
+	sa.cmd.Flags().StringP(
+		sa.KeyComment(),
+		"m",
+		"",
+		"Comment about the recipient, like the device holding the key",
+	)
+
+	// Bind flags to config
+	config.ViperBindPFlagSet(sa.cmd, nil)
+
+	return sa
+}
+
+func (s *SecretsRecipientsAdd) RunSecretsRecipientsAddCommand(cmd *cobra.Command, args []string) error {
+	if err := s.CheckRequiredFlags(); err != nil {
+		return err
+	}
+
+	r, keyComment, err := kubestrap.ParseRecipient(args[1])
+	if err != nil {
+		return err
+	}
+	comment := s.Comment()
+	if comment == "" {
+		comment = keyComment
+	}
+	if err := s.parent.addRecipients([]recipient{{Name: args[0], Recipient: r, Comment: comment}}); err != nil {
+		return err
+	}
+	log.Infof("added recipient '%s': %s", args[0], r)
+
+	return nil
+}
+
+func (s *SecretsRecipientsAdd) Cmd() *cobra.Command {
+	return s.cmd
+}
+
+func (s *SecretsRecipientsAdd) CheckRequiredFlags() error {
+	return s.parent.CheckRequiredFlags()
+}
+
+// Flags keys, defaults and value getters
+func (s *SecretsRecipientsAdd) KeyComment() string {
+	return "comment"
+}
+
+func (s *SecretsRecipientsAdd) Comment() string {
+	return config.ViperGetString(s.cmd, s.KeyComment())
+}
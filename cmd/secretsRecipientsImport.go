@@ -0,0 +1,105 @@
+/*
+Copyright © 2023 Dataflows
+*/
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/thedataflows/go-commons/pkg/log"
+	"github.com/thedataflows/kubestrap/pkg/kubestrap"
+)
+
+type SecretsRecipientsImport struct {
+	cmd    *cobra.Command
+	parent *SecretsRecipients
+}
+
+var (
+	_ = NewSecretsRecipientsImport(secretsRecipients)
+)
+
+func init() {
+
+}
+
+func NewSecretsRecipientsImport(parent *SecretsRecipients) *SecretsRecipientsImport {
+	si := &SecretsRecipientsImport{
+		parent: parent,
+	}
+
+	si.cmd = &cobra.Command{
+		Use:   "import FILE",
+		Short: "Adds the SSH and age public keys of an authorized_keys style team file as recipients, named after their comments",
+		Long: `Every key must have a comment, like 'alice@laptop', used as the recipient name. Age public keys can be followed by a comment as well. Empty lines and lines starting with '#' are ignored.
+SSH keys of types age can not encrypt to, like ecdsa or security keys, are skipped with a warning.
+Recipients missing from the file are kept. Remove them with the remove command.`,
+		Example:       parent.parent.parent.cmd.Use + " " + parent.parent.cmd.Use + " --context mycontext " + parent.cmd.Use + " import team/authorized_keys",
+		Args:          cobra.ExactArgs(1),
+		RunE:          si.RunSecretsRecipientsImportCommand,
+		SilenceErrors: parent.Cmd().SilenceErrors,
+		SilenceUsage:  parent.Cmd().SilenceUsage,
+	}
+
+	parent.Cmd().AddCommand(si.cmd)
+
+	return si
+}
+
+func (s *SecretsRecipientsImport) RunSecretsRecipientsImportCommand(cmd *cobra.Command, args []string) error {
+	if err := s.CheckRequiredFlags(); err != nil {
+		return err
+	}
+
+	data, err := os.ReadFile(args[0])
+	if err != nil {
+		return err
+	}
+	added := []recipient{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		r, comment, err := kubestrap.ParseRecipient(line)
+		if err != nil {
+			if errors.Is(err, kubestrap.ErrUnsupportedRecipient) {
+				log.Warnf("%s:%d: %v", args[0], lineNumber, err)
+				continue
+			}
+			return fmt.Errorf("%s:%d: %v", args[0], lineNumber, err)
+		}
+		if comment == "" {
+			return fmt.Errorf("%s:%d: the key has no comment to name the recipient", args[0], lineNumber)
+		}
+		added = append(added, recipient{Name: comment, Recipient: r})
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if len(added) == 0 {
+		return fmt.Errorf("no public keys found in '%s'", args[0])
+	}
+
+	if err := s.parent.addRecipients(added); err != nil {
+		return err
+	}
+	log.Infof("imported %d recipients from: %s", len(added), args[0])
+
+	return nil
+}
+
+func (s *SecretsRecipientsImport) Cmd() *cobra.Command {
+	return s.cmd
+}
+
+func (s *SecretsRecipientsImport) CheckRequiredFlags() error {
+	return s.parent.CheckRequiredFlags()
+}
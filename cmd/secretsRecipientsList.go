@@ -0,0 +1,95 @@
+/*
+Copyright © 2023 Dataflows
+*/
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+)
+
+type SecretsRecipientsList struct {
+	cmd    *cobra.Command
+	parent *SecretsRecipients
+}
+
+var (
+	_ = NewSecretsRecipientsList(secretsRecipients)
+)
+
+func init() {
+
+}
+
+func NewSecretsRecipientsList(parent *SecretsRecipients) *SecretsRecipientsList {
+	sl := &SecretsRecipientsList{
+		parent: parent,
+	}
+
+	sl.cmd = &cobra.Command{
+		Use:           "list",
+		Short:         "Lists the age recipients of the sops config, with their names and comments",
+		Long:          `Recipients without a name are not in the recipients file. Named recipients missing from the sops config are listed as well, with the 'missing' comment.`,
+		Example:       parent.parent.parent.cmd.Use + " " + parent.parent.cmd.Use + " --context mycontext " + parent.cmd.Use + " list",
+		Aliases:       []string{"ls"},
+		RunE:          sl.RunSecretsRecipientsListCommand,
+		SilenceErrors: parent.Cmd().SilenceErrors,
+		SilenceUsage:  parent.Cmd().SilenceUsage,
+	}
+
+	parent.Cmd().AddCommand(sl.cmd)
+
+	return sl
+}
+
+func (s *SecretsRecipientsList) RunSecretsRecipientsListCommand(cmd *cobra.Command, args []string) error {
+	if err := s.CheckRequiredFlags(); err != nil {
+		return err
+	}
+
+	sopsRecipients, err := sopsConfigRecipients(s.parent.parent.SopsConfig())
+	if err != nil {
+		return err
+	}
+	named, err := readRecipients(s.parent.RecipientsFile())
+	if err != nil {
+		return err
+	}
+	local := s.parent.localRecipients()
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tRECIPIENT\tCOMMENT")
+	print := func(name, r, comment string) {
+		if slices.Contains(local, r) {
+			name += " (local)"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\n", name, r, comment)
+	}
+	for _, r := range sopsRecipients {
+		i := slices.IndexFunc(named, func(n recipient) bool { return n.Recipient == r })
+		if i < 0 {
+			print("", r, "")
+			continue
+		}
+		print(named[i].Name, r, named[i].Comment)
+	}
+	for _, n := range named {
+		if !slices.Contains(sopsRecipients, n.Recipient) {
+			print(n.Name, n.Recipient, "missing")
+		}
+	}
+
+	return w.Flush()
+}
+
+func (s *SecretsRecipientsList) Cmd() *cobra.Command {
+	return s.cmd
+}
+
+func (s *SecretsRecipientsList) CheckRequiredFlags() error {
+	return s.parent.CheckRequiredFlags()
+}
@@ -0,0 +1,137 @@
+/*
+Copyright © 2023 Dataflows
+*/
+package cmd
+
+import (
+	"fmt"
+	"slices"
+
+	"github.com/spf13/cobra"
+	"github.com/thedataflows/go-commons/pkg/config"
+	"github.com/thedataflows/go-commons/pkg/log"
+	"github.com/thedataflows/kubestrap/pkg/kubestrap"
+)
+
+type SecretsRecipientsRemove struct {
+	cmd    *cobra.Command
+	parent *SecretsRecipients
+}
+
+var (
+	_ = NewSecretsRecipientsRemove(secretsRecipients)
+)
+
+func init() {
+
+}
+
+func NewSecretsRecipientsRemove(parent *SecretsRecipients) *SecretsRecipientsRemove {
+	sr := &SecretsRecipientsRemove{
+		parent: parent,
+	}
+
+	sr.cmd = &cobra.Command{
+		Use:   "remove NAME|RECIPIENT",
+		Short: "Removes an age recipient from the sops config and re-encrypts the secret files with a new data key, so it can not decrypt them",
+		Long: `A recipient can not be removed when a key group would be left without age recipients, as nobody could decrypt the secret files.
+Removing the recipient of the local age key requires --force, as the secret files can not be decrypted with it afterwards.
+Secrets the removed recipient could read before are still known to them, so rotate them as well.`,
+		Example: parent.parent.parent.cmd.Use + " " + parent.parent.cmd.Use + " --context mycontext " + parent.cmd.Use + " remove alice\n" +
+			parent.parent.parent.cmd.Use + " " + parent.parent.cmd.Use + " --context mycontext " + parent.cmd.Use + " remove age1ql3z7hjy54pw3hyww5ayyfg7zqgvc7w3j2elw8zmrj2kg5sfn9aqmcac8p",
+		Aliases:       []string{"rm"},
+		Args:          cobra.ExactArgs(1),
+		RunE:          sr.RunSecretsRecipientsRemoveCommand,
+		SilenceErrors: parent.Cmd().SilenceErrors,
+		SilenceUsage:  parent.Cmd().SilenceUsage,
+	}
+
+	parent.Cmd().AddCommand(sr.cmd)
+
+	sr.cmd.Flags().Bool(
+		sr.KeyForce(),
+		false,
+		"Remove the recipient of the local age key",
+	)
+
+	// Bind flags to config
+	config.ViperBindPFlagSet(sr.cmd, nil)
+
+	return sr
+}
+
+func (s *SecretsRecipientsRemove) RunSecretsRecipientsRemoveCommand(cmd *cobra.Command, args []string) error {
+	if err := s.CheckRequiredFlags(); err != nil {
+		return err
+	}
+
+	recipientsFile := s.parent.RecipientsFile()
+	named, err := readRecipients(recipientsFile)
+	if err != nil {
+		return err
+	}
+	r := args[0]
+	if i := slices.IndexFunc(named, func(n recipient) bool { return n.Name == r }); i >= 0 {
+		r = named[i].Recipient
+	} else if normalized, _, err := kubestrap.ParseRecipient(r); err == nil {
+		// SSH public keys are stored without their comment
+		r = normalized
+	}
+
+	sopsConfigPath := s.parent.parent.SopsConfig()
+	keyGroups, err := sopsConfigKeyGroups(sopsConfigPath)
+	if err != nil {
+		return err
+	}
+	inSopsConfig := false
+	for _, group := range keyGroups {
+		if !slices.Contains(group, r) {
+			continue
+		}
+		inSopsConfig = true
+		if !slices.ContainsFunc(group, func(g string) bool { return g != r }) {
+			return fmt.Errorf("'%s' is the last age recipient of a key group in '%s'. Add another recipient first", args[0], sopsConfigPath)
+		}
+	}
+	inRecipientsFile := slices.ContainsFunc(named, func(n recipient) bool { return n.Recipient == r })
+	if !inSopsConfig && !inRecipientsFile {
+		return fmt.Errorf("unknown recipient '%s'", args[0])
+	}
+	if slices.Contains(s.parent.localRecipients(), r) && !s.Force() {
+		return fmt.Errorf("'%s' is the recipient of the local age key '%s'. Use --force flag to remove it anyway", args[0], s.parent.PrivateKeyPath())
+	}
+
+	if inSopsConfig {
+		if err := patchSopsConfig(sopsConfigPath, nil, []string{r}); err != nil {
+			return err
+		}
+	}
+	// the data key is replaced as well, so a failed update can be resumed by removing again
+	if err := s.parent.updateSecretKeys(true); err != nil {
+		return err
+	}
+
+	if err := writeRecipients(recipientsFile, slices.DeleteFunc(named, func(n recipient) bool { return n.Recipient == r })); err != nil {
+		return err
+	}
+	log.Infof("removed recipient: %s", r)
+
+	return nil
+}
+
+func (s *SecretsRecipientsRemove) Cmd() *cobra.Command {
+	return s.cmd
+}
+
+func (s *SecretsRecipientsRemove) CheckRequiredFlags() error {
+	return s.parent.CheckRequiredFlags()
+}
+
+// Flags keys, defaults and value getters
+func (s *SecretsRecipientsRemove) KeyForce() string {
+	return "force"
+}
+
+func (s *SecretsRecipientsRemove) Force() bool {
+	return config.ViperGetBool(s.cmd, s.KeyForce())
+}
@@ -0,0 +1,601 @@
+/*
+Copyright © 2023 Dataflows
+*/
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/goccy/go-yaml"
+	"github.com/spf13/cobra"
+	"github.com/thedataflows/go-commons/pkg/config"
+	"github.com/thedataflows/go-commons/pkg/defaults"
+	"github.com/thedataflows/go-commons/pkg/file"
+	"github.com/thedataflows/go-commons/pkg/log"
+	"github.com/thedataflows/kubestrap/pkg/kubestrap"
+)
+
+type SecretsRotateAgeKey struct {
+	cmd    *cobra.Command
+	parent *Secrets
+}
+
+// ageRotationFile is a file encrypted to the age key and its rotation outcome
+type ageRotationFile struct {
+	path   string
+	sops   bool
+	status string
+	err    error
+}
+
+var (
+	_ = NewSecretsRotateAgeKey(secrets)
+)
+
+func init() {
+
+}
+
+func NewSecretsRotateAgeKey(parent *Secrets) *SecretsRotateAgeKey {
+	sr := &SecretsRotateAgeKey{
+		parent: parent,
+	}
+
+	sr.cmd = &cobra.Command{
+		Use:   "rotate-age-key [PATTERN]...",
+		Short: "Replaces the age key, re-encrypting all secret files to the new one. Resumes an interrupted rotation",
+		Long: `Rotation runs in steps:
+  1. generate a new key pair, next to the current one with the '.new' suffix, or reuse it when resuming.
+     A passphrase is only generated when the public key file lists a recipient other than the current and new keys,
+     like a recovery key. It is stored in the vault, and renamed after the local key file once replaced
+  2. add the new recipient to the sops config
+  3. rotate the data key of every secret file matching the patterns, adding the new recipient and removing the current one
+  4. remove the current recipient from the sops config
+  5. re-encrypt the SSH CA key to the new key, and the vault to both keys
+  6. check that every file decrypts with the new key only
+  7. replace the local key files with the new ones, re-encrypt the vault to the new key only,
+     and update the in-cluster secret if requested
+Files already rotated are skipped, so after fixing a failure, running the command again resumes the rotation.
+Other recipients, like the keys of other team members, are kept.`,
+		Example: parent.parent.cmd.Use + " " + parent.cmd.Use + " --context mycontext rotate-age-key\n" +
+			parent.parent.cmd.Use + " " + parent.cmd.Use + " --context mycontext rotate-age-key --update-cluster-secret 'secret.*\\.yaml' '.*\\.enc\\.yaml'",
+		Aliases:       []string{"rak"},
+		RunE:          sr.RunSecretsRotateAgeKeyCommand,
+		SilenceErrors: parent.Cmd().SilenceErrors,
+		SilenceUsage:  parent.Cmd().SilenceUsage,
+	}
+
+	parent.Cmd().AddCommand(sr.cmd)
+
+	sr.cmd.Flags().String(
+		sr.KeyPrivateKeyPath(),
+		sr.DefaultPrivateKeyPath(),
+		"Private key path",
+	)
+
+	sr.cmd.Flags().String(
+		sr.KeyPublicKeyPath(),
+		sr.DefaultPublicKeyPath(),
+		"Public key path",
+	)
+
+	sr.cmd.Flags().Bool(
+		sr.KeyUpdateClusterSecret(),
+		false,
+		"Update the in-cluster secret used by FluxCD to decrypt, using the Kubernetes context",
+	)
+
+	sr.cmd.Flags().StringP(
+		sr.KeyNamespace(),
+		"n",
+		"flux-system",
+		"Kubernetes namespace of the in-cluster secret",
+	)
+
+	sr.cmd.Flags().String(
+		sr.KeyClusterSecret(),
+		"sops-age",
+		"Name of the in-cluster secret",
+	)
+
+	// Bind flags to config
+	config.ViperBindPFlagSet(sr.cmd, nil)
+
+	return sr
+}
+
+func (s *SecretsRotateAgeKey) RunSecretsRotateAgeKeyCommand(cmd *cobra.Command, args []string) error {
+	if err := s.CheckRequiredFlags(); err != nil {
+		return err
+	}
+
+	privateKeyPath, publicKeyPath := s.PrivateKeyPath(), s.PublicKeyPath()
+	newPrivateKeyPath, newPublicKeyPath := privateKeyPath+".new", publicKeyPath+".new"
+
+	// current key
+	log.Infof("loading private key: %s", privateKeyPath)
+	currentIdentity, err := decryptAgeIdentity(privateKeyPath)
+	if err != nil {
+		return err
+	}
+	currentRecipients, err := kubestrap.AgeRecipients([]byte(currentIdentity))
+	if err != nil {
+		return err
+	}
+
+	// new key
+	var newIdentity []byte
+	if file.IsFile(newPrivateKeyPath) {
+		log.Infof("resuming rotation with the new key: %s", newPrivateKeyPath)
+		if newIdentity, err = s.decryptNewIdentity(currentIdentity, newPrivateKeyPath); err != nil {
+			return err
+		}
+	} else {
+		log.Info("generating new age key")
+		if newIdentity, _, err = kubestrap.GenerateAgeIdentity(); err != nil {
+			return err
+		}
+		// a generated passphrase is stored in the vault, still read with the current key
+		if err := os.Setenv("SOPS_AGE_KEY", currentIdentity); err != nil {
+			return err
+		}
+		ownRecipients, err := kubestrap.AgeRecipients(newIdentity)
+		if err != nil {
+			return err
+		}
+		publicKeys, err := readPublicKeys(publicKeyPath)
+		if err != nil {
+			return err
+		}
+		// the current key is retired, so it can not recover the passphrase
+		passphrase, generated, err := readAgeKeyPassphrase(publicKeyPath, publicKeys, append(ownRecipients, currentRecipients...))
+		if err != nil {
+			return err
+		}
+		if err := encryptAgeIdentity(newIdentity, passphrase, generated, newPrivateKeyPath, privateKeyPath, publicKeyPath); err != nil {
+			return err
+		}
+		log.Infof("wrote: %s", newPrivateKeyPath)
+	}
+	newRecipients, err := kubestrap.AgeRecipients(newIdentity)
+	if err != nil {
+		return err
+	}
+	if slices.ContainsFunc(newRecipients, func(r string) bool { return slices.Contains(currentRecipients, r) }) {
+		return fmt.Errorf("'%s' holds the current key. Remove it to start a new rotation", newPrivateKeyPath)
+	}
+	// other recipients listed with the current key are kept
+	newPublicKeys := slices.Clone(newRecipients)
+	if data, err := os.ReadFile(publicKeyPath); err == nil {
+		for _, r := range strings.Split(string(data), "\n") {
+			r = strings.TrimSpace(r)
+			if r != "" && !slices.Contains(currentRecipients, r) && !slices.Contains(newPublicKeys, r) {
+				newPublicKeys = append(newPublicKeys, r)
+			}
+		}
+	}
+	if err := os.WriteFile(newPublicKeyPath, []byte(strings.Join(newPublicKeys, "\n")+"\n"), 0600); err != nil {
+		return fmt.Errorf("error writing public key: %s", err)
+	}
+
+	// both keys decrypt until the final check
+	if err := os.Setenv("SOPS_AGE_KEY", strings.TrimSpace(currentIdentity)+"\n"+string(newIdentity)); err != nil {
+		return err
+	}
+
+	sopsConfigPath := s.parent.SopsConfig()
+	if err := patchSopsConfig(sopsConfigPath, newRecipients, nil); err != nil {
+		return err
+	}
+
+	files := []*ageRotationFile{}
+	for _, p := range findSecretFiles(s.parent.KubeClusterDir(), args) {
+		files = append(files, &ageRotationFile{path: p})
+	}
+	failed := 0
+	for i, f := range files {
+		f.status, f.err = s.rotateFile(f.path, currentRecipients, newRecipients)
+		f.sops = f.err == nil && f.status != "not encrypted"
+		if f.err != nil {
+			failed++
+			f.status = "failed"
+			log.Errorf("[%d/%d] %s: %v", i+1, len(files), f.path, f.err)
+			continue
+		}
+		log.Infof("[%d/%d] %s: %s", i+1, len(files), f.path, f.status)
+	}
+
+	// other files encrypted with age to the key. The vault stays readable by the current key until the key files are replaced,
+	// as it may hold the passphrase of the new key needed to resume
+	for _, a := range []struct {
+		path       string
+		recipients []string
+	}{
+		{s.parent.VaultFile(), append(slices.Clone(newPublicKeys), currentRecipients...)},
+		{s.parent.SshCa(), newPublicKeys},
+	} {
+		if !file.IsFile(a.path) {
+			continue
+		}
+		f := &ageRotationFile{path: a.path, status: "re-encrypted"}
+		files = append(files, f)
+		if f.err = s.reencryptAgeFile(a.path, a.recipients); f.err != nil {
+			failed++
+			f.status = "failed"
+		}
+	}
+
+	if failed == 0 {
+		if err := patchSopsConfig(sopsConfigPath, nil, currentRecipients); err != nil {
+			return err
+		}
+
+		// final check
+		log.Info("checking that all files decrypt with the new key only")
+		if err := os.Setenv("SOPS_AGE_KEY", string(newIdentity)); err != nil {
+			return err
+		}
+		for _, f := range files {
+			if f.status == "not encrypted" {
+				continue
+			}
+			if f.err = s.checkFile(f, currentRecipients); f.err != nil {
+				failed++
+				f.status = "check failed"
+			}
+		}
+	}
+
+	// Summary
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "FILE\tSTATUS\tERROR")
+	for _, f := range files {
+		errMessage := ""
+		if f.err != nil {
+			errMessage = f.err.Error()
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\n", f.path, f.status, errMessage)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d files failed. Fix them and run the command again to resume. Until then, both '%s' and '%s' are needed to decrypt", failed, len(files), privateKeyPath, newPrivateKeyPath)
+	}
+
+	// the public key goes first, so the private key always has a matching one
+	if err := os.Rename(newPublicKeyPath, publicKeyPath); err != nil {
+		return fmt.Errorf("all files are rotated, but replacing '%s' failed: %v. Rename '%s' and '%s' manually", publicKeyPath, err, newPrivateKeyPath, newPublicKeyPath)
+	}
+	if err := os.Rename(newPrivateKeyPath, privateKeyPath); err != nil {
+		return fmt.Errorf("all files are rotated, but replacing '%s' failed: %v. Rename '%s' manually", privateKeyPath, err, newPrivateKeyPath)
+	}
+	log.Infof("wrote: %s", privateKeyPath)
+	log.Infof("age public key: %s", strings.Join(newRecipients, ", "))
+	if err := s.finalizeVault(newPrivateKeyPath, privateKeyPath); err != nil {
+		log.Warnf("error re-encrypting the vault '%s' to the new key only, it is still encrypted to the previous key too: %v. Update it with vault set", s.parent.VaultFile(), err)
+	}
+
+	if s.UpdateClusterSecret() {
+		if err := s.updateClusterSecret(newIdentity); err != nil {
+			return fmt.Errorf("error updating in-cluster secret '%s/%s': %v. FluxCD can not decrypt until it is updated", s.Namespace(), s.ClusterSecret(), err)
+		}
+	}
+
+	return nil
+}
+
+// decryptNewIdentity decrypts the new key of an interrupted rotation, with its generated passphrase from the vault if stored there,
+// otherwise with the passphrase read as usual
+func (s *SecretsRotateAgeKey) decryptNewIdentity(currentIdentity, newPrivateKeyPath string) ([]byte, error) {
+	vaultFile := s.parent.VaultFile()
+	if file.IsFile(vaultFile) {
+		// the vault is encrypted to the current key until the rotation completes
+		if err := os.Setenv("SOPS_AGE_KEY", currentIdentity); err != nil {
+			return nil, err
+		}
+		entries, err := readVault(vaultFile, s.PrivateKeyPath())
+		if err != nil {
+			log.Debugf("not using the vault: %v", err)
+		}
+		if passphrase, ok := entries[vaultEntryName(newPrivateKeyPath)]; ok {
+			log.Infof("using generated age key passphrase from vault '%s'", vaultFile)
+			data, err := os.ReadFile(newPrivateKeyPath)
+			if err != nil {
+				return nil, err
+			}
+			identity, err := kubestrap.AgeDecryptWithPassphrase(data, []byte(passphrase))
+			if err != nil {
+				return nil, fmt.Errorf("error decrypting '%s': %v", newPrivateKeyPath, err)
+			}
+			return identity, nil
+		}
+	}
+	identity, err := decryptAgeIdentity(newPrivateKeyPath)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(identity), nil
+}
+
+// finalizeVault re-encrypts the vault to the new key only, once the key files are replaced,
+// renaming the entry of the passphrase of the new key, if generated, after the file it protects
+func (s *SecretsRotateAgeKey) finalizeVault(newPrivateKeyPath, privateKeyPath string) error {
+	vaultFile := s.parent.VaultFile()
+	if !file.IsFile(vaultFile) {
+		return nil
+	}
+	newEntryName, entryName := vaultEntryName(newPrivateKeyPath), vaultEntryName(privateKeyPath)
+	renamed := false
+	if err := updateVault(vaultFile, privateKeyPath, s.PublicKeyPath(), func(entries map[string]string) {
+		if passphrase, ok := entries[newEntryName]; ok {
+			entries[entryName] = passphrase
+			delete(entries, newEntryName)
+			renamed = true
+		}
+	}); err != nil {
+		return err
+	}
+	if renamed {
+		log.Infof("renamed generated age key passphrase in vault '%s' to '%s'", vaultFile, entryName)
+	}
+	log.Infof("re-encrypted vault '%s' to the new key", vaultFile)
+	return nil
+}
+
+// rotateFile replaces the data key of a sops encrypted file and its current age recipients with the new ones
+func (s *SecretsRotateAgeKey) rotateFile(path string, currentRecipients, newRecipients []string) (string, error) {
+	recipients, encrypted, err := sopsAgeRecipients(path)
+	if err != nil {
+		return "", err
+	}
+	if !encrypted {
+		return "not encrypted", nil
+	}
+	hasCurrent := slices.ContainsFunc(recipients, func(r string) bool { return slices.Contains(currentRecipients, r) })
+	hasNew := !slices.ContainsFunc(newRecipients, func(r string) bool { return !slices.Contains(recipients, r) })
+	if hasNew && !hasCurrent {
+		return "already rotated", nil
+	}
+	out, err := raw.RunRawCommandCaptureStdout(
+		raw.Cmd(),
+		[]string{
+			"sops",
+			"--rotate",
+			"--in-place",
+			"--add-age",
+			strings.Join(newRecipients, ","),
+			"--rm-age",
+			strings.Join(currentRecipients, ","),
+			path,
+		},
+	)
+	if err != nil {
+		if len(out) == 0 {
+			return "", err
+		}
+		return "", fmt.Errorf("%v\n%s", err, out)
+	}
+	return "rotated", nil
+}
+
+// reencryptAgeFile decrypts an age encrypted file and encrypts it to the recipients, replacing it only once encrypted
+func (s *SecretsRotateAgeKey) reencryptAgeFile(path string, recipients []string) error {
+	out, err := ageDecrypt(path, s.PrivateKeyPath())
+	if err != nil {
+		return err
+	}
+	data, err := kubestrap.AgeEncrypt([]byte(out), []byte(strings.Join(recipients, "\n")))
+	if err != nil {
+		return fmt.Errorf("error encrypting '%s': %v", path, err)
+	}
+	newPath := path + ".new"
+	if err := os.WriteFile(newPath, data, 0600); err != nil {
+		_ = os.Remove(newPath)
+		return err
+	}
+	return os.Rename(newPath, path)
+}
+
+// checkFile verifies that a file decrypts with the key in SOPS_AGE_KEY and is no longer encrypted to the current recipients
+func (s *SecretsRotateAgeKey) checkFile(f *ageRotationFile, currentRecipients []string) error {
+	if !f.sops {
+		_, err := ageDecrypt(f.path, s.PrivateKeyPath())
+		return err
+	}
+	recipients, _, err := sopsAgeRecipients(f.path)
+	if err != nil {
+		return err
+	}
+	if slices.ContainsFunc(recipients, func(r string) bool { return slices.Contains(currentRecipients, r) }) {
+		return fmt.Errorf("still encrypted to the current key")
+	}
+	out, err := raw.RunRawCommandCaptureStdout(
+		raw.Cmd(),
+		[]string{
+			"sops",
+			"--decrypt",
+			f.path,
+		},
+	)
+	if err != nil {
+		if len(out) == 0 {
+			return err
+		}
+		return fmt.Errorf("%v\n%s", err, out)
+	}
+	return nil
+}
+
+// updateClusterSecret creates or replaces the in-cluster secret holding the age key, as FluxCD expects it
+func (s *SecretsRotateAgeKey) updateClusterSecret(identity []byte) error {
+	log.Infof("updating in-cluster secret: %s/%s", s.Namespace(), s.ClusterSecret())
+	pipe := func(data []byte) {
+		reader, writer := io.Pipe()
+		raw.SetStdin(reader)
+		go func() {
+			_, _ = io.Copy(writer, bytes.NewReader(data))
+			_ = writer.Close()
+		}()
+	}
+	defer raw.SetStdin(nil)
+
+	pipe(identity)
+	manifest, err := raw.RunRawCommandCaptureStdout(
+		raw.Cmd(),
+		[]string{
+			"kubectl",
+			"--context",
+			s.parent.SecretsContext(),
+			"--namespace",
+			s.Namespace(),
+			"create",
+			"secret",
+			"generic",
+			s.ClusterSecret(),
+			"--from-file=age.agekey=/dev/stdin",
+			"--dry-run=client",
+			"--output",
+			"yaml",
+		},
+	)
+	if err != nil {
+		return err
+	}
+	pipe([]byte(manifest))
+	out, err := raw.RunRawCommandCaptureStdout(
+		raw.Cmd(),
+		[]string{
+			"kubectl",
+			"--context",
+			s.parent.SecretsContext(),
+			"apply",
+			"--filename",
+			"-",
+		},
+	)
+	if err != nil {
+		if len(out) == 0 {
+			return err
+		}
+		return fmt.Errorf("%v\n%s", err, out)
+	}
+	return nil
+}
+
+// sopsMetadata is the part of the sops metadata of an encrypted file kubestrap uses
+type sopsMetadata struct {
+	Age []struct {
+		Recipient string `yaml:"recipient"`
+	} `yaml:"age"`
+	LastModified string `yaml:"lastmodified"`
+	Mac          string `yaml:"mac"`
+}
+
+// readSopsMetadata returns the sops metadata of a file, or nil when it is not encrypted with sops
+func readSopsMetadata(path string) (*sopsMetadata, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	metadata, err := parseSopsMetadata(data)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing '%s': %v", path, err)
+	}
+	return metadata, nil
+}
+
+// parseSopsMetadata returns the sops metadata of YAML or JSON data, or nil when it is not encrypted with sops
+func parseSopsMetadata(data []byte) (*sopsMetadata, error) {
+	var doc struct {
+		Sops *sopsMetadata `yaml:"sops"`
+	}
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	return doc.Sops, nil
+}
+
+// sopsAgeRecipients returns the age recipients of a sops encrypted file, and whether it is encrypted with sops at all
+func sopsAgeRecipients(path string) ([]string, bool, error) {
+	metadata, err := readSopsMetadata(path)
+	if err != nil || metadata == nil {
+		return nil, false, err
+	}
+	recipients := make([]string, 0, len(metadata.Age))
+	for _, a := range metadata.Age {
+		recipients = append(recipients, a.Recipient)
+	}
+	return recipients, true, nil
+}
+
+func (s *SecretsRotateAgeKey) Cmd() *cobra.Command {
+	return s.cmd
+}
+
+func (s *SecretsRotateAgeKey) CheckRequiredFlags() error {
+	return s.parent.CheckRequiredFlags()
+}
+
+// Flags keys, defaults and value getters
+func (s *SecretsRotateAgeKey) KeyPrivateKeyPath() string {
+	return "private-key"
+}
+
+func (s *SecretsRotateAgeKey) DefaultPrivateKeyPath() string {
+	return "secrets/" + defaults.Undefined + ".age"
+}
+
+func (s *SecretsRotateAgeKey) PrivateKeyPath() string {
+	privateKeyPath := config.ViperGetString(s.cmd, s.KeyPrivateKeyPath())
+	if privateKeyPath == s.DefaultPrivateKeyPath() {
+		privateKeyPath = s.parent.AgePrivateKeyPath()
+	}
+	return privateKeyPath
+}
+
+func (s *SecretsRotateAgeKey) KeyPublicKeyPath() string {
+	return "public-key"
+}
+
+func (s *SecretsRotateAgeKey) DefaultPublicKeyPath() string {
+	return s.DefaultPrivateKeyPath() + ".pub"
+}
+
+func (s *SecretsRotateAgeKey) PublicKeyPath() string {
+	publicKeyPath := config.ViperGetString(s.cmd, s.KeyPublicKeyPath())
+	if publicKeyPath == s.DefaultPublicKeyPath() {
+		publicKeyPath = s.PrivateKeyPath() + ".pub"
+	}
+	return publicKeyPath
+}
+
+func (s *SecretsRotateAgeKey) KeyUpdateClusterSecret() string {
+	return "update-cluster-secret"
+}
+
+func (s *SecretsRotateAgeKey) UpdateClusterSecret() bool {
+	return config.ViperGetBool(s.cmd, s.KeyUpdateClusterSecret())
+}
+
+func (s *SecretsRotateAgeKey) KeyNamespace() string {
+	return "namespace"
+}
+
+func (s *SecretsRotateAgeKey) Namespace() string {
+	return config.ViperGetString(s.cmd, s.KeyNamespace())
+}
+
+func (s *SecretsRotateAgeKey) KeyClusterSecret() string {
+	return "cluster-secret"
+}
+
+func (s *SecretsRotateAgeKey) ClusterSecret() string {
+	return config.ViperGetString(s.cmd, s.KeyClusterSecret())
+}
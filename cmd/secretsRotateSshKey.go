@@ -0,0 +1,435 @@
+/*
+Copyright © 2023 Dataflows
+*/
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/k0sproject/rig"
+	"github.com/spf13/cobra"
+	"github.com/thedataflows/go-commons/pkg/config"
+	"github.com/thedataflows/go-commons/pkg/defaults"
+	"github.com/thedataflows/go-commons/pkg/file"
+	"github.com/thedataflows/go-commons/pkg/lang"
+	"github.com/thedataflows/go-commons/pkg/log"
+	"github.com/thedataflows/kubestrap/pkg/constants"
+	"github.com/thedataflows/kubestrap/pkg/kubestrap"
+	"golang.org/x/crypto/ssh"
+)
+
+type SecretsRotateSshKey struct {
+	cmd    *cobra.Command
+	parent *Secrets
+}
+
+var (
+	_ = NewSecretsRotateSshKey(secrets)
+)
+
+func init() {
+
+}
+
+func NewSecretsRotateSshKey(parent *Secrets) *SecretsRotateSshKey {
+	sr := &SecretsRotateSshKey{
+		parent: parent,
+	}
+
+	sr.cmd = &cobra.Command{
+		Use:   "rotate-ssh-key",
+		Short: "Replaces the cluster SSH key on all hosts using it, then locally. Rolls back if any host fails",
+		Long: `Rotation runs in steps, each on all cluster hosts and bastions using the key, before the next step:
+  1. generate a new key pair, next to the current one with the '.new' suffix
+  2. authorize the new public key, connecting with the current key
+  3. verify that login works with the new key
+  4. remove the current public key from the authorized keys, connecting with the new key
+  5. replace the local key files with the new ones
+If any host fails, the changes already made on hosts are reverted and the new key pair is removed.`,
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			keyType := sr.SshKeyType()
+			if !slices.Contains(sshKeyTypes, keyType) {
+				return fmt.Errorf("invalid SSH key type: %s. Valid: %v", keyType, sshKeyTypes)
+			}
+			return nil
+		},
+		RunE:          sr.RunSecretsRotateSshKeyCommand,
+		SilenceErrors: parent.Cmd().SilenceErrors,
+		SilenceUsage:  parent.Cmd().SilenceUsage,
+	}
+
+	parent.Cmd().AddCommand(sr.cmd)
+
+	sr.cmd.Flags().StringP(
+		sr.KeyPrivateKeyFile(),
+		"k",
+		sr.DefaultPrivateKeyFile(),
+		"Private key file to rotate. Hosts and bastions are selected by their keyPath referring to it",
+	)
+
+	sr.cmd.Flags().String(
+		sr.KeySshKeyType(),
+		sshKeyTypes[0],
+		fmt.Sprintf("SSH Private Key Type of the new key. Valid values: %v", sshKeyTypes),
+	)
+
+	// Bind flags to config
+	config.ViperBindPFlagSet(sr.cmd, nil)
+
+	return sr
+}
+
+// rotationTarget is an SSH endpoint authenticating with the rotated key, with the rotation steps completed on it
+type rotationTarget struct {
+	settings   *rig.SSH
+	address    string
+	installed  bool
+	verified   bool
+	removed    bool
+	rolledBack bool
+	err        error
+}
+
+func (s *SecretsRotateSshKey) RunSecretsRotateSshKeyCommand(cmd *cobra.Command, args []string) error {
+	if err := s.CheckRequiredFlags(); err != nil {
+		return err
+	}
+
+	cl, err := kubestrap.NewK0sCluster(s.parent.SecretsContext(), s.parent.ClusterBootstrapPath())
+	if err != nil {
+		return err
+	}
+	privateKeyFile, err := filepath.Abs(s.PrivateKeyFile())
+	if err != nil {
+		return err
+	}
+	publicKeyFile := privateKeyFile + ".pub"
+	newPrivateKeyFile := privateKeyFile + ".new"
+	newPublicKeyFile := newPrivateKeyFile + ".pub"
+	if file.IsFile(newPrivateKeyFile) {
+		return fmt.Errorf("'%s' exists, perhaps from an interrupted rotation. Remove it after making sure it is not authorized on any host", newPrivateKeyFile)
+	}
+
+	// key paths in the cluster spec are relative to it
+	clusterBootstrapPath, err := filepath.Abs(s.parent.ClusterBootstrapPath())
+	if err != nil {
+		return err
+	}
+	knownHosts, err := s.parent.parent.KnownHosts(clusterBootstrapPath)
+	if err != nil {
+		return err
+	}
+	currentDir := file.WorkingDirectory()
+	if err := os.Chdir(clusterBootstrapPath); err != nil {
+		return err
+	}
+	defer func() { _ = os.Chdir(currentDir) }()
+
+	usesKey := func(settings *rig.SSH) bool {
+		if settings.KeyPath == nil {
+			return false
+		}
+		keyPath, err := filepath.Abs(strings.TrimSuffix(*settings.KeyPath, ".pub"))
+		return err == nil && keyPath == privateKeyFile
+	}
+	targets := []*rotationTarget{}
+	for _, h := range cl.GetClusterSpec().Spec.Hosts {
+		if h.SSH == nil || !usesKey(h.SSH) {
+			log.Warnf("[%s] skipping host not using '%s'", hostLabel(h), privateKeyFile)
+		}
+		if h.SSH == nil {
+			continue
+		}
+		for settings := h.SSH; settings != nil; settings = settings.Bastion {
+			address := lang.If(settings.User != "", settings.User, "root") + "@" + kubestrap.SSHAddress(settings)
+			if !usesKey(settings) || slices.ContainsFunc(targets, func(t *rotationTarget) bool { return t.address == address }) {
+				continue
+			}
+			targets = append(targets, &rotationTarget{settings: settings, address: address})
+		}
+	}
+	if len(targets) == 0 {
+		return fmt.Errorf("no cluster hosts or bastions use '%s'", privateKeyFile)
+	}
+
+	// current key
+	currentKey, err := os.ReadFile(privateKeyFile)
+	if err != nil {
+		return err
+	}
+	currentSigner, err := signerFromPrivateKey(currentKey)
+	if err != nil {
+		return err
+	}
+	currentPubKey := string(ssh.MarshalAuthorizedKey(currentSigner.PublicKey()))
+
+	// new key
+	log.Infof("generating new %s SSH key", s.SshKeyType())
+	newPrivateKeyRaw, newPublicKeySsh, err := generateKeyPair(s.SshKeyType())
+	if err != nil {
+		return err
+	}
+	newSigner, err := ssh.NewSignerFromKey(newPrivateKeyRaw)
+	if err != nil {
+		return err
+	}
+	passphrase, generated, err := readOrGeneratePassphrase("SSH key", 32, true)
+	if err != nil {
+		return err
+	}
+	newPubKeyBytes, newPrivKeyBytes, err := encodeKeyPair(newPrivateKeyRaw, newPublicKeySsh, passphrase)
+	if err != nil {
+		return err
+	}
+	vaultFile := s.parent.VaultFile()
+	agePrivateKeyPath := s.parent.AgePrivateKeyPath()
+	vaultEntry, newVaultEntry := vaultEntryName(privateKeyFile), vaultEntryName(newPrivateKeyFile)
+	if generated {
+		// stored before the key is written, so it can always be decrypted
+		if err := updateVault(vaultFile, agePrivateKeyPath, agePrivateKeyPath+".pub", func(entries map[string]string) {
+			entries[newVaultEntry] = string(passphrase)
+		}); err != nil {
+			return fmt.Errorf("error storing generated SSH key passphrase in vault: %v", err)
+		}
+		log.Infof("stored generated SSH key passphrase in vault '%s' as '%s'", vaultFile, newVaultEntry)
+	}
+	newPubKey := string(newPubKeyBytes)
+	if err := os.WriteFile(newPrivateKeyFile, newPrivKeyBytes, 0600); err != nil {
+		return fmt.Errorf("error writing private key: %s", err)
+	}
+	if err := os.WriteFile(newPublicKeyFile, newPubKeyBytes, 0600); err != nil {
+		_ = os.Remove(newPrivateKeyFile)
+		return fmt.Errorf("error writing public key: %s", err)
+	}
+	log.Infof("wrote: %s", newPrivateKeyFile)
+
+	// hops using the rotated key authenticate only with signer, other bastions with their own key
+	authWith := func(signer ssh.Signer) sshAuthFunc {
+		return func(settings *rig.SSH) ([]ssh.AuthMethod, error) {
+			if usesKey(settings) {
+				return []ssh.AuthMethod{ssh.PublicKeys(signer)}, nil
+			}
+			return identityAuth(nil, nil)(settings)
+		}
+	}
+	run := func(t *rotationTarget, signer ssh.Signer, command string) error {
+		client, err := dialSSH(t.settings, authWith(signer), knownHosts.HostKeyCallback())
+		if err != nil {
+			return err
+		}
+		defer client.Close()
+		if _, stderr, err := sshRunCommand(client, command); err != nil {
+			return fmt.Errorf("%v: %s", err, strings.TrimSpace(stderr))
+		}
+		return nil
+	}
+	user := func(t *rotationTarget) string {
+		return lang.If(t.settings.User != "", t.settings.User, "root")
+	}
+
+	steps := []struct {
+		name string
+		run  func(t *rotationTarget) error
+	}{
+		{
+			name: "authorizing new key",
+			run: func(t *rotationTarget) error {
+				script, err := addAuthorizedKeyScript(user(t), newPubKey, "")
+				if err == nil {
+					err = run(t, currentSigner, script)
+				}
+				t.installed = err == nil
+				return err
+			},
+		},
+		{
+			name: "verifying login with new key",
+			run: func(t *rotationTarget) error {
+				err := run(t, newSigner, "true")
+				t.verified = err == nil
+				return err
+			},
+		},
+		{
+			name: "removing current key",
+			run: func(t *rotationTarget) error {
+				script, err := removeAuthorizedKeyScript(user(t), currentPubKey)
+				if err == nil {
+					err = run(t, newSigner, script)
+				}
+				t.removed = err == nil
+				return err
+			},
+		},
+	}
+
+	var rotationErr error
+	for _, step := range steps {
+		for _, t := range targets {
+			log.Infof("[%s] %s", t.address, step.name)
+			if err := step.run(t); err != nil {
+				log.Errorf("[%s] failed %s: %v", t.address, step.name, err)
+				t.err = fmt.Errorf("failed %s: %v", step.name, err)
+				rotationErr = fmt.Errorf("rotating '%s' failed on %s", privateKeyFile, t.address)
+				break
+			}
+		}
+		if rotationErr != nil {
+			break
+		}
+	}
+
+	if rotationErr != nil {
+		log.Warnf("rolling back")
+		if err := s.rollback(targets, run, user, currentPubKey, newPubKey, currentSigner, newSigner); err != nil {
+			rotationErr = errors.Join(rotationErr, err)
+		}
+		for _, f := range []string{newPrivateKeyFile, newPublicKeyFile} {
+			if err := os.Remove(f); err != nil {
+				rotationErr = errors.Join(rotationErr, err)
+			}
+		}
+		if generated {
+			if err := updateVault(vaultFile, agePrivateKeyPath, agePrivateKeyPath+".pub", func(entries map[string]string) {
+				delete(entries, newVaultEntry)
+			}); err != nil {
+				rotationErr = errors.Join(rotationErr, fmt.Errorf("error removing '%s' from vault: %v", newVaultEntry, err))
+			}
+		}
+	} else {
+		// the public key goes first, so the private key always has a matching one
+		if err := os.Rename(newPublicKeyFile, publicKeyFile); err != nil {
+			rotationErr = fmt.Errorf("hosts authorize only the new key, but replacing '%s' failed: %v. Rename '%s' and '%s' manually", publicKeyFile, err, newPrivateKeyFile, newPublicKeyFile)
+		} else if err := os.Rename(newPrivateKeyFile, privateKeyFile); err != nil {
+			rotationErr = fmt.Errorf("hosts authorize only the new key, but replacing '%s' failed: %v. Rename '%s' manually", privateKeyFile, err, newPrivateKeyFile)
+		} else {
+			log.Infof("wrote: %s", privateKeyFile)
+			log.Infof("SSH Public key: %s", strings.TrimSpace(newPubKey))
+		}
+		// the passphrase of the current key is obsolete
+		if rotationErr == nil && (generated || file.IsFile(vaultFile)) {
+			if err := updateVault(vaultFile, agePrivateKeyPath, agePrivateKeyPath+".pub", func(entries map[string]string) {
+				delete(entries, vaultEntry)
+				if generated {
+					entries[vaultEntry] = entries[newVaultEntry]
+					delete(entries, newVaultEntry)
+				}
+			}); err != nil {
+				rotationErr = fmt.Errorf("error renaming '%s' to '%s' in vault: %v", newVaultEntry, vaultEntry, err)
+			} else if generated {
+				log.Infof("stored generated SSH key passphrase in vault '%s' as '%s'", vaultFile, vaultEntry)
+			}
+		}
+	}
+
+	// Summary
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "HOST\tSTATUS\tERROR")
+	for _, t := range targets {
+		status := "pending"
+		switch {
+		case t.rolledBack:
+			status = "rolled back"
+		case t.removed:
+			status = "rotated"
+		case t.err != nil:
+			status = "failed"
+		}
+		errMessage := ""
+		if t.err != nil {
+			errMessage = t.err.Error()
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\n", t.address, status, errMessage)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	return rotationErr
+}
+
+// rollback re-authorizes the current key where it was removed, then removes the new key where it was authorized
+func (s *SecretsRotateSshKey) rollback(
+	targets []*rotationTarget,
+	run func(t *rotationTarget, signer ssh.Signer, command string) error,
+	user func(t *rotationTarget) string,
+	currentPubKey, newPubKey string,
+	currentSigner, newSigner ssh.Signer,
+) error {
+	var rollbackErr error
+	for _, t := range targets {
+		if !t.removed {
+			continue
+		}
+		log.Infof("[%s] authorizing current key again", t.address)
+		script, err := addAuthorizedKeyScript(user(t), currentPubKey, "")
+		if err == nil {
+			err = run(t, newSigner, script)
+		}
+		if err != nil {
+			log.Errorf("[%s] failed authorizing current key again: %v", t.address, err)
+			t.err = errors.Join(t.err, fmt.Errorf("failed rollback: %v", err))
+			rollbackErr = errors.Join(rollbackErr, fmt.Errorf("rollback failed on %s, which authorizes only the new key from '%s'", t.address, newPubKey))
+			continue
+		}
+		t.removed = false
+	}
+	for _, t := range targets {
+		if !t.installed || t.removed {
+			continue
+		}
+		log.Infof("[%s] removing new key", t.address)
+		script, err := removeAuthorizedKeyScript(user(t), newPubKey)
+		if err == nil {
+			err = run(t, currentSigner, script)
+		}
+		if err != nil {
+			log.Errorf("[%s] failed removing new key: %v", t.address, err)
+			t.err = errors.Join(t.err, fmt.Errorf("failed rollback: %v", err))
+			rollbackErr = errors.Join(rollbackErr, fmt.Errorf("rollback failed on %s, which still authorizes the new key", t.address))
+			continue
+		}
+		t.installed = false
+		t.rolledBack = true
+	}
+	return rollbackErr
+}
+
+func (s *SecretsRotateSshKey) Cmd() *cobra.Command {
+	return s.cmd
+}
+
+func (s *SecretsRotateSshKey) CheckRequiredFlags() error {
+	return s.parent.CheckRequiredFlags()
+}
+
+// Flags keys, defaults and value getters
+func (s *SecretsRotateSshKey) KeyPrivateKeyFile() string {
+	return "private-key-file"
+}
+
+func (s *SecretsRotateSshKey) DefaultPrivateKeyFile() string {
+	return fmt.Sprintf("bootstrap/cluster-%s/%s", defaults.Undefined, constants.DefaultClusterSshKeyFileName)
+}
+
+func (s *SecretsRotateSshKey) PrivateKeyFile() string {
+	privateKeyFile := config.ViperGetString(s.cmd, s.KeyPrivateKeyFile())
+	if privateKeyFile == s.DefaultPrivateKeyFile() {
+		privateKeyFile = s.parent.ClusterBootstrapPath() + "/" + constants.DefaultClusterSshKeyFileName
+	}
+	return privateKeyFile
+}
+
+func (s *SecretsRotateSshKey) KeySshKeyType() string {
+	return "ssh-key-type"
+}
+
+func (s *SecretsRotateSshKey) SshKeyType() string {
+	return config.ViperGetString(s.cmd, s.KeySshKeyType())
+}
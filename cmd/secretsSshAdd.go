@@ -0,0 +1,208 @@
+/*
+Copyright © 2023 Dataflows
+*/
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/thedataflows/go-commons/pkg/config"
+	"github.com/thedataflows/go-commons/pkg/defaults"
+	"github.com/thedataflows/go-commons/pkg/log"
+	"github.com/thedataflows/kubestrap/pkg/constants"
+	"github.com/thedataflows/kubestrap/pkg/kubestrap"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+type SecretsSshAdd struct {
+	cmd    *cobra.Command
+	parent *Secrets
+}
+
+var (
+	_ = NewSecretsSshAdd(secrets)
+)
+
+func init() {
+
+}
+
+func NewSecretsSshAdd(parent *Secrets) *SecretsSshAdd {
+	sa := &SecretsSshAdd{
+		parent: parent,
+	}
+
+	sa.cmd = &cobra.Command{
+		Use:   "ssh-add",
+		Short: "Decrypts the cluster SSH key and loads it into the running SSH agent",
+		Long: `The agent is found with SSH_AUTH_SOCK, or pageant and the OpenSSH agent on windows.
+Once loaded, cluster commands, secrets commands connecting to hosts and k0sctl use the key from the agent, without asking for its passphrase.`,
+		Example: parent.parent.cmd.Use + " " + parent.cmd.Use + " --context mycontext ssh-add --lifetime 2h\n" +
+			parent.parent.cmd.Use + " " + parent.cmd.Use + " --context mycontext ssh-add --delete",
+		RunE:          sa.RunSecretsSshAddCommand,
+		SilenceErrors: parent.Cmd().SilenceErrors,
+		SilenceUsage:  parent.Cmd().SilenceUsage,
+	}
+
+	parent.Cmd().AddCommand(sa.cmd)
+
+	sa.cmd.Flags().StringP(
+		sa.KeyPrivateKeyFile(),
+		"k",
+		sa.DefaultPrivateKeyFile(),
+		"Private key file to load",
+	)
+
+	sa.cmd.Flags().DurationP(
+		sa.KeyLifetime(),
+		"t",
+		0,
+		"Maximum lifetime of the key in the agent, e.g. 8h. Unlimited if 0",
+	)
+
+	sa.cmd.Flags().Bool(
+		sa.KeyConfirm(),
+		false,
+		"Ask the agent to confirm each use of the key",
+	)
+
+	sa.cmd.Flags().BoolP(
+		sa.KeyDelete(),
+		"D",
+		false,
+		"Remove the key from the agent instead",
+	)
+
+	// Bind flags to config
+	config.ViperBindPFlagSet(sa.cmd, nil)
+
+	return sa
+}
+
+func (s *SecretsSshAdd) RunSecretsSshAddCommand(cmd *cobra.Command, args []string) error {
+	if err := s.CheckRequiredFlags(); err != nil {
+		return err
+	}
+
+	lifetime := s.Lifetime()
+	if lifetime < 0 || lifetime.Seconds() > float64(^uint32(0)) {
+		return fmt.Errorf("invalid lifetime: %s", lifetime)
+	}
+
+	sshAgent, err := kubestrap.SSHAgent()
+	if err != nil {
+		return fmt.Errorf("%v. Start one with 'eval $(ssh-agent)'", err)
+	}
+
+	privateKeyFile, err := filepath.Abs(s.PrivateKeyFile())
+	if err != nil {
+		return err
+	}
+	privateKey, err := os.ReadFile(privateKeyFile)
+	if err != nil {
+		return err
+	}
+
+	rawKey, err := ssh.ParseRawPrivateKey(privateKey)
+	var pubKey ssh.PublicKey
+	if passphraseErr, ok := err.(*ssh.PassphraseMissingError); ok {
+		pubKey = passphraseErr.PublicKey
+		if s.Delete() && pubKey != nil {
+			return s.removeKey(sshAgent, pubKey, privateKeyFile)
+		}
+		var passphrase []byte
+		passphrase, err = readPassphrase(fmt.Sprintf("Enter passphrase for %s: ", privateKeyFile))
+		if err != nil {
+			return fmt.Errorf("error reading passphrase: %v", err)
+		}
+		rawKey, err = ssh.ParseRawPrivateKeyWithPassphrase(privateKey, passphrase)
+	}
+	if err != nil {
+		return fmt.Errorf("error decrypting private key: %v", err)
+	}
+	signer, err := ssh.NewSignerFromKey(rawKey)
+	if err != nil {
+		return err
+	}
+	pubKey = signer.PublicKey()
+	if s.Delete() {
+		return s.removeKey(sshAgent, pubKey, privateKeyFile)
+	}
+
+	if err := sshAgent.Add(agent.AddedKey{
+		PrivateKey:       rawKey,
+		Comment:          privateKeyFile,
+		LifetimeSecs:     uint32(lifetime.Seconds()),
+		ConfirmBeforeUse: s.Confirm(),
+	}); err != nil {
+		return fmt.Errorf("error adding key to ssh agent: %v", err)
+	}
+	log.Infof("added %s (%s) to ssh agent", privateKeyFile, ssh.FingerprintSHA256(pubKey))
+	if lifetime > 0 {
+		log.Infof("key expires at %s", time.Now().Add(lifetime).Format(time.RFC3339))
+	}
+
+	return nil
+}
+
+func (s *SecretsSshAdd) removeKey(sshAgent agent.Agent, pubKey ssh.PublicKey, privateKeyFile string) error {
+	if err := sshAgent.Remove(pubKey); err != nil {
+		return fmt.Errorf("error removing key from ssh agent: %v", err)
+	}
+	log.Infof("removed %s (%s) from ssh agent", privateKeyFile, ssh.FingerprintSHA256(pubKey))
+	return nil
+}
+
+func (s *SecretsSshAdd) Cmd() *cobra.Command {
+	return s.cmd
+}
+
+func (s *SecretsSshAdd) CheckRequiredFlags() error {
+	return s.parent.CheckRequiredFlags()
+}
+
+// Flags keys, defaults and value getters
+func (s *SecretsSshAdd) KeyPrivateKeyFile() string {
+	return "private-key-file"
+}
+
+func (s *SecretsSshAdd) DefaultPrivateKeyFile() string {
+	return fmt.Sprintf("bootstrap/cluster-%s/%s", defaults.Undefined, constants.DefaultClusterSshKeyFileName)
+}
+
+func (s *SecretsSshAdd) PrivateKeyFile() string {
+	privateKeyFile := config.ViperGetString(s.cmd, s.KeyPrivateKeyFile())
+	if privateKeyFile == s.DefaultPrivateKeyFile() {
+		privateKeyFile = s.parent.ClusterBootstrapPath() + "/" + constants.DefaultClusterSshKeyFileName
+	}
+	return privateKeyFile
+}
+
+func (s *SecretsSshAdd) KeyLifetime() string {
+	return "lifetime"
+}
+
+func (s *SecretsSshAdd) Lifetime() time.Duration {
+	return config.ViperGetDuration(s.cmd, s.KeyLifetime())
+}
+
+func (s *SecretsSshAdd) KeyConfirm() string {
+	return "confirm"
+}
+
+func (s *SecretsSshAdd) Confirm() bool {
+	return config.ViperGetBool(s.cmd, s.KeyConfirm())
+}
+
+func (s *SecretsSshAdd) KeyDelete() string {
+	return "delete"
+}
+
+func (s *SecretsSshAdd) Delete() bool {
+	return config.ViperGetBool(s.cmd, s.KeyDelete())
+}
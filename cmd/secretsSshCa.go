@@ -0,0 +1,78 @@
+/*
+Copyright © 2023 Dataflows
+*/
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"golang.org/x/crypto/ssh"
+)
+
+type SecretsSshCa struct {
+	cmd    *cobra.Command
+	parent *Secrets
+}
+
+var (
+	secretsSshCa = NewSecretsSshCa(secrets)
+)
+
+func init() {
+
+}
+
+func NewSecretsSshCa(parent *Secrets) *SecretsSshCa {
+	sc := &SecretsSshCa{
+		parent: parent,
+	}
+
+	sc.cmd = &cobra.Command{
+		Use:   "ssh-ca",
+		Short: "Manages the SSH certificate authority trusted by the cluster hosts",
+		Long: `Hosts trusting the CA accept any user certificate it issued, instead of keys in authorized_keys.
+The CA private key is kept in the secrets directory, encrypted with age to the cluster recipients.`,
+		SilenceErrors: parent.Cmd().SilenceErrors,
+		SilenceUsage:  parent.Cmd().SilenceUsage,
+	}
+
+	parent.Cmd().AddCommand(sc.cmd)
+
+	return sc
+}
+
+// loadSshCa decrypts the SSH CA private key with the age private key
+func loadSshCa(caPath, agePrivateKeyPath string) (ssh.Signer, error) {
+	out, err := ageDecrypt(caPath, agePrivateKeyPath)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := ssh.ParsePrivateKey([]byte(strings.TrimSpace(out) + "\n"))
+	if err != nil {
+		return nil, fmt.Errorf("error parsing SSH CA private key '%s': %v", caPath, err)
+	}
+	return signer, nil
+}
+
+// readSshCaPublicKey returns the SSH CA public key in authorized keys format
+func readSshCaPublicKey(caPath string) (string, error) {
+	data, err := os.ReadFile(caPath + ".pub")
+	if err != nil {
+		return "", fmt.Errorf("error reading SSH CA public key: %v. Initialize the CA first", err)
+	}
+	if _, _, _, _, err := ssh.ParseAuthorizedKey(data); err != nil {
+		return "", fmt.Errorf("error parsing SSH CA public key '%s.pub': %v", caPath, err)
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+func (s *SecretsSshCa) Cmd() *cobra.Command {
+	return s.cmd
+}
+
+func (s *SecretsSshCa) CheckRequiredFlags() error {
+	return s.parent.CheckRequiredFlags()
+}
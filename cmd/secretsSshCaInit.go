@@ -0,0 +1,162 @@
+/*
+Copyright © 2023 Dataflows
+*/
+package cmd
+
+import (
+	"bytes"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"github.com/spf13/cobra"
+	"github.com/thedataflows/go-commons/pkg/config"
+	"github.com/thedataflows/go-commons/pkg/defaults"
+	"github.com/thedataflows/go-commons/pkg/file"
+	"github.com/thedataflows/go-commons/pkg/log"
+	"golang.org/x/crypto/ssh"
+)
+
+type SecretsSshCaInit struct {
+	cmd    *cobra.Command
+	parent *SecretsSshCa
+}
+
+var (
+	_ = NewSecretsSshCaInit(secretsSshCa)
+)
+
+func init() {
+
+}
+
+func NewSecretsSshCaInit(parent *SecretsSshCa) *SecretsSshCaInit {
+	si := &SecretsSshCaInit{
+		parent: parent,
+	}
+
+	si.cmd = &cobra.Command{
+		Use:   "init",
+		Short: "Generates the SSH CA key pair. The private key is encrypted with age to the cluster recipients",
+		Long:  ``,
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			keyType := si.SshKeyType()
+			if !slices.Contains(sshKeyTypes, keyType) {
+				return fmt.Errorf("invalid SSH key type: %s. Valid: %v", keyType, sshKeyTypes)
+			}
+			return nil
+		},
+		RunE:          si.RunSecretsSshCaInitCommand,
+		SilenceErrors: parent.Cmd().SilenceErrors,
+		SilenceUsage:  parent.Cmd().SilenceUsage,
+	}
+
+	parent.Cmd().AddCommand(si.cmd)
+
+	si.cmd.Flags().String(
+		si.KeyPublicKeyPath(),
+		si.DefaultPublicKeyPath(),
+		"Age public key path, the recipients of the encrypted CA private key. Can have multiple keys separated by new lines",
+	)
+
+	si.cmd.Flags().String(
+		si.KeySshKeyType(),
+		sshKeyTypes[3],
+		fmt.Sprintf("SSH CA Key Type. Valid values: %v", sshKeyTypes),
+	)
+
+	si.cmd.Flags().Bool(
+		si.KeyForce(),
+		false,
+		"Force overwrites. Certificates issued by the previous CA are no longer trusted once the new CA is installed instead",
+	)
+
+	// Bind flags to config
+	config.ViperBindPFlagSet(si.cmd, nil)
+
+	return si
+}
+
+func (s *SecretsSshCaInit) RunSecretsSshCaInitCommand(cmd *cobra.Command, args []string) error {
+	if err := s.CheckRequiredFlags(); err != nil {
+		return err
+	}
+
+	caPath := s.parent.parent.SshCa()
+	if file.IsFile(caPath) && !s.Force() {
+		return fmt.Errorf("'%s' exists. Use --force flag to override", caPath)
+	}
+	if !file.IsFile(s.PublicKeyPath()) {
+		return fmt.Errorf("age public key '%s' does not exist. Bootstrap the secrets first", s.PublicKeyPath())
+	}
+	if err := os.MkdirAll(filepath.Dir(caPath), 0700); err != nil {
+		return err
+	}
+
+	privateKeyRaw, publicKeySsh, err := generateKeyPair(s.SshKeyType())
+	if err != nil {
+		return err
+	}
+	comment := fmt.Sprintf("kubestrap SSH CA %s", s.parent.parent.SecretsContext())
+	privBlock, err := ssh.MarshalPrivateKey(privateKeyRaw, comment)
+	if err != nil {
+		return err
+	}
+
+	if err := ageEncrypt(pem.EncodeToMemory(privBlock), s.PublicKeyPath(), caPath); err != nil {
+		return err
+	}
+	log.Infof("wrote: %s", caPath)
+
+	pubKey := bytes.TrimSpace(ssh.MarshalAuthorizedKey(publicKeySsh))
+	if err := os.WriteFile(caPath+".pub", append(pubKey, []byte(" "+comment+"\n")...), 0644); err != nil {
+		return fmt.Errorf("error writing public key: %s", err)
+	}
+	log.Infof("wrote: %s.pub", caPath)
+	log.Infof("SSH CA public key: %s", pubKey)
+
+	return nil
+}
+
+func (s *SecretsSshCaInit) Cmd() *cobra.Command {
+	return s.cmd
+}
+
+func (s *SecretsSshCaInit) CheckRequiredFlags() error {
+	return s.parent.CheckRequiredFlags()
+}
+
+// Flags keys, defaults and value getters
+func (s *SecretsSshCaInit) KeyPublicKeyPath() string {
+	return "public-key"
+}
+
+func (s *SecretsSshCaInit) DefaultPublicKeyPath() string {
+	return "secrets/" + defaults.Undefined + ".age.pub"
+}
+
+func (s *SecretsSshCaInit) PublicKeyPath() string {
+	publicKeyPath := config.ViperGetString(s.cmd, s.KeyPublicKeyPath())
+	if publicKeyPath == s.DefaultPublicKeyPath() {
+		publicKeyPath = s.parent.parent.SecretsDir() + "/" + s.parent.parent.SecretsContext() + ".age.pub"
+	}
+	return publicKeyPath
+}
+
+func (s *SecretsSshCaInit) KeySshKeyType() string {
+	return "ssh-key-type"
+}
+
+func (s *SecretsSshCaInit) SshKeyType() string {
+	return config.ViperGetString(s.cmd, s.KeySshKeyType())
+}
+
+func (s *SecretsSshCaInit) KeyForce() string {
+	return "force"
+}
+
+func (s *SecretsSshCaInit) Force() bool {
+	return config.ViperGetBool(s.cmd, s.KeyForce())
+}
@@ -0,0 +1,136 @@
+/*
+Copyright © 2023 Dataflows
+*/
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/k0sproject/k0sctl/pkg/apis/k0sctl.k0sproject.io/v1beta1/cluster"
+	"github.com/k0sproject/rig/exec"
+	"github.com/spf13/cobra"
+	"github.com/thedataflows/go-commons/pkg/config"
+	"github.com/thedataflows/go-commons/pkg/file"
+	"github.com/thedataflows/go-commons/pkg/log"
+	"github.com/thedataflows/kubestrap/pkg/kubestrap"
+)
+
+type SecretsSshCaInstall struct {
+	cmd           *cobra.Command
+	parent        *SecretsSshCa
+	hostSelection *HostSelection
+}
+
+var (
+	_ = NewSecretsSshCaInstall(secretsSshCa)
+)
+
+func init() {
+
+}
+
+func NewSecretsSshCaInstall(parent *SecretsSshCa) *SecretsSshCaInstall {
+	si := &SecretsSshCaInstall{
+		parent: parent,
+	}
+
+	si.cmd = &cobra.Command{
+		Use:   "install",
+		Short: "Configures sshd on the cluster hosts to trust user certificates issued by the SSH CA. Exits with error if it failed on any host",
+		Long: fmt.Sprintf(`The CA public key is added to the file sshd reads TrustedUserCAKeys from, or to '%s' configured as such.
+The sshd configuration is validated, restored if invalid, and sshd is reloaded. Requires root or passwordless sudo.`, kubestrap.TrustedUserCAKeysPath),
+		RunE:          si.RunSecretsSshCaInstallCommand,
+		SilenceErrors: parent.Cmd().SilenceErrors,
+		SilenceUsage:  parent.Cmd().SilenceUsage,
+	}
+
+	parent.Cmd().AddCommand(si.cmd)
+
+	si.hostSelection = NewHostSelection(si.cmd)
+
+	// Bind flags to config
+	config.ViperBindPFlagSet(si.cmd, nil)
+
+	return si
+}
+
+func (s *SecretsSshCaInstall) RunSecretsSshCaInstallCommand(cmd *cobra.Command, args []string) error {
+	if err := s.CheckRequiredFlags(); err != nil {
+		return err
+	}
+
+	secrets := s.parent.parent
+	caPubKey, err := readSshCaPublicKey(secrets.SshCa())
+	if err != nil {
+		return err
+	}
+
+	cl, err := kubestrap.NewK0sCluster(secrets.SecretsContext(), secrets.ClusterBootstrapPath())
+	if err != nil {
+		return err
+	}
+	hosts, err := s.hostSelection.Select(cl.GetClusterSpec().Spec.Hosts)
+	if err != nil {
+		return err
+	}
+
+	// key paths in the cluster spec are relative to it
+	clusterBootstrapPath, err := filepath.Abs(secrets.ClusterBootstrapPath())
+	if err != nil {
+		return err
+	}
+	knownHosts, err := secrets.parent.KnownHosts(clusterBootstrapPath)
+	if err != nil {
+		return err
+	}
+	currentDir := file.WorkingDirectory()
+	if err := os.Chdir(clusterBootstrapPath); err != nil {
+		return err
+	}
+	defer func() { _ = os.Chdir(currentDir) }()
+
+	script := "sh -c " + kubestrap.ShellQuote(kubestrap.TrustedUserCAScript(caPubKey))
+	failed := 0
+	for _, h := range hosts {
+		if err := installSshCa(knownHosts, h, script); err != nil {
+			log.Errorf("[%s] %v", hostLabel(h), err)
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("installing the SSH CA failed on %d of %d hosts", failed, len(hosts))
+	}
+
+	return nil
+}
+
+// installSshCa connects to the host and runs the script installing the CA as root
+func installSshCa(knownHosts *kubestrap.KnownHosts, h *cluster.Host, script string) error {
+	if err := knownHosts.Connect(h); err != nil {
+		return fmt.Errorf("failed to connect: %v", err)
+	}
+	defer h.Disconnect()
+
+	stdout, stderr := &bytes.Buffer{}, &bytes.Buffer{}
+	if _, err := kubestrap.RemoteExec(h, script, nil, stdout, stderr, 0, exec.Sudo(h)); err != nil {
+		return fmt.Errorf("failed to install the SSH CA: %v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	if strings.TrimSpace(stdout.String()) == "exists" {
+		log.Infof("[%s] SSH CA is already trusted", hostLabel(h))
+		return nil
+	}
+	log.Infof("[%s] SSH CA installed", hostLabel(h))
+	return nil
+}
+
+func (s *SecretsSshCaInstall) Cmd() *cobra.Command {
+	return s.cmd
+}
+
+func (s *SecretsSshCaInstall) CheckRequiredFlags() error {
+	return s.parent.CheckRequiredFlags()
+}
@@ -0,0 +1,48 @@
+/*
+Copyright © 2023 Dataflows
+*/
+package cmd
+
+import (
+	"github.com/spf13/cobra"
+)
+
+type SecretsSshCert struct {
+	cmd    *cobra.Command
+	parent *Secrets
+}
+
+var (
+	secretsSshCert = NewSecretsSshCert(secrets)
+)
+
+func init() {
+
+}
+
+func NewSecretsSshCert(parent *Secrets) *SecretsSshCert {
+	sc := &SecretsSshCert{
+		parent: parent,
+	}
+
+	sc.cmd = &cobra.Command{
+		Use:   "ssh-cert",
+		Short: "Manages SSH user certificates issued by the SSH CA",
+		Long: `A certificate is written next to the key it is issued for, with the '-cert.pub' suffix, where ssh and kubestrap find it.
+Kubestrap connections to cluster hosts authenticate with it while it is valid.`,
+		SilenceErrors: parent.Cmd().SilenceErrors,
+		SilenceUsage:  parent.Cmd().SilenceUsage,
+	}
+
+	parent.Cmd().AddCommand(sc.cmd)
+
+	return sc
+}
+
+func (s *SecretsSshCert) Cmd() *cobra.Command {
+	return s.cmd
+}
+
+func (s *SecretsSshCert) CheckRequiredFlags() error {
+	return s.parent.CheckRequiredFlags()
+}
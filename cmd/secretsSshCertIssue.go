@@ -0,0 +1,311 @@
+/*
+Copyright © 2023 Dataflows
+*/
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/thedataflows/go-commons/pkg/config"
+	"github.com/thedataflows/go-commons/pkg/defaults"
+	"github.com/thedataflows/go-commons/pkg/lang"
+	"github.com/thedataflows/go-commons/pkg/log"
+	"github.com/thedataflows/kubestrap/pkg/constants"
+	"github.com/thedataflows/kubestrap/pkg/kubestrap"
+	"golang.org/x/crypto/ssh"
+)
+
+type SecretsSshCertIssue struct {
+	cmd    *cobra.Command
+	parent *SecretsSshCert
+}
+
+var (
+	_ = NewSecretsSshCertIssue(secretsSshCert)
+)
+
+func init() {
+
+}
+
+// clockSkew is subtracted from the start of the certificate validity, for hosts with clocks behind
+const clockSkew = 5 * time.Minute
+
+func NewSecretsSshCertIssue(parent *SecretsSshCert) *SecretsSshCertIssue {
+	si := &SecretsSshCertIssue{
+		parent: parent,
+	}
+
+	si.cmd = &cobra.Command{
+		Use:   "issue",
+		Short: "Signs a short lived SSH user certificate for a public key with the SSH CA",
+		Long: `The certificate is valid for the principals, the users it can log in as, from --valid-from for --validity.
+When --valid-from is not set, the certificate is valid from now, with 5 minutes of tolerance for clock differences.`,
+		Example: parent.parent.parent.cmd.Use + " " + parent.parent.cmd.Use + " --context mycontext " + parent.cmd.Use + " issue --validity 2h\n" +
+			parent.parent.parent.cmd.Use + " " + parent.parent.cmd.Use + " --context mycontext " + parent.cmd.Use + " issue -k ~/.ssh/id_ed25519.pub -n admin,ubuntu --key-id alice",
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			_, _, err := si.ValidityWindow()
+			return err
+		},
+		RunE:          si.RunSecretsSshCertIssueCommand,
+		SilenceErrors: parent.Cmd().SilenceErrors,
+		SilenceUsage:  parent.Cmd().SilenceUsage,
+	}
+
+	parent.Cmd().AddCommand(si.cmd)
+
+	si.cmd.Flags().StringP(
+		si.KeyPublicKeyFile(),
+		"k",
+		si.DefaultPublicKeyFile(),
+		"Public key file to issue the certificate for",
+	)
+
+	si.cmd.Flags().StringSliceP(
+		si.KeyPrincipals(),
+		"n",
+		[]string{},
+		"Users the certificate can log in as. Defaults to the SSH users of the cluster hosts and bastions",
+	)
+
+	si.cmd.Flags().Duration(
+		si.KeyValidity(),
+		8*time.Hour,
+		"Duration the certificate is valid for",
+	)
+
+	si.cmd.Flags().String(
+		si.KeyValidFrom(),
+		"",
+		"Time the certificate is valid from, in RFC3339 format. Defaults to now",
+	)
+
+	si.cmd.Flags().String(
+		si.KeyKeyId(),
+		"",
+		"Key identifier, logged by sshd on login. Defaults to the local user and context",
+	)
+
+	si.cmd.Flags().StringP(
+		si.KeyOutput(),
+		"o",
+		"",
+		"Certificate file. Defaults to the public key file with the '-cert.pub' suffix",
+	)
+
+	si.cmd.Flags().String(
+		si.KeyPrivateKeyPath(),
+		si.DefaultPrivateKeyPath(),
+		"Age private key path, to decrypt the SSH CA private key",
+	)
+
+	// Bind flags to config
+	config.ViperBindPFlagSet(si.cmd, nil)
+
+	return si
+}
+
+func (s *SecretsSshCertIssue) RunSecretsSshCertIssueCommand(cmd *cobra.Command, args []string) error {
+	if err := s.CheckRequiredFlags(); err != nil {
+		return err
+	}
+
+	secrets := s.parent.parent
+	publicKeyFile := s.PublicKeyFile()
+	data, err := os.ReadFile(publicKeyFile)
+	if err != nil {
+		return err
+	}
+	pubKey, _, _, _, err := ssh.ParseAuthorizedKey(data)
+	if err != nil {
+		return fmt.Errorf("error parsing public key '%s': %v", publicKeyFile, err)
+	}
+	if _, ok := pubKey.(*ssh.Certificate); ok {
+		return fmt.Errorf("'%s' is a certificate, not a public key", publicKeyFile)
+	}
+
+	principals := s.Principals()
+	if len(principals) == 0 {
+		cl, err := kubestrap.NewK0sCluster(secrets.SecretsContext(), secrets.ClusterBootstrapPath())
+		if err != nil {
+			return fmt.Errorf("%v. Specify the principals instead", err)
+		}
+		for _, h := range cl.GetClusterSpec().Spec.Hosts {
+			for settings := h.SSH; settings != nil; settings = settings.Bastion {
+				user := lang.If(settings.User != "", settings.User, "root")
+				if !slices.Contains(principals, user) {
+					principals = append(principals, user)
+				}
+			}
+		}
+		if len(principals) == 0 {
+			return fmt.Errorf("no cluster hosts use SSH. Specify the principals instead")
+		}
+	}
+
+	validFrom, validBefore, err := s.ValidityWindow()
+	if err != nil {
+		return err
+	}
+
+	ca, err := loadSshCa(secrets.SshCa(), s.PrivateKeyPath())
+	if err != nil {
+		return err
+	}
+	cert, err := kubestrap.IssueUserCertificate(ca, pubKey, s.KeyId(), principals, validFrom, validBefore)
+	if err != nil {
+		return err
+	}
+
+	output := s.Output()
+	if output == "" {
+		output = kubestrap.CertificatePath(publicKeyFile)
+	}
+	certBytes := append(
+		[]byte(strings.TrimSpace(string(ssh.MarshalAuthorizedKey(cert)))),
+		[]byte(" "+cert.KeyId+"\n")...,
+	)
+	if err := os.WriteFile(output, certBytes, 0644); err != nil {
+		return fmt.Errorf("error writing certificate: %s", err)
+	}
+	log.Infof("wrote: %s", output)
+	log.Infof(
+		"certificate '%s' serial %d for %v valid from %s to %s",
+		cert.KeyId,
+		cert.Serial,
+		principals,
+		validFrom.Format(time.RFC3339),
+		validBefore.Format(time.RFC3339),
+	)
+
+	return nil
+}
+
+func (s *SecretsSshCertIssue) Cmd() *cobra.Command {
+	return s.cmd
+}
+
+func (s *SecretsSshCertIssue) CheckRequiredFlags() error {
+	return s.parent.CheckRequiredFlags()
+}
+
+// Flags keys, defaults and value getters
+func (s *SecretsSshCertIssue) KeyPublicKeyFile() string {
+	return "public-key-file"
+}
+
+func (s *SecretsSshCertIssue) DefaultPublicKeyFile() string {
+	return fmt.Sprintf("bootstrap/cluster-%s/%s.pub", defaults.Undefined, constants.DefaultClusterSshKeyFileName)
+}
+
+func (s *SecretsSshCertIssue) PublicKeyFile() string {
+	publicKeyFile := config.ViperGetString(s.cmd, s.KeyPublicKeyFile())
+	if publicKeyFile == s.DefaultPublicKeyFile() {
+		publicKeyFile = s.parent.parent.ClusterBootstrapPath() + "/" + constants.DefaultClusterSshKeyFileName + ".pub"
+	}
+	return publicKeyFile
+}
+
+func (s *SecretsSshCertIssue) KeyPrincipals() string {
+	return "principals"
+}
+
+func (s *SecretsSshCertIssue) Principals() []string {
+	return config.ViperGetStringSlice(s.cmd, s.KeyPrincipals())
+}
+
+func (s *SecretsSshCertIssue) KeyValidity() string {
+	return "validity"
+}
+
+func (s *SecretsSshCertIssue) Validity() time.Duration {
+	return config.ViperGetDuration(s.cmd, s.KeyValidity())
+}
+
+func (s *SecretsSshCertIssue) KeyValidFrom() string {
+	return "valid-from"
+}
+
+func (s *SecretsSshCertIssue) ValidFromRaw() string {
+	return config.ViperGetString(s.cmd, s.KeyValidFrom())
+}
+
+func (s *SecretsSshCertIssue) ValidFrom() (time.Time, error) {
+	if s.ValidFromRaw() == "" {
+		return time.Now(), nil
+	}
+	return time.Parse(time.RFC3339, s.ValidFromRaw())
+}
+
+// ValidityWindow returns the validated start and end of the certificate validity.
+// Without --valid-from, it starts now, widened by clockSkew on both ends
+func (s *SecretsSshCertIssue) ValidityWindow() (time.Time, time.Time, error) {
+	if s.Validity() <= 0 {
+		return time.Time{}, time.Time{}, fmt.Errorf("invalid validity: %s. Must be positive", s.Validity())
+	}
+	validFrom, err := s.ValidFrom()
+	if err != nil {
+		return time.Time{}, time.Time{}, fmt.Errorf("invalid valid-from: %s. Valid: RFC3339 time, e.g. %s", s.ValidFromRaw(), time.Now().Format(time.RFC3339))
+	}
+	if s.ValidFromRaw() == "" {
+		validFrom = validFrom.Add(-clockSkew)
+	}
+	validBefore := validFrom.Add(s.Validity())
+	if s.ValidFromRaw() == "" {
+		validBefore = validBefore.Add(clockSkew)
+	}
+	// certificates hold unsigned unix times
+	if validFrom.Before(time.Unix(0, 0)) {
+		return time.Time{}, time.Time{}, fmt.Errorf("invalid valid-from: %s. Must not be before %s", validFrom.Format(time.RFC3339), time.Unix(0, 0).UTC().Format(time.RFC3339))
+	}
+	if !validBefore.After(validFrom) {
+		return time.Time{}, time.Time{}, fmt.Errorf("invalid valid-from: %s. Must be before the end of the validity, %s", validFrom.Format(time.RFC3339), validBefore.Format(time.RFC3339))
+	}
+	return validFrom, validBefore, nil
+}
+
+func (s *SecretsSshCertIssue) KeyKeyId() string {
+	return "key-id"
+}
+
+func (s *SecretsSshCertIssue) KeyId() string {
+	keyId := config.ViperGetString(s.cmd, s.KeyKeyId())
+	if keyId == "" {
+		name := "kubestrap"
+		if u, err := user.Current(); err == nil {
+			name = u.Username
+		}
+		keyId = name + "@" + s.parent.parent.SecretsContext()
+	}
+	return keyId
+}
+
+func (s *SecretsSshCertIssue) KeyOutput() string {
+	return "output"
+}
+
+func (s *SecretsSshCertIssue) Output() string {
+	return config.ViperGetString(s.cmd, s.KeyOutput())
+}
+
+func (s *SecretsSshCertIssue) KeyPrivateKeyPath() string {
+	return "private-key"
+}
+
+func (s *SecretsSshCertIssue) DefaultPrivateKeyPath() string {
+	return "secrets/" + defaults.Undefined + ".age"
+}
+
+func (s *SecretsSshCertIssue) PrivateKeyPath() string {
+	privateKeyPath := config.ViperGetString(s.cmd, s.KeyPrivateKeyPath())
+	if privateKeyPath == s.DefaultPrivateKeyPath() {
+		privateKeyPath = s.parent.parent.SecretsDir() + "/" + s.parent.parent.SecretsContext() + ".age"
+	}
+	return privateKeyPath
+}
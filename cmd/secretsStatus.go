@@ -0,0 +1,344 @@
+/*
+Copyright © 2023 Dataflows
+*/
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+	"github.com/thedataflows/go-commons/pkg/config"
+	"github.com/thedataflows/go-commons/pkg/defaults"
+	"github.com/thedataflows/go-commons/pkg/log"
+	"github.com/thedataflows/kubestrap/pkg/constants"
+	"github.com/thedataflows/kubestrap/pkg/kubestrap"
+)
+
+const (
+	statusOutputTable = "table"
+	statusOutputJson  = "json"
+)
+
+var (
+	statusOutputs = []string{statusOutputTable, statusOutputJson}
+)
+
+type SecretsStatus struct {
+	cmd    *cobra.Command
+	parent *Secrets
+}
+
+// secretStatus is the status of a secret file
+type secretStatus struct {
+	File         string   `json:"file"`
+	Encrypted    bool     `json:"encrypted"`
+	Recipients   []string `json:"recipients"`
+	Expected     []string `json:"expected"`
+	Missing      []string `json:"missing"`
+	Unexpected   []string `json:"unexpected"`
+	LastModified string   `json:"lastModified,omitempty"`
+	Decrypt      string   `json:"decrypt"`
+	Problems     []string `json:"problems"`
+}
+
+var (
+	_ = NewSecretsStatus(secrets)
+)
+
+func init() {
+
+}
+
+func NewSecretsStatus(parent *Secrets) *SecretsStatus {
+	ss := &SecretsStatus{
+		parent: parent,
+	}
+
+	ss.cmd = &cobra.Command{
+		Use:   "status [PATTERN]...",
+		Short: "Reports, for every secret file, whether it is encrypted to the recipients of the sops config and decrypts",
+		Long: `Secret files are the files in the Kubernetes cluster directory matching any of the patterns, by default '` + constants.DefaultSecretFilesPattern + `'.
+A file has problems when it is not encrypted with sops, its age recipients differ from the ones of the matching sops config creation rule,
+or it does not decrypt, including a failed MAC check. The command fails when any file has problems, so it can gate CI pipelines.
+Decrypting needs the age private key, its passphrase, or SOPS_AGE_KEY set. Use --skip-decrypt to only check the sops metadata.`,
+		Example: parent.parent.cmd.Use + " " + parent.cmd.Use + " --context mycontext status\n" +
+			parent.parent.cmd.Use + " " + parent.cmd.Use + " --context mycontext status --output json --skip-decrypt",
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			output := ss.Output()
+			if !slices.Contains(statusOutputs, output) {
+				return fmt.Errorf("invalid output: %s. Valid: %v", output, statusOutputs)
+			}
+			return nil
+		},
+		Aliases:       []string{"st"},
+		RunE:          ss.RunSecretsStatusCommand,
+		SilenceErrors: parent.Cmd().SilenceErrors,
+		SilenceUsage:  parent.Cmd().SilenceUsage,
+	}
+
+	parent.Cmd().AddCommand(ss.cmd)
+
+	ss.cmd.Flags().StringP(
+		ss.KeyOutput(),
+		"o",
+		statusOutputTable,
+		fmt.Sprintf("Output format. One of %v", statusOutputs),
+	)
+
+	ss.cmd.Flags().String(
+		ss.KeyPrivateKeyPath(),
+		ss.DefaultPrivateKeyPath(),
+		"Private key path",
+	)
+
+	ss.cmd.Flags().String(
+		ss.KeySshPrivateKeyPath(),
+		"",
+		"SSH private key path, decrypting instead of the age private key",
+	)
+
+	ss.cmd.Flags().Bool(
+		ss.KeySkipDecrypt(),
+		false,
+		"Do not decrypt the files, only check their sops metadata",
+	)
+
+	// Bind flags to config
+	config.ViperBindPFlagSet(ss.cmd, nil)
+
+	return ss
+}
+
+func (s *SecretsStatus) RunSecretsStatusCommand(cmd *cobra.Command, args []string) error {
+	if err := s.CheckRequiredFlags(); err != nil {
+		return err
+	}
+
+	sopsConfigPath := s.parent.SopsConfig()
+	rules, err := readSopsCreationRules(sopsConfigPath)
+	if err != nil {
+		return err
+	}
+	if !s.SkipDecrypt() {
+		if err := loadSopsIdentity(s.PrivateKeyPath(), s.SshPrivateKeyPath()); err != nil {
+			return fmt.Errorf("%v. Use --%s to only check the sops metadata", err, s.KeySkipDecrypt())
+		}
+	}
+
+	statuses := []*secretStatus{}
+	failed := 0
+	for _, p := range findSecretFiles(s.parent.KubeClusterDir(), args) {
+		status := s.fileStatus(p, sopsConfigPath, rules)
+		if len(status.Problems) > 0 {
+			failed++
+			log.Errorf("%s: %s", status.File, strings.Join(status.Problems, "; "))
+		}
+		statuses = append(statuses, status)
+	}
+
+	switch s.Output() {
+	case statusOutputJson:
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetEscapeHTML(false)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(statuses); err != nil {
+			return err
+		}
+	default:
+		if err := printSecretStatuses(statuses); err != nil {
+			return err
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d secret files have problems", failed, len(statuses))
+	}
+	return nil
+}
+
+// fileStatus inspects the sops metadata of the file and decrypts it, unless skipped
+func (s *SecretsStatus) fileStatus(path, sopsConfigPath string, rules []sopsCreationRule) *secretStatus {
+	status := &secretStatus{
+		File:       path,
+		Recipients: []string{},
+		Expected:   []string{},
+		Missing:    []string{},
+		Unexpected: []string{},
+		Decrypt:    "skipped",
+		Problems:   []string{},
+	}
+	if rel, err := filepath.Rel(s.parent.ProjectRoot(), path); err == nil {
+		status.File = filepath.ToSlash(rel)
+	}
+
+	metadata, err := readSopsMetadata(path)
+	if err != nil {
+		status.Problems = append(status.Problems, err.Error())
+		return status
+	}
+	if metadata == nil {
+		status.Decrypt = "-"
+		status.Problems = append(status.Problems, "not encrypted")
+		return status
+	}
+	status.Encrypted = true
+	status.LastModified = metadata.LastModified
+	for _, a := range metadata.Age {
+		status.Recipients = append(status.Recipients, normalizeRecipient(a.Recipient))
+	}
+
+	rule, err := matchSopsCreationRule(rules, sopsConfigPath, path)
+	switch {
+	case err != nil:
+		status.Problems = append(status.Problems, err.Error())
+	case rule == nil:
+		status.Problems = append(status.Problems, "no matching creation rule in "+sopsConfigPath)
+	default:
+		for _, r := range rule.ageRecipients() {
+			status.Expected = append(status.Expected, normalizeRecipient(r))
+		}
+		for _, r := range status.Expected {
+			if !slices.Contains(status.Recipients, r) {
+				status.Missing = append(status.Missing, r)
+			}
+		}
+		for _, r := range status.Recipients {
+			if !slices.Contains(status.Expected, r) {
+				status.Unexpected = append(status.Unexpected, r)
+			}
+		}
+		if len(status.Missing) > 0 {
+			status.Problems = append(status.Problems, fmt.Sprintf("%d recipients missing", len(status.Missing)))
+		}
+		if len(status.Unexpected) > 0 {
+			status.Problems = append(status.Problems, fmt.Sprintf("%d unexpected recipients", len(status.Unexpected)))
+		}
+	}
+
+	if s.SkipDecrypt() {
+		return status
+	}
+	// sops checks the MAC while decrypting
+	status.Decrypt = "ok"
+	// the output is never shown, as it is plain text
+	if _, err := raw.RunRawCommandCaptureStdout(
+		raw.Cmd(),
+		[]string{
+			"sops",
+			"--decrypt",
+			path,
+		},
+	); err != nil {
+		status.Decrypt = "failed"
+		status.Problems = append(status.Problems, err.Error())
+	}
+	return status
+}
+
+// matchSopsCreationRule returns the first creation rule whose path_regex matches the path relative to the sops config directory, like sops does
+func matchSopsCreationRule(rules []sopsCreationRule, sopsConfigPath, path string) (*sopsCreationRule, error) {
+	configDir, err := filepath.Abs(filepath.Dir(sopsConfigPath))
+	if err != nil {
+		return nil, err
+	}
+	path = strings.TrimPrefix(path, configDir+string(filepath.Separator))
+	for i := range rules {
+		if rules[i].PathRegex == "" {
+			return &rules[i], nil
+		}
+		matched, err := regexp.MatchString(rules[i].PathRegex, path)
+		if err != nil {
+			return nil, fmt.Errorf("invalid path_regex '%s' in %s: %v", rules[i].PathRegex, sopsConfigPath, err)
+		}
+		if matched {
+			return &rules[i], nil
+		}
+	}
+	return nil, nil
+}
+
+// normalizeRecipient strips the comment of SSH public keys, so recipients compare equal
+func normalizeRecipient(r string) string {
+	if normalized, _, err := kubestrap.ParseRecipient(r); err == nil {
+		return normalized
+	}
+	return strings.TrimSpace(r)
+}
+
+func printSecretStatuses(statuses []*secretStatus) error {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "FILE\tENCRYPTED\tRECIPIENTS\tLAST MODIFIED\tDECRYPT\tSTATUS")
+	for _, st := range statuses {
+		problems := "ok"
+		if len(st.Problems) > 0 {
+			// only the first line of errors fits the table
+			first := make([]string, 0, len(st.Problems))
+			for _, p := range st.Problems {
+				first = append(first, strings.SplitN(p, "\n", 2)[0])
+			}
+			problems = strings.Join(first, "; ")
+		}
+		lastModified := st.LastModified
+		if lastModified == "" {
+			lastModified = "-"
+		}
+		fmt.Fprintf(w, "%s\t%v\t%d\t%s\t%s\t%s\n", st.File, st.Encrypted, len(st.Recipients), lastModified, st.Decrypt, problems)
+	}
+	return w.Flush()
+}
+
+func (s *SecretsStatus) Cmd() *cobra.Command {
+	return s.cmd
+}
+
+func (s *SecretsStatus) CheckRequiredFlags() error {
+	return s.parent.CheckRequiredFlags()
+}
+
+// Flags keys, defaults and value getters
+func (s *SecretsStatus) KeyOutput() string {
+	return "output"
+}
+
+func (s *SecretsStatus) Output() string {
+	return config.ViperGetString(s.cmd, s.KeyOutput())
+}
+
+func (s *SecretsStatus) KeyPrivateKeyPath() string {
+	return "private-key"
+}
+
+func (s *SecretsStatus) DefaultPrivateKeyPath() string {
+	return "secrets/" + defaults.Undefined + ".age"
+}
+
+func (s *SecretsStatus) PrivateKeyPath() string {
+	privateKeyPath := config.ViperGetString(s.cmd, s.KeyPrivateKeyPath())
+	if privateKeyPath == s.DefaultPrivateKeyPath() {
+		privateKeyPath = s.parent.AgePrivateKeyPath()
+	}
+	return privateKeyPath
+}
+
+func (s *SecretsStatus) KeySshPrivateKeyPath() string {
+	return "ssh-private-key"
+}
+
+func (s *SecretsStatus) SshPrivateKeyPath() string {
+	return config.ViperGetString(s.cmd, s.KeySshPrivateKeyPath())
+}
+
+func (s *SecretsStatus) KeySkipDecrypt() string {
+	return "skip-decrypt"
+}
+
+func (s *SecretsStatus) SkipDecrypt() bool {
+	return config.ViperGetBool(s.cmd, s.KeySkipDecrypt())
+}
@@ -0,0 +1,157 @@
+/*
+Copyright © 2023 Dataflows
+*/
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/goccy/go-yaml"
+	"github.com/spf13/cobra"
+	"github.com/thedataflows/go-commons/pkg/config"
+	"github.com/thedataflows/go-commons/pkg/defaults"
+	"github.com/thedataflows/go-commons/pkg/file"
+)
+
+type SecretsVault struct {
+	cmd    *cobra.Command
+	parent *Secrets
+}
+
+var (
+	secretsVault = NewSecretsVault(secrets)
+)
+
+func init() {
+
+}
+
+func NewSecretsVault(parent *Secrets) *SecretsVault {
+	sv := &SecretsVault{
+		parent: parent,
+	}
+
+	sv.cmd = &cobra.Command{
+		Use:   "vault",
+		Short: "Manages the vault of generated passphrases",
+		Long: `The vault is a YAML map of entry names to values, encrypted with age to the recipients in the age public key file.
+Passphrases generated by bootstrap, rotate-age-key and rotate-ssh-key are stored there, named after the file they protect, instead of being printed.
+The age key passphrase is only generated when the age public key file lists another recipient, like a recovery key, able to get it back without the age key.
+Bootstrap keeps the recipients already listed there, unless forced.`,
+		Aliases:       []string{"v"},
+		SilenceErrors: parent.Cmd().SilenceErrors,
+		SilenceUsage:  parent.Cmd().SilenceUsage,
+	}
+
+	parent.Cmd().AddCommand(sv.cmd)
+
+	sv.cmd.PersistentFlags().String(
+		sv.KeyPrivateKeyPath(),
+		sv.DefaultPrivateKeyPath(),
+		"Age private key path, decrypting the vault",
+	)
+
+	sv.cmd.PersistentFlags().String(
+		sv.KeyPublicKeyPath(),
+		sv.DefaultPublicKeyPath(),
+		"Age public key path, with the vault recipients. Can have multiple keys separated by new lines",
+	)
+
+	// Bind flags to config
+	config.ViperBindPFlagSet(sv.cmd, sv.cmd.PersistentFlags())
+
+	return sv
+}
+
+// readVault decrypts the vault with the age private key. A missing vault is empty
+func readVault(vaultFile, agePrivateKeyPath string) (map[string]string, error) {
+	entries := map[string]string{}
+	if !file.IsAccessible(vaultFile) {
+		return entries, nil
+	}
+	out, err := ageDecrypt(vaultFile, agePrivateKeyPath)
+	if err != nil {
+		return nil, err
+	}
+	if err := yaml.Unmarshal([]byte(out), &entries); err != nil {
+		return nil, fmt.Errorf("error parsing vault '%s': %v", vaultFile, err)
+	}
+	return entries, nil
+}
+
+// updateVault applies update to the vault entries and encrypts them again to the recipients in agePublicKeyPath.
+// The vault is replaced only once encrypted
+func updateVault(vaultFile, agePrivateKeyPath, agePublicKeyPath string, update func(entries map[string]string)) error {
+	entries, err := readVault(vaultFile, agePrivateKeyPath)
+	if err != nil {
+		return err
+	}
+	update(entries)
+	data, err := yaml.Marshal(entries)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(vaultFile), 0700); err != nil {
+		return err
+	}
+	newVaultFile := vaultFile + ".new"
+	if err := ageEncrypt(data, agePublicKeyPath, newVaultFile); err != nil {
+		_ = os.Remove(newVaultFile)
+		return err
+	}
+	return os.Rename(newVaultFile, vaultFile)
+}
+
+// vaultEntryName returns the name of the vault entry with the passphrase of the file at path, relative to the project root
+func vaultEntryName(path string) string {
+	if absPath, err := filepath.Abs(path); err == nil {
+		path = absPath
+	}
+	if rel, err := filepath.Rel(secrets.ProjectRoot(), path); err == nil {
+		path = rel
+	}
+	return filepath.ToSlash(path)
+}
+
+func (s *SecretsVault) Cmd() *cobra.Command {
+	return s.cmd
+}
+
+func (s *SecretsVault) CheckRequiredFlags() error {
+	return s.parent.CheckRequiredFlags()
+}
+
+// Flags keys, defaults and value getters
+func (s *SecretsVault) KeyPrivateKeyPath() string {
+	return "private-key"
+}
+
+func (s *SecretsVault) DefaultPrivateKeyPath() string {
+	return "secrets/" + defaults.Undefined + ".age"
+}
+
+func (s *SecretsVault) PrivateKeyPath() string {
+	privateKeyPath := config.ViperGetString(s.cmd, s.KeyPrivateKeyPath())
+	if privateKeyPath == s.DefaultPrivateKeyPath() {
+		privateKeyPath = s.parent.AgePrivateKeyPath()
+	}
+	return privateKeyPath
+}
+
+func (s *SecretsVault) KeyPublicKeyPath() string {
+	return "public-key"
+}
+
+func (s *SecretsVault) DefaultPublicKeyPath() string {
+	return s.DefaultPrivateKeyPath() + ".pub"
+}
+
+func (s *SecretsVault) PublicKeyPath() string {
+	publicKeyPath := config.ViperGetString(s.cmd, s.KeyPublicKeyPath())
+	if publicKeyPath == s.DefaultPublicKeyPath() {
+		publicKeyPath = s.parent.AgePrivateKeyPath() + ".pub"
+	}
+	return publicKeyPath
+}
@@ -0,0 +1,71 @@
+/*
+Copyright © 2023 Dataflows
+*/
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+)
+
+type SecretsVaultGet struct {
+	cmd    *cobra.Command
+	parent *SecretsVault
+}
+
+var (
+	_ = NewSecretsVaultGet(secretsVault)
+)
+
+func init() {
+
+}
+
+func NewSecretsVaultGet(parent *SecretsVault) *SecretsVaultGet {
+	sg := &SecretsVaultGet{
+		parent: parent,
+	}
+
+	sg.cmd = &cobra.Command{
+		Use:   "get NAME",
+		Short: "Prints the value of a vault entry",
+		Example: parent.parent.parent.cmd.Use + " " + parent.parent.cmd.Use + " --context mycontext " + parent.cmd.Use + " get bootstrap/cluster-mycontext/cluster.sshkey\n" +
+			parent.parent.parent.cmd.Use + " " + parent.parent.cmd.Use + " --context mycontext --passphrase-command \"" + parent.parent.parent.cmd.Use + " " + parent.parent.cmd.Use + " --context mycontext " + parent.cmd.Use + " get bootstrap/cluster-mycontext/cluster.sshkey\" ssh-add",
+		Args:          cobra.ExactArgs(1),
+		RunE:          sg.RunSecretsVaultGetCommand,
+		SilenceErrors: parent.Cmd().SilenceErrors,
+		SilenceUsage:  parent.Cmd().SilenceUsage,
+	}
+
+	parent.Cmd().AddCommand(sg.cmd)
+
+	return sg
+}
+
+func (s *SecretsVaultGet) RunSecretsVaultGetCommand(cmd *cobra.Command, args []string) error {
+	if err := s.CheckRequiredFlags(); err != nil {
+		return err
+	}
+
+	vaultFile := s.parent.parent.VaultFile()
+	entries, err := readVault(vaultFile, s.parent.PrivateKeyPath())
+	if err != nil {
+		return err
+	}
+	value, ok := entries[args[0]]
+	if !ok {
+		return fmt.Errorf("'%s' is not in vault '%s'", args[0], vaultFile)
+	}
+	fmt.Println(value)
+
+	return nil
+}
+
+func (s *SecretsVaultGet) Cmd() *cobra.Command {
+	return s.cmd
+}
+
+func (s *SecretsVaultGet) CheckRequiredFlags() error {
+	return s.parent.CheckRequiredFlags()
+}
@@ -0,0 +1,73 @@
+/*
+Copyright © 2023 Dataflows
+*/
+package cmd
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/spf13/cobra"
+)
+
+type SecretsVaultList struct {
+	cmd    *cobra.Command
+	parent *SecretsVault
+}
+
+var (
+	_ = NewSecretsVaultList(secretsVault)
+)
+
+func init() {
+
+}
+
+func NewSecretsVaultList(parent *SecretsVault) *SecretsVaultList {
+	sl := &SecretsVaultList{
+		parent: parent,
+	}
+
+	sl.cmd = &cobra.Command{
+		Use:           "list",
+		Short:         "Lists the names of the vault entries, without their values",
+		Example:       parent.parent.parent.cmd.Use + " " + parent.parent.cmd.Use + " --context mycontext " + parent.cmd.Use + " list",
+		Aliases:       []string{"ls"},
+		RunE:          sl.RunSecretsVaultListCommand,
+		SilenceErrors: parent.Cmd().SilenceErrors,
+		SilenceUsage:  parent.Cmd().SilenceUsage,
+	}
+
+	parent.Cmd().AddCommand(sl.cmd)
+
+	return sl
+}
+
+func (s *SecretsVaultList) RunSecretsVaultListCommand(cmd *cobra.Command, args []string) error {
+	if err := s.CheckRequiredFlags(); err != nil {
+		return err
+	}
+
+	entries, err := readVault(s.parent.parent.VaultFile(), s.parent.PrivateKeyPath())
+	if err != nil {
+		return err
+	}
+	names := make([]string, 0, len(entries))
+	for name := range entries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Println(name)
+	}
+
+	return nil
+}
+
+func (s *SecretsVaultList) Cmd() *cobra.Command {
+	return s.cmd
+}
+
+func (s *SecretsVaultList) CheckRequiredFlags() error {
+	return s.parent.CheckRequiredFlags()
+}
@@ -0,0 +1,104 @@
+/*
+Copyright © 2023 Dataflows
+*/
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+	"github.com/thedataflows/go-commons/pkg/config"
+	"github.com/thedataflows/go-commons/pkg/log"
+)
+
+type SecretsVaultSet struct {
+	cmd    *cobra.Command
+	parent *SecretsVault
+}
+
+var (
+	_ = NewSecretsVaultSet(secretsVault)
+)
+
+func init() {
+
+}
+
+func NewSecretsVaultSet(parent *SecretsVault) *SecretsVaultSet {
+	ss := &SecretsVaultSet{
+		parent: parent,
+	}
+
+	ss.cmd = &cobra.Command{
+		Use:   "set NAME",
+		Short: "Sets the value of a vault entry, read from the terminal or the standard input, or generated",
+		Long:  `The value is never taken from the command line, so it does not end up in the shell history.`,
+		Example: parent.parent.parent.cmd.Use + " " + parent.parent.cmd.Use + " --context mycontext " + parent.cmd.Use + " set backup-password\n" +
+			parent.parent.parent.cmd.Use + " " + parent.parent.cmd.Use + " --context mycontext " + parent.cmd.Use + " set backup-password --generate 48",
+		Args:          cobra.ExactArgs(1),
+		RunE:          ss.RunSecretsVaultSetCommand,
+		SilenceErrors: parent.Cmd().SilenceErrors,
+		SilenceUsage:  parent.Cmd().SilenceUsage,
+	}
+
+	parent.Cmd().AddCommand(ss.cmd)
+
+	ss.cmd.Flags().Int(
+		ss.KeyGenerate(),
+		0,
+		"Generate a random value of this length instead of reading it",
+	)
+
+	// Bind flags to config
+	config.ViperBindPFlagSet(ss.cmd, nil)
+
+	return ss
+}
+
+func (s *SecretsVaultSet) RunSecretsVaultSetCommand(cmd *cobra.Command, args []string) error {
+	if err := s.CheckRequiredFlags(); err != nil {
+		return err
+	}
+
+	name := args[0]
+	var value []byte
+	if length := s.Generate(); length > 0 {
+		value = randomBytes(length)
+	} else {
+		var err error
+		value, err = readInPassword(fmt.Sprintf("Enter value for %s: ", name))
+		if err != nil {
+			return err
+		}
+	}
+	if len(value) == 0 {
+		return fmt.Errorf("empty value for '%s'", name)
+	}
+
+	vaultFile := s.parent.parent.VaultFile()
+	if err := updateVault(vaultFile, s.parent.PrivateKeyPath(), s.parent.PublicKeyPath(), func(entries map[string]string) {
+		entries[name] = string(value)
+	}); err != nil {
+		return err
+	}
+	log.Infof("stored '%s' in vault '%s'", name, vaultFile)
+
+	return nil
+}
+
+func (s *SecretsVaultSet) Cmd() *cobra.Command {
+	return s.cmd
+}
+
+func (s *SecretsVaultSet) CheckRequiredFlags() error {
+	return s.parent.CheckRequiredFlags()
+}
+
+// Flags keys, defaults and value getters
+func (s *SecretsVaultSet) KeyGenerate() string {
+	return "generate"
+}
+
+func (s *SecretsVaultSet) Generate() int {
+	return config.ViperGetInt(s.cmd, s.KeyGenerate())
+}
@@ -3,6 +3,7 @@ module github.com/thedataflows/kubestrap
 go 1.23
 
 require (
+	filippo.io/age v1.2.1
 	github.com/cavaliergopher/grab/v3 v3.0.1
 	github.com/dlclark/regexp2 v1.11.4
 	github.com/go-cmd/cmd v1.4.3
@@ -22,6 +23,7 @@ require (
 )
 
 require (
+	filippo.io/edwards25519 v1.1.0 // indirect
 	github.com/Azure/go-ntlmssp v0.0.0-20221128193559-754e69321358 // indirect
 	github.com/ChrisTrenkamp/goxpath v0.0.0-20210404020558-97928f7e12b6 // indirect
 	github.com/Microsoft/go-winio v0.6.2 // indirect
@@ -1,12 +1,13 @@
 package constants
 
 const (
-	EnvPrefix                    = "KS"
-	BUFFERSIZE                   = 1 * 1024 * 1024
-	Windows                      = "windows"
-	Linux                        = "linux"
-	Darwin                       = "darwin"
-	DefaultConfigName            = "kubestrap-defaults"
-	DefaultClusterSshKeyFileName = "cluster.sshkey"
-	DefaultSecretFilesPattern    = `secret.*\.yaml` // #nosec G101
+	EnvPrefix                        = "KS"
+	BUFFERSIZE                       = 1 * 1024 * 1024
+	Windows                          = "windows"
+	Linux                            = "linux"
+	Darwin                           = "darwin"
+	DefaultConfigName                = "kubestrap-defaults"
+	DefaultClusterSshKeyFileName     = "cluster.sshkey"
+	DefaultClusterKnownHostsFileName = "known_hosts"
+	DefaultSecretFilesPattern        = `secret.*\.yaml` // #nosec G101
 )
@@ -66,6 +66,9 @@ Loop:
 //
 // if filesToExtract list is nil and patternToExtract is empty, all files will be extracted
 //
+// besides the archive formats supported by archiver, the payload of deb, rpm and macOS pkg (xar) packages can be extracted.
+// Leading './' is stripped from the names of package files
+//
 // if destination does not exist, a directory will be created
 func ExtractFiles(archivePath, destination string, filesToExtract []string, patternToExtract string, stripPath bool) ([]string, error) {
 	if d, err := os.Stat(destination); err == nil {
@@ -85,57 +88,64 @@ func ExtractFiles(archivePath, destination string, filesToExtract []string, patt
 	}
 	defer f.Close()
 
-	// try to identify archive
-	format, input, err := archiver.Identify(archivePath, f)
-	if err != nil {
-		return nil, err
+	extractedFiles := make([]string, 0, len(filesToExtract))
+	handleFile := func(ctx context.Context, f archiver.File) error {
+		if re.String() != "" {
+			if !re.Match([]byte(f.NameInArchive)) && !slices.Contains(filesToExtract, f.NameInArchive) {
+				return nil
+			}
+		} else if !slices.Contains(filesToExtract, f.NameInArchive) {
+			return nil
+		}
+		if f.IsDir() {
+			if stripPath {
+				return nil
+			}
+			err = os.MkdirAll(filepath.Join(destination, f.NameInArchive), f.Mode())
+			return err
+		}
+		dstFileName := f.NameInArchive
+		if stripPath {
+			dstFileName = filepath.Base(f.NameInArchive)
+		}
+		if err := WriteExtractedFile(f, filepath.Join(destination, dstFileName)); err != nil {
+			return err
+		}
+		extractedFiles = append(extractedFiles, dstFileName)
+		log.Debugf("extracted %s", dstFileName)
+		return nil
 	}
 
-	// try to decompress
-	if decom, ok := format.(archiver.Decompressor); ok {
-		rc, err := decom.OpenReader(input)
+	// distro packages are not supported by archiver
+	if pkgFormat := identifyPackage(f); pkgFormat != "" {
+		log.Debugf("extracting %s package payload from '%s'", pkgFormat, archivePath)
+		if err := extractPackage(context.Background(), pkgFormat, f, handleFile); err != nil {
+			return nil, err
+		}
+	} else {
+		// try to identify archive
+		format, input, err := archiver.Identify(archivePath, f)
 		if err != nil {
 			return nil, err
 		}
-		defer rc.Close()
-		input = rc
-	}
 
-	// try to extract
-	extractedFiles := make([]string, 0, len(filesToExtract))
-	if ex, ok := format.(archiver.Extractor); ok {
-		if err := ex.Extract(
-			context.Background(),
-			input,
-			nil,
-			func(ctx context.Context, f archiver.File) error {
-				if re.String() != "" {
-					if !re.Match([]byte(f.NameInArchive)) && !slices.Contains(filesToExtract, f.NameInArchive) {
-						return nil
-					}
-				} else if !slices.Contains(filesToExtract, f.NameInArchive) {
-					return nil
-				}
-				if f.IsDir() {
-					if stripPath {
-						return nil
-					}
-					err = os.MkdirAll(filepath.Join(destination, f.NameInArchive), f.Mode())
-					return err
-				}
-				dstFileName := f.NameInArchive
-				if stripPath {
-					dstFileName = filepath.Base(f.NameInArchive)
-				}
-				if err := WriteExtractedFile(f, filepath.Join(destination, dstFileName)); err != nil {
-					return err
-				}
-				extractedFiles = append(extractedFiles, dstFileName)
-				log.Debugf("extracted %s", dstFileName)
-				return nil
-			},
-		); err != nil {
-			return nil, err
+		// try to decompress plain compressed files. A compressed archive, like tar.gz, is identified as a CompressedArchive,
+		// which embeds its Compression and so is a Decompressor too, but its Extract already decompresses the input
+		_, isExtractor := format.(archiver.Extractor)
+		if decom, ok := format.(archiver.Decompressor); ok && !isExtractor {
+			rc, err := decom.OpenReader(input)
+			if err != nil {
+				return nil, err
+			}
+			defer rc.Close()
+			input = rc
+		}
+
+		// try to extract
+		if ex, ok := format.(archiver.Extractor); ok {
+			if err := ex.Extract(context.Background(), input, nil, handleFile); err != nil {
+				return nil, err
+			}
 		}
 	}
 
@@ -156,7 +166,7 @@ func WriteExtractedFile(source archiver.File, destination string) error {
 	dstDir := filepath.Dir(destination)
 	_, err = os.Stat(dstDir)
 	if err != nil {
-		if err != os.ErrNotExist {
+		if !os.IsNotExist(err) {
 			return err
 		}
 		err = os.MkdirAll(dstDir, 0700)
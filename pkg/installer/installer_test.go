@@ -0,0 +1,45 @@
+package installer
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mholt/archiver/v4"
+)
+
+func TestExtractFilesCompressedArchives(t *testing.T) {
+	tests := []struct {
+		name string
+		c    archiver.Compressor
+	}{
+		{"tool.tar", nil},
+		{"tool.tar.gz", archiver.Gz{}},
+		{"tool.tar.xz", archiver.Xz{}},
+		{"tool.tar.zst", archiver.Zstd{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			path := filepath.Join(dir, tt.name)
+			if err := os.WriteFile(path, testCompress(t, tt.c, testTar(t)), 0600); err != nil {
+				t.Fatal(err)
+			}
+			out := filepath.Join(dir, "out")
+			extracted, err := ExtractFiles(path, out, []string{"./usr/bin/tool"}, "", true)
+			if err != nil {
+				t.Fatalf("ExtractFiles() error = %v", err)
+			}
+			if len(extracted) != 1 || extracted[0] != "tool" {
+				t.Fatalf("ExtractFiles() = %v, want [tool]", extracted)
+			}
+			content, err := os.ReadFile(filepath.Join(out, "tool"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(content) != testContent {
+				t.Errorf("extracted content = %q, want %q", content, testContent)
+			}
+		})
+	}
+}
@@ -0,0 +1,373 @@
+package installer
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/zlib"
+	"context"
+	"encoding/binary"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mholt/archiver/v4"
+)
+
+const (
+	packageDeb = "deb"
+	packageRpm = "rpm"
+	packageXar = "xar"
+)
+
+var (
+	debMagic = []byte("!<arch>\n")
+	rpmMagic = []byte{0xed, 0xab, 0xee, 0xdb}
+	xarMagic = []byte("xar!")
+)
+
+// identifyPackage returns the package format of f, based on its magic bytes, or empty if not a known package
+func identifyPackage(f io.ReaderAt) string {
+	magic := make([]byte, len(debMagic))
+	n, _ := f.ReadAt(magic, 0)
+	magic = magic[:n]
+	switch {
+	case bytes.HasPrefix(magic, debMagic):
+		return packageDeb
+	case bytes.HasPrefix(magic, rpmMagic):
+		return packageRpm
+	case bytes.HasPrefix(magic, xarMagic):
+		return packageXar
+	}
+	return ""
+}
+
+// extractPackage walks the files in the payload of a deb, rpm or xar (macOS pkg) package
+func extractPackage(ctx context.Context, format string, f *os.File, handleFile archiver.FileHandler) error {
+	switch format {
+	case packageDeb:
+		return extractDeb(ctx, f, handleFile)
+	case packageRpm:
+		return extractRpm(ctx, f, handleFile)
+	case packageXar:
+		return extractXar(ctx, f, handleFile)
+	}
+	return fmt.Errorf("unsupported package format '%s'", format)
+}
+
+// extractDeb walks the files in the data.tar.* member of a deb (ar) package
+func extractDeb(ctx context.Context, r io.Reader, handleFile archiver.FileHandler) error {
+	br := bufio.NewReader(r)
+	if _, err := br.Discard(len(debMagic)); err != nil {
+		return err
+	}
+	header := make([]byte, 60)
+	for {
+		if _, err := io.ReadFull(br, header); err != nil {
+			if err == io.EOF {
+				return fmt.Errorf("no data archive found in deb package")
+			}
+			return err
+		}
+		name := strings.TrimSuffix(strings.TrimSpace(string(header[0:16])), "/")
+		size, err := strconv.ParseInt(strings.TrimSpace(string(header[48:58])), 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid size of ar member '%s': %v", name, err)
+		}
+		if !strings.HasPrefix(name, "data.tar") {
+			// members are aligned to 2 bytes
+			if _, err := br.Discard(int(size + size%2)); err != nil {
+				return err
+			}
+			continue
+		}
+		member := io.LimitReader(br, size)
+		format, input, err := archiver.Identify(name, member)
+		if err != nil {
+			return err
+		}
+		ex, ok := format.(archiver.Extractor)
+		if !ok {
+			return fmt.Errorf("deb member '%s' is not an archive", name)
+		}
+		return ex.Extract(ctx, input, nil, func(ctx context.Context, f archiver.File) error {
+			f.NameInArchive = strings.TrimPrefix(f.NameInArchive, "./")
+			return handleFile(ctx, f)
+		})
+	}
+}
+
+// extractRpm walks the files in the cpio payload of a rpm package
+func extractRpm(ctx context.Context, r io.Reader, handleFile archiver.FileHandler) error {
+	br := bufio.NewReader(r)
+	// lead
+	if _, err := br.Discard(96); err != nil {
+		return err
+	}
+	// signature header is padded to 8 bytes, the main header is not
+	size, err := skipRpmHeader(br)
+	if err != nil {
+		return fmt.Errorf("invalid rpm signature header: %v", err)
+	}
+	if _, err := br.Discard(int((8 - size%8) % 8)); err != nil {
+		return err
+	}
+	if _, err := skipRpmHeader(br); err != nil {
+		return fmt.Errorf("invalid rpm header: %v", err)
+	}
+	payload, err := decompress(br)
+	if err != nil {
+		return err
+	}
+	defer payload.Close()
+	return extractCpio(ctx, payload, handleFile)
+}
+
+// skipRpmHeader discards a rpm header structure and returns its size
+func skipRpmHeader(r *bufio.Reader) (int64, error) {
+	intro := make([]byte, 16)
+	if _, err := io.ReadFull(r, intro); err != nil {
+		return 0, err
+	}
+	if !bytes.Equal(intro[0:3], []byte{0x8e, 0xad, 0xe8}) {
+		return 0, fmt.Errorf("bad magic")
+	}
+	indexCount := int64(binary.BigEndian.Uint32(intro[8:12]))
+	storeSize := int64(binary.BigEndian.Uint32(intro[12:16]))
+	size := indexCount*16 + storeSize
+	if _, err := r.Discard(int(size)); err != nil {
+		return 0, err
+	}
+	return 16 + size, nil
+}
+
+type xarFile struct {
+	Name string `xml:"name"`
+	Type string `xml:"type"`
+	Data struct {
+		Offset   int64 `xml:"offset"`
+		Length   int64 `xml:"length"`
+		Encoding struct {
+			Style string `xml:"style,attr"`
+		} `xml:"encoding"`
+	} `xml:"data"`
+	Files []xarFile `xml:"file"`
+}
+
+// extractXar walks the files in the cpio Payload(s) of a xar archive, as used by macOS pkg installers
+func extractXar(ctx context.Context, f *os.File, handleFile archiver.FileHandler) error {
+	header := make([]byte, 28)
+	if _, err := f.ReadAt(header, 0); err != nil {
+		return err
+	}
+	headerSize := int64(binary.BigEndian.Uint16(header[4:6]))
+	tocSize := int64(binary.BigEndian.Uint64(header[8:16]))
+	toc, err := zlib.NewReader(io.NewSectionReader(f, headerSize, tocSize))
+	if err != nil {
+		return fmt.Errorf("invalid xar table of contents: %v", err)
+	}
+	defer toc.Close()
+	var doc struct {
+		Files []xarFile `xml:"toc>file"`
+	}
+	if err := xml.NewDecoder(toc).Decode(&doc); err != nil {
+		return fmt.Errorf("invalid xar table of contents: %v", err)
+	}
+
+	heap := headerSize + tocSize
+	found := false
+	var walk func(files []xarFile) error
+	walk = func(files []xarFile) error {
+		for _, x := range files {
+			if err := walk(x.Files); err != nil {
+				return err
+			}
+			if x.Name != "Payload" || x.Type != "file" {
+				continue
+			}
+			found = true
+			var data io.Reader = io.NewSectionReader(f, heap+x.Data.Offset, x.Data.Length)
+			switch x.Data.Encoding.Style {
+			case "application/x-gzip":
+				// xar gzip encoding is actually zlib
+				zr, err := zlib.NewReader(data)
+				if err != nil {
+					return err
+				}
+				defer zr.Close()
+				data = zr
+			case "application/x-bzip2":
+				data = bzip2.NewReader(data)
+			}
+			payload, err := decompress(data)
+			if err != nil {
+				return err
+			}
+			defer payload.Close()
+			if err := extractCpio(ctx, payload, handleFile); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := walk(doc.Files); err != nil {
+		return err
+	}
+	if !found {
+		return fmt.Errorf("no Payload found in xar archive")
+	}
+	return nil
+}
+
+// decompress returns a decompressing reader if r is compressed, otherwise r as is
+func decompress(r io.Reader) (io.ReadCloser, error) {
+	format, input, err := archiver.Identify("", r)
+	if err == archiver.ErrNoMatch {
+		return io.NopCloser(input), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	decom, ok := format.(archiver.Decompressor)
+	if !ok {
+		return io.NopCloser(input), nil
+	}
+	return decom.OpenReader(input)
+}
+
+// cpioFileInfo implements fs.FileInfo for cpio entries
+type cpioFileInfo struct {
+	name    string
+	size    int64
+	mode    fs.FileMode
+	modTime time.Time
+}
+
+func (fi cpioFileInfo) Name() string       { return fi.name }
+func (fi cpioFileInfo) Size() int64        { return fi.size }
+func (fi cpioFileInfo) Mode() fs.FileMode  { return fi.mode }
+func (fi cpioFileInfo) ModTime() time.Time { return fi.modTime }
+func (fi cpioFileInfo) IsDir() bool        { return fi.mode.IsDir() }
+func (fi cpioFileInfo) Sys() any           { return nil }
+
+// extractCpio walks the regular files and directories in a cpio archive, in newc, crc or odc format
+func extractCpio(ctx context.Context, r io.Reader, handleFile archiver.FileHandler) error {
+	br := bufio.NewReader(r)
+	var offset int64
+	discard := func(n int64) error {
+		_, err := br.Discard(int(n))
+		offset += n
+		return err
+	}
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		magic, err := br.Peek(6)
+		if err != nil {
+			return fmt.Errorf("invalid cpio header: %v", err)
+		}
+		var (
+			headerSize, align     int64
+			fields                []int64
+			nameSize, size, mtime int64
+			mode                  uint32
+		)
+		switch string(magic) {
+		case "070701", "070702":
+			// newc: 13 hex fields of 8 chars, name and data are aligned to 4 bytes
+			headerSize, align = 110, 4
+			header := make([]byte, headerSize)
+			if _, err := io.ReadFull(br, header); err != nil {
+				return err
+			}
+			for i := 6; i < int(headerSize); i += 8 {
+				v, err := strconv.ParseInt(string(header[i:i+8]), 16, 64)
+				if err != nil {
+					return fmt.Errorf("invalid cpio header: %v", err)
+				}
+				fields = append(fields, v)
+			}
+			mode, mtime, size, nameSize = uint32(fields[1]), fields[5], fields[6], fields[11]
+		case "070707":
+			// odc: octal fields, no alignment
+			headerSize, align = 76, 1
+			header := make([]byte, headerSize)
+			if _, err := io.ReadFull(br, header); err != nil {
+				return err
+			}
+			for _, w := range [][2]int{{18, 6}, {48, 11}, {59, 6}, {65, 11}} {
+				v, err := strconv.ParseInt(string(header[w[0]:w[0]+w[1]]), 8, 64)
+				if err != nil {
+					return fmt.Errorf("invalid cpio header: %v", err)
+				}
+				fields = append(fields, v)
+			}
+			mode, mtime, nameSize, size = uint32(fields[0]), fields[1], fields[2], fields[3]
+		default:
+			return fmt.Errorf("unsupported cpio format '%s'", string(magic))
+		}
+		offset += headerSize
+		// names are NUL terminated and limited to PATH_MAX
+		if nameSize < 1 || nameSize > 4096 {
+			return fmt.Errorf("invalid cpio name size %d", nameSize)
+		}
+		if size < 0 {
+			return fmt.Errorf("invalid cpio file size %d", size)
+		}
+
+		name := make([]byte, nameSize)
+		if _, err := io.ReadFull(br, name); err != nil {
+			return err
+		}
+		offset += nameSize
+		if err := discard((align - offset%align) % align); err != nil {
+			return err
+		}
+		nameInArchive := strings.TrimPrefix(strings.TrimRight(string(name), "\x00"), "./")
+		if nameInArchive == "TRAILER!!!" {
+			return nil
+		}
+
+		fileMode := fs.FileMode(mode & 0777)
+		switch mode & 0170000 {
+		case 0040000:
+			fileMode |= fs.ModeDir
+		case 0100000:
+		default:
+			// skip links, devices and other special files
+			fileMode |= fs.ModeIrregular
+		}
+		data := io.LimitReader(br, size)
+		if fileMode&fs.ModeIrregular == 0 && nameInArchive != "." {
+			f := archiver.File{
+				FileInfo: cpioFileInfo{
+					name:    nameInArchive[strings.LastIndex(nameInArchive, "/")+1:],
+					size:    size,
+					mode:    fileMode,
+					modTime: time.Unix(mtime, 0),
+				},
+				NameInArchive: nameInArchive,
+				Open: func() (io.ReadCloser, error) {
+					return io.NopCloser(data), nil
+				},
+			}
+			if err := handleFile(ctx, f); err != nil {
+				return err
+			}
+		}
+		// skip whatever the handler did not read
+		if _, err := io.Copy(io.Discard, data); err != nil {
+			return err
+		}
+		offset += size
+		if err := discard((align - offset%align) % align); err != nil {
+			return err
+		}
+	}
+}
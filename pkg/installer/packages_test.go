@@ -0,0 +1,283 @@
+package installer
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mholt/archiver/v4"
+)
+
+const testContent = "#!/bin/sh\necho tool\n"
+
+// testTar returns a tar archive with usr/bin/tool, named the way dpkg-deb names entries
+func testTar(t *testing.T) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, dir := range []string{"./", "./usr/", "./usr/bin/"} {
+		if err := tw.WriteHeader(&tar.Header{Typeflag: tar.TypeDir, Name: dir, Mode: 0755}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: "./usr/bin/tool", Mode: 0755, Size: int64(len(testContent))}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tw.Write([]byte(testContent)); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// testCompress compresses data with c, or returns it as is if c is nil
+func testCompress(t *testing.T, c archiver.Compressor, data []byte) []byte {
+	t.Helper()
+	if c == nil {
+		return data
+	}
+	var buf bytes.Buffer
+	w, err := c.OpenWriter(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// testAr returns an ar archive with the given members, in order
+func testAr(members ...[2]string) []byte {
+	buf := bytes.NewBuffer(append([]byte{}, debMagic...))
+	for _, m := range members {
+		fmt.Fprintf(buf, "%-16s%-12d%-6d%-6d%-8s%-10d`\n", m[0], 0, 0, 0, "100644", len(m[1]))
+		buf.WriteString(m[1])
+		if len(m[1])%2 == 1 {
+			buf.WriteByte('\n')
+		}
+	}
+	return buf.Bytes()
+}
+
+// testDeb returns a deb package with its data archive compressed by c
+func testDeb(t *testing.T, dataName string, c archiver.Compressor) []byte {
+	t.Helper()
+	control := testCompress(t, archiver.Gz{}, testTar(t))
+	return testAr(
+		[2]string{"debian-binary", "2.0\n"},
+		[2]string{"control.tar.gz", string(control)},
+		[2]string{dataName, string(testCompress(t, c, testTar(t)))},
+	)
+}
+
+// testCpioNewc returns a newc cpio archive with usr/bin/tool
+func testCpioNewc() []byte {
+	var buf bytes.Buffer
+	entry := func(name string, mode int, data string) {
+		fmt.Fprintf(&buf, "070701%08X%08X%08X%08X%08X%08X%08X%08X%08X%08X%08X%08X%08X",
+			1, mode, 0, 0, 1, 0, len(data), 0, 0, 0, 0, len(name)+1, 0)
+		buf.WriteString(name + "\x00")
+		buf.Write(make([]byte, (4-buf.Len()%4)%4))
+		buf.WriteString(data)
+		buf.Write(make([]byte, (4-buf.Len()%4)%4))
+	}
+	entry(".", 0040755, "")
+	entry("./usr/bin", 0040755, "")
+	entry("./usr/bin/tool", 0100755, testContent)
+	entry("./usr/bin/link", 0120777, "tool")
+	entry("TRAILER!!!", 0, "")
+	return buf.Bytes()
+}
+
+// testCpioOdc returns an odc cpio archive with usr/bin/tool, as found in macOS pkg payloads
+func testCpioOdc() []byte {
+	var buf bytes.Buffer
+	entry := func(name string, mode int, data string) {
+		fmt.Fprintf(&buf, "070707%06o%06o%06o%06o%06o%06o%06o%011o%06o%011o",
+			0, 1, mode, 0, 0, 1, 0, 0, len(name)+1, len(data))
+		buf.WriteString(name + "\x00")
+		buf.WriteString(data)
+	}
+	entry(".", 0040755, "")
+	entry("./usr/bin/tool", 0100755, testContent)
+	entry("TRAILER!!!", 0, "")
+	return buf.Bytes()
+}
+
+// testRpmHeader returns a rpm header structure with one index entry
+func testRpmHeader(storeSize int) []byte {
+	header := []byte{0x8e, 0xad, 0xe8, 0x01, 0, 0, 0, 0}
+	header = binary.BigEndian.AppendUint32(header, 1)
+	header = binary.BigEndian.AppendUint32(header, uint32(storeSize))
+	header = append(header, make([]byte, 16+storeSize)...)
+	return header
+}
+
+// testRpm returns a rpm package with the given payload
+func testRpm(payload []byte) []byte {
+	lead := append(append([]byte{}, rpmMagic...), make([]byte, 92)...)
+	// the signature header is 37 bytes, padded to 40
+	signature := append(testRpmHeader(5), 0, 0, 0)
+	return bytes.Join([][]byte{lead, signature, testRpmHeader(3), payload}, nil)
+}
+
+// testXar returns a xar archive with a file of the given name and encoding, nested in a directory
+func testXar(t *testing.T, name, encoding string, payload []byte) []byte {
+	t.Helper()
+	toc := fmt.Sprintf(`<?xml version="1.0" encoding="UTF-8"?>
+<xar><toc><file id="1"><name>tool.pkg</name><type>directory</type>
+<file id="2"><name>Bom</name><type>file</type><data><offset>0</offset><length>3</length></data></file>
+<file id="3"><name>%s</name><type>file</type><data><offset>3</offset><length>%d</length><encoding style="%s"/></data></file>
+</file></toc></xar>`, name, len(payload), encoding)
+	var tocBuf bytes.Buffer
+	zw := zlib.NewWriter(&tocBuf)
+	if _, err := zw.Write([]byte(toc)); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	header := append([]byte{}, xarMagic...)
+	header = binary.BigEndian.AppendUint16(header, 28)
+	header = binary.BigEndian.AppendUint16(header, 1)
+	header = binary.BigEndian.AppendUint64(header, uint64(tocBuf.Len()))
+	header = binary.BigEndian.AppendUint64(header, uint64(len(toc)))
+	header = binary.BigEndian.AppendUint32(header, 0)
+	return bytes.Join([][]byte{header, tocBuf.Bytes(), []byte("bom"), payload}, nil)
+}
+
+// testZlib returns data compressed with zlib, which is what xar calls gzip
+func testZlib(t *testing.T, data []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zlib.NewWriter(&buf)
+	if _, err := zw.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// testPackages returns valid packages of every supported format and compression, by name
+func testPackages(t *testing.T) map[string][]byte {
+	t.Helper()
+	return map[string][]byte{
+		"deb xz":           testDeb(t, "data.tar.xz", archiver.Xz{}),
+		"deb gzip":         testDeb(t, "data.tar.gz", archiver.Gz{}),
+		"deb zstd":         testDeb(t, "data.tar.zst", archiver.Zstd{}),
+		"deb none":         testDeb(t, "data.tar", nil),
+		"rpm gzip":         testRpm(testCompress(t, archiver.Gz{}, testCpioNewc())),
+		"rpm xz":           testRpm(testCompress(t, archiver.Xz{}, testCpioNewc())),
+		"rpm zstd":         testRpm(testCompress(t, archiver.Zstd{}, testCpioNewc())),
+		"xar gzip cpio":    testXar(t, "Payload", "application/octet-stream", testCompress(t, archiver.Gz{}, testCpioOdc())),
+		"xar zlib cpio":    testXar(t, "Payload", "application/x-gzip", testZlib(t, testCpioNewc())),
+		"xar uncompressed": testXar(t, "Payload", "application/octet-stream", testCpioOdc()),
+	}
+}
+
+// testExtract writes data to a temporary package and extracts usr/bin/tool from it, failing on panics
+func testExtract(t *testing.T, data []byte) (extracted []string, dir string, err error) {
+	t.Helper()
+	dir = t.TempDir()
+	path := filepath.Join(dir, "package")
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			t.Fatalf("panic: %v", r)
+		}
+	}()
+	dir = filepath.Join(dir, "out")
+	extracted, err = ExtractFiles(path, dir, []string{"usr/bin/tool"}, "", true)
+	return extracted, dir, err
+}
+
+func TestExtractFilesPackages(t *testing.T) {
+	for name, data := range testPackages(t) {
+		t.Run(name, func(t *testing.T) {
+			extracted, dir, err := testExtract(t, data)
+			if err != nil {
+				t.Fatalf("ExtractFiles() error = %v", err)
+			}
+			if len(extracted) != 1 || extracted[0] != "tool" {
+				t.Fatalf("ExtractFiles() = %v, want [tool]", extracted)
+			}
+			content, err := os.ReadFile(filepath.Join(dir, "tool"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(content) != testContent {
+				t.Errorf("extracted content = %q, want %q", content, testContent)
+			}
+		})
+	}
+}
+
+func TestExtractFilesTruncatedPackages(t *testing.T) {
+	for name, data := range testPackages(t) {
+		for _, size := range []int{len(debMagic), 64, len(data) / 2} {
+			t.Run(fmt.Sprintf("%s/%d", name, size), func(t *testing.T) {
+				if _, _, err := testExtract(t, data[:size]); err == nil {
+					t.Errorf("ExtractFiles() of %d of %d bytes did not fail", size, len(data))
+				}
+			})
+		}
+	}
+}
+
+func TestExtractFilesCorruptPackages(t *testing.T) {
+	hugeName := testCpioNewc()
+	copy(hugeName[94:102], "FFFFFFFF")
+	negativeName := testCpioNewc()
+	copy(negativeName[94:102], "-0000001")
+	negativeSize := testCpioNewc()
+	copy(negativeSize[54:62], "-0000001")
+	hugeHeader := testRpm(testCpioNewc())
+	copy(hugeHeader[96+8:96+16], []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff})
+	badTar := testTar(t)
+	copy(badTar[148:156], "garbage!")
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"deb bad member size", bytes.Replace(testDeb(t, "data.tar.gz", archiver.Gz{}), []byte("4         `"), []byte("4x        `"), 1)},
+		{"deb no data member", testAr([2]string{"debian-binary", "2.0\n"})},
+		{"deb data not an archive", testAr([2]string{"debian-binary", "2.0\n"}, [2]string{"data.tar.gz", "not gzip data"})},
+		{"deb bad tar checksum", testAr([2]string{"data.tar", string(badTar)})},
+		{"rpm bad signature magic", bytes.Replace(testRpm(testCpioNewc()), []byte{0x8e, 0xad, 0xe8}, []byte{0, 0, 0}, 1)},
+		{"rpm huge header", hugeHeader},
+		{"rpm bad cpio magic", testRpm(bytes.Replace(testCpioNewc(), []byte("070701"), []byte("123456"), 1))},
+		{"rpm bad cpio field", testRpm(bytes.Replace(testCpioNewc(), []byte("070701"), []byte("070701XYZ"), 1))},
+		{"rpm huge cpio name", testRpm(hugeName)},
+		{"rpm negative cpio name size", testRpm(negativeName)},
+		{"rpm negative cpio size", testRpm(negativeSize)},
+		{"rpm no cpio trailer", testRpm(bytes.Split(testCpioNewc(), []byte("TRAILER"))[0])},
+		{"rpm corrupt gzip", testRpm(append([]byte{0x1f, 0x8b, 0x08}, "corrupt"...))},
+		{"xar bad toc", append(testXar(t, "Payload", "", nil)[:28], "not zlib"...)},
+		{"xar no payload", testXar(t, "Scripts", "application/octet-stream", testCpioOdc())},
+		{"xar payload out of heap", testXar(t, "Payload", "application/x-gzip", nil)},
+		{"xar corrupt zlib payload", testXar(t, "Payload", "application/x-gzip", []byte("not zlib"))},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, _, err := testExtract(t, tt.data); err == nil {
+				t.Errorf("ExtractFiles() did not fail")
+			}
+		})
+	}
+}
@@ -0,0 +1,189 @@
+package kubestrap
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"filippo.io/age"
+	"filippo.io/age/agessh"
+	"filippo.io/age/armor"
+	"golang.org/x/crypto/ssh"
+)
+
+// age X25519 keys are bech32 encoded, the identity in upper case
+const (
+	AgeIdentityPrefix  = "AGE-SECRET-KEY-"
+	AgeRecipientPrefix = "age"
+)
+
+// GenerateAgeIdentity returns a new age X25519 identity in the age-keygen file format, and its recipient
+func GenerateAgeIdentity() (identityFile []byte, recipient string, err error) {
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		return nil, "", err
+	}
+	recipient = identity.Recipient().String()
+	identityFile = []byte(fmt.Sprintf(
+		"# created: %s\n# public key: %s\n%s\n",
+		time.Now().Format(time.RFC3339),
+		recipient,
+		identity,
+	))
+	return identityFile, recipient, nil
+}
+
+// AgeRecipient returns the recipient, or public key, of an age X25519 identity
+func AgeRecipient(identity string) (string, error) {
+	i, err := age.ParseX25519Identity(identity)
+	if err != nil {
+		return "", fmt.Errorf("malformed age identity: %v", err)
+	}
+	return i.Recipient().String(), nil
+}
+
+// ValidateAgeRecipient checks that recipient is an age X25519 recipient
+func ValidateAgeRecipient(recipient string) error {
+	if _, err := age.ParseX25519Recipient(recipient); err != nil {
+		return fmt.Errorf("malformed age recipient '%s': %v", recipient, err)
+	}
+	return nil
+}
+
+// ErrUnsupportedRecipient is returned for valid SSH public keys of types age can not encrypt to
+var ErrUnsupportedRecipient = errors.New("unsupported recipient")
+
+// ParseRecipient parses an age X25519 recipient, or an SSH public key in the authorized_keys format that age encrypts to.
+// Both can be followed by a comment. It returns the recipient without options and comment, and the comment
+func ParseRecipient(recipient string) (normalized, comment string, err error) {
+	if fields := strings.Fields(recipient); len(fields) > 0 && strings.HasPrefix(fields[0], AgeRecipientPrefix+"1") {
+		return fields[0], strings.Join(fields[1:], " "), ValidateAgeRecipient(fields[0])
+	}
+	publicKey, comment, _, _, err := ssh.ParseAuthorizedKey([]byte(recipient))
+	if err != nil {
+		return "", "", fmt.Errorf("malformed recipient '%s': neither an age nor an SSH public key", strings.TrimSpace(recipient))
+	}
+	switch publicKey.Type() {
+	case ssh.KeyAlgoED25519, ssh.KeyAlgoRSA:
+	default:
+		return "", "", fmt.Errorf("%w: SSH key type '%s', age only encrypts to %s and %s keys", ErrUnsupportedRecipient, publicKey.Type(), ssh.KeyAlgoED25519, ssh.KeyAlgoRSA)
+	}
+	return strings.TrimSpace(string(ssh.MarshalAuthorizedKey(publicKey))), comment, nil
+}
+
+// AgeRecipients returns the recipients of all identities in an identity file, ignoring comments and empty lines
+func AgeRecipients(identityFile []byte) ([]string, error) {
+	identities, err := age.ParseIdentities(bytes.NewReader(identityFile))
+	if err != nil {
+		return nil, err
+	}
+	recipients := make([]string, 0, len(identities))
+	for _, identity := range identities {
+		x25519, ok := identity.(*age.X25519Identity)
+		if !ok {
+			return nil, fmt.Errorf("unsupported age identity, only X25519 identities are supported")
+		}
+		recipients = append(recipients, x25519.Recipient().String())
+	}
+	return recipients, nil
+}
+
+// AgeEncryptWithPassphrase encrypts data with a passphrase, armored like 'age --encrypt --armor --passphrase'
+func AgeEncryptWithPassphrase(data, passphrase []byte) ([]byte, error) {
+	recipient, err := age.NewScryptRecipient(string(passphrase))
+	if err != nil {
+		return nil, err
+	}
+	return ageEncrypt(data, recipient)
+}
+
+// AgeDecryptWithPassphrase decrypts data encrypted with a passphrase, armored or not
+func AgeDecryptWithPassphrase(data, passphrase []byte) ([]byte, error) {
+	identity, err := age.NewScryptIdentity(string(passphrase))
+	if err != nil {
+		return nil, err
+	}
+	return ageDecrypt(data, identity)
+}
+
+// AgeEncrypt encrypts data, armored, to the recipients in a recipients file: age X25519 recipients and SSH public keys,
+// ignoring comments and empty lines
+func AgeEncrypt(data, recipientsFile []byte) ([]byte, error) {
+	recipients := []age.Recipient{}
+	scanner := bufio.NewScanner(bytes.NewReader(recipientsFile))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		normalized, _, err := ParseRecipient(line)
+		if err != nil {
+			return nil, err
+		}
+		var recipient age.Recipient
+		if strings.HasPrefix(normalized, AgeRecipientPrefix+"1") {
+			recipient, err = age.ParseX25519Recipient(normalized)
+		} else {
+			recipient, err = agessh.ParseRecipient(normalized)
+		}
+		if err != nil {
+			return nil, err
+		}
+		recipients = append(recipients, recipient)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(recipients) == 0 {
+		return nil, fmt.Errorf("no recipients found")
+	}
+	return ageEncrypt(data, recipients...)
+}
+
+// AgeDecrypt decrypts data, armored or not, with the identities in an age identity file
+func AgeDecrypt(data, identityFile []byte) ([]byte, error) {
+	identities, err := age.ParseIdentities(bytes.NewReader(identityFile))
+	if err != nil {
+		return nil, err
+	}
+	return ageDecrypt(data, identities...)
+}
+
+func ageEncrypt(data []byte, recipients ...age.Recipient) ([]byte, error) {
+	out := &bytes.Buffer{}
+	armored := armor.NewWriter(out)
+	w, err := age.Encrypt(armored, recipients...)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	if err := armored.Close(); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+func ageDecrypt(data []byte, identities ...age.Identity) ([]byte, error) {
+	var src io.Reader = bytes.NewReader(data)
+	if bytes.HasPrefix(bytes.TrimLeft(data, " \t\r\n"), []byte(armor.Header)) {
+		src = armor.NewReader(bytes.NewReader(bytes.TrimLeft(data, " \t\r\n")))
+	}
+	r, err := age.Decrypt(src, identities...)
+	if err != nil {
+		var noMatch *age.NoIdentityMatchError
+		if errors.As(err, &noMatch) {
+			return nil, fmt.Errorf("no identity matched any of the recipients, or the passphrase is incorrect")
+		}
+		return nil, err
+	}
+	return io.ReadAll(r)
+}
@@ -1,13 +1,22 @@
 package kubestrap
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
 	"os"
+	"path"
+	"strings"
 
 	"github.com/goccy/go-yaml"
 	"github.com/k0sproject/k0sctl/pkg/apis/k0sctl.k0sproject.io/v1beta1"
+	"github.com/k0sproject/k0sctl/pkg/apis/k0sctl.k0sproject.io/v1beta1/cluster"
 	"github.com/k0sproject/rig"
+	"github.com/k0sproject/rig/exec"
 	"github.com/thedataflows/go-commons/pkg/file"
 	"github.com/thedataflows/go-commons/pkg/log"
+	"github.com/thedataflows/kubestrap/pkg/constants"
 )
 
 type KubestrapCluster struct {
@@ -60,3 +69,76 @@ type Remote struct {
 	// List of hosts to run the command on
 	Hosts []string `yaml:"hosts"`
 }
+
+// HostPlatform returns the os and arch of a connected host, in GOOS and GOARCH notation
+func HostPlatform(h *cluster.Host) (string, string, error) {
+	if h.IsWindows() {
+		out, err := h.ExecOutput(`powershell -Command "$env:PROCESSOR_ARCHITECTURE"`)
+		if err != nil {
+			return "", "", err
+		}
+		switch strings.ToLower(out) {
+		case "amd64":
+			return constants.Windows, "amd64", nil
+		case "arm64":
+			return constants.Windows, "arm64", nil
+		case "x86":
+			return constants.Windows, "386", nil
+		}
+		return "", "", fmt.Errorf("unsupported architecture '%s'", out)
+	}
+
+	out, err := h.ExecOutput("uname -sm")
+	if err != nil {
+		return "", "", err
+	}
+	fields := strings.Fields(strings.ToLower(out))
+	if len(fields) != 2 {
+		return "", "", fmt.Errorf("unexpected 'uname -sm' output '%s'", out)
+	}
+	goos := fields[0]
+	switch fields[1] {
+	case "x86_64", "amd64":
+		return goos, "amd64", nil
+	case "aarch64", "arm64":
+		return goos, "arm64", nil
+	case "armv7l", "armv6l", "arm":
+		return goos, "arm", nil
+	case "i386", "i686":
+		return goos, "386", nil
+	}
+	return "", "", fmt.Errorf("unsupported architecture '%s'", fields[1])
+}
+
+// UploadFileIfChanged uploads a local file to a connected host, unless the remote file has the same sha256 checksum
+//
+// Returns true if the file was uploaded
+func UploadFileIfChanged(h *cluster.Host, src, dst string, mode os.FileMode) (bool, error) {
+	f, err := os.Open(src)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	shasum := sha256.New()
+	if _, err := io.Copy(shasum, f); err != nil {
+		return false, err
+	}
+	localSum := hex.EncodeToString(shasum.Sum(nil))
+
+	fsys := h.SudoFsys()
+	if remoteSum, err := fsys.Sha256(dst); err == nil && remoteSum == localSum {
+		return false, nil
+	}
+	if err := fsys.MkDirAll(path.Dir(dst), 0755); err != nil {
+		return false, err
+	}
+	if err := h.Upload(src, dst, exec.Sudo(h)); err != nil {
+		return false, err
+	}
+	if !h.IsWindows() {
+		if err := h.Execf(`chmod %o "%s"`, mode, dst, exec.Sudo(h)); err != nil {
+			return true, err
+		}
+	}
+	return true, nil
+}
@@ -0,0 +1,194 @@
+package kubestrap
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/k0sproject/k0sctl/pkg/apis/k0sctl.k0sproject.io/v1beta1/cluster"
+	"github.com/k0sproject/rig/exec"
+	"github.com/k0sproject/rig/pkg/rigfs"
+)
+
+// chmodFsys is implemented by the posix remote filesystem
+type chmodFsys interface {
+	Chmod(name string, mode fs.FileMode) error
+}
+
+// UploadPath copies a local file, or a directory if recursive, to a connected host, preserving file modes.
+// If dst is an existing directory or ends with '/', src is copied into it.
+// The checksum of each file is verified after transfer
+//
+// Returns the number of files copied
+func UploadPath(h *cluster.Host, src, dst string, recursive, sudo bool) (int, error) {
+	opts := []exec.Option{}
+	if sudo {
+		opts = append(opts, exec.Sudo(h))
+	}
+	fsys := rigfs.NewFsys(h, opts...)
+
+	info, err := os.Stat(src)
+	if err != nil {
+		return 0, err
+	}
+	if info.IsDir() && !recursive {
+		return 0, fmt.Errorf("'%s' is a directory. Copy recursively to include it", src)
+	}
+	if d, err := fsys.Stat(dst); (err == nil && d.IsDir()) || strings.HasSuffix(dst, "/") {
+		dst = path.Join(dst, filepath.Base(src))
+	}
+
+	if !info.IsDir() {
+		if err := uploadFile(h, fsys, src, dst, info.Mode().Perm(), opts); err != nil {
+			return 0, err
+		}
+		return 1, nil
+	}
+
+	copied := 0
+	err = filepath.WalkDir(src, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, p)
+		if err != nil {
+			return err
+		}
+		remotePath := path.Join(dst, filepath.ToSlash(rel))
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return fsys.MkDirAll(remotePath, info.Mode().Perm())
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		if err := uploadFile(h, fsys, p, remotePath, info.Mode().Perm(), opts); err != nil {
+			return err
+		}
+		copied++
+		return nil
+	})
+	return copied, err
+}
+
+// uploadFile uploads a single file. Upload verifies the checksum of the remote file
+func uploadFile(h *cluster.Host, fsys rigfs.Fsys, src, dst string, mode fs.FileMode, opts []exec.Option) error {
+	if err := fsys.MkDirAll(path.Dir(dst), 0755); err != nil {
+		return err
+	}
+	if err := h.Upload(src, dst, opts...); err != nil {
+		return err
+	}
+	// existing files keep their mode when overwritten. Windows hosts do not support it
+	if chmodder, ok := fsys.(chmodFsys); ok {
+		return chmodder.Chmod(dst, mode)
+	}
+	return nil
+}
+
+// DownloadPath copies a file, or a directory if recursive, from a connected host to a local path, preserving file modes.
+// If dst is an existing directory or ends with a path separator, src is copied into it.
+// The checksum of each file is verified after transfer
+//
+// Returns the number of files copied
+func DownloadPath(h *cluster.Host, src, dst string, recursive, sudo bool) (int, error) {
+	opts := []exec.Option{}
+	if sudo {
+		opts = append(opts, exec.Sudo(h))
+	}
+	fsys := rigfs.NewFsys(h, opts...)
+
+	info, err := fsys.Stat(src)
+	if err != nil {
+		return 0, err
+	}
+	if info.IsDir() && !recursive {
+		return 0, fmt.Errorf("'%s' is a directory. Copy recursively to include it", src)
+	}
+	if d, err := os.Stat(dst); (err == nil && d.IsDir()) || strings.HasSuffix(dst, string(os.PathSeparator)) {
+		dst = filepath.Join(dst, path.Base(src))
+	}
+
+	if !info.IsDir() {
+		if err := downloadFile(fsys, src, dst, info.Mode().Perm()); err != nil {
+			return 0, err
+		}
+		return 1, nil
+	}
+
+	copied := 0
+	err = fs.WalkDir(fsys, src, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		localPath := filepath.Join(dst, filepath.FromSlash(strings.TrimPrefix(strings.TrimPrefix(p, src), "/")))
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return os.MkdirAll(localPath, info.Mode().Perm())
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		if err := downloadFile(fsys, p, localPath, info.Mode().Perm()); err != nil {
+			return err
+		}
+		copied++
+		return nil
+	})
+	return copied, err
+}
+
+// downloadFile downloads a single file and verifies its checksum
+func downloadFile(fsys rigfs.Fsys, src, dst string, mode fs.FileMode) error {
+	remote, err := fsys.Open(src)
+	if err != nil {
+		return err
+	}
+	defer remote.Close()
+	copier, ok := remote.(rigfs.Copier)
+	if !ok {
+		return fmt.Errorf("'%s' can not be copied", src)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	local, err := os.OpenFile(dst, os.O_RDWR|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	defer local.Close()
+
+	shasum := sha256.New()
+	if _, err := copier.CopyTo(io.MultiWriter(local, shasum)); err != nil {
+		return fmt.Errorf("copy '%s': %v", src, err)
+	}
+	if err := local.Close(); err != nil {
+		return err
+	}
+	// existing files keep their mode when overwritten
+	if err := os.Chmod(dst, mode); err != nil {
+		return err
+	}
+
+	remoteSum, err := fsys.Sha256(src)
+	if err != nil {
+		return fmt.Errorf("validate '%s' checksum: %v", src, err)
+	}
+	if remoteSum != hex.EncodeToString(shasum.Sum(nil)) {
+		return fmt.Errorf("checksum mismatch for '%s'", src)
+	}
+	return nil
+}
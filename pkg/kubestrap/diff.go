@@ -0,0 +1,118 @@
+package kubestrap
+
+import (
+	"fmt"
+	"strings"
+)
+
+// maxDiffCells limits the size of the table used to compute the longest common subsequence of lines
+const maxDiffCells = 16 * 1024 * 1024
+
+type diffOp struct {
+	kind byte
+	line string
+	// line indexes in a and b before this operation
+	a, b int
+}
+
+// UnifiedDiff returns the line based unified diff of a and b with context lines around the changes, or empty if they are equal
+func UnifiedDiff(a, b, fromName, toName string, context int) string {
+	if a == b {
+		return ""
+	}
+	aLines, bLines := splitLines(a), splitLines(b)
+	header := fmt.Sprintf("--- %s\n+++ %s\n", fromName, toName)
+	if (len(aLines)+1)*(len(bLines)+1) > maxDiffCells {
+		return header + "@@ outputs are too large to diff @@\n"
+	}
+
+	ops := diffLines(aLines, bLines)
+	var sb strings.Builder
+	sb.WriteString(header)
+	for i := 0; i < len(ops); {
+		if ops[i].kind == ' ' {
+			i++
+			continue
+		}
+		// hunk spans the changes closer than 2*context lines, with context lines around
+		start := max(i-context, 0)
+		end := i
+		for j := i; j < len(ops); j++ {
+			if ops[j].kind != ' ' {
+				end = j + 1
+			} else if j-end >= 2*context {
+				break
+			}
+		}
+		end = min(end+context, len(ops))
+
+		aCount, bCount := 0, 0
+		for _, op := range ops[start:end] {
+			if op.kind != '+' {
+				aCount++
+			}
+			if op.kind != '-' {
+				bCount++
+			}
+		}
+		fmt.Fprintf(&sb, "@@ -%s +%s @@\n", hunkRange(ops[start].a, aCount), hunkRange(ops[start].b, bCount))
+		for _, op := range ops[start:end] {
+			fmt.Fprintf(&sb, "%c%s\n", op.kind, op.line)
+		}
+		i = end
+	}
+	return sb.String()
+}
+
+func hunkRange(start, count int) string {
+	if count == 0 {
+		return fmt.Sprintf("%d,0", start)
+	}
+	if count == 1 {
+		return fmt.Sprintf("%d", start+1)
+	}
+	return fmt.Sprintf("%d,%d", start+1, count)
+}
+
+func splitLines(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(s, "\n"), "\n")
+}
+
+// diffLines returns the edit script transforming a into b, based on their longest common subsequence
+func diffLines(a, b []string) []diffOp {
+	// lcs[i][j] is the length of the longest common subsequence of a[i:] and b[j:]
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+
+	ops := make([]diffOp, 0, len(a)+len(b))
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			ops = append(ops, diffOp{kind: ' ', line: a[i], a: i, b: j})
+			i++
+			j++
+		case i < len(a) && (j == len(b) || lcs[i+1][j] >= lcs[i][j+1]):
+			ops = append(ops, diffOp{kind: '-', line: a[i], a: i, b: j})
+			i++
+		default:
+			ops = append(ops, diffOp{kind: '+', line: b[j], a: i, b: j})
+			j++
+		}
+	}
+	return ops
+}
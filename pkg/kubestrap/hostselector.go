@@ -0,0 +1,121 @@
+package kubestrap
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/k0sproject/k0sctl/pkg/apis/k0sctl.k0sproject.io/v1beta1/cluster"
+	"golang.org/x/exp/slices"
+)
+
+var HostRoles = []string{"controller", "worker", "controller+worker", "single"}
+
+// HostSelector selects cluster hosts by patterns, named groups of patterns and roles
+//
+// A pattern is matched against the host address, hostname and hostname override. It can be:
+//   - a regular expression enclosed in slashes, e.g. /^node-[0-9]+$/
+//   - a glob, e.g. node-*
+//   - an exact value
+type HostSelector struct {
+	// Host patterns
+	Hosts []string
+	// Names of the groups in GroupDefinitions
+	Groups []string
+	// Host roles
+	Roles []string
+	// Named groups of host patterns
+	GroupDefinitions map[string][]string
+}
+
+// Select returns the hosts matching any of the patterns or groups, and any of the roles.
+// If no patterns and groups are specified, all hosts are matched. If no roles are specified, any role is matched
+func (s *HostSelector) Select(hosts cluster.Hosts) (cluster.Hosts, error) {
+	patterns := append([]string{}, s.Hosts...)
+	for _, g := range s.Groups {
+		groupPatterns, ok := s.GroupDefinitions[g]
+		if !ok {
+			return nil, fmt.Errorf("host group '%s' is not defined", g)
+		}
+		if len(groupPatterns) == 0 {
+			return nil, fmt.Errorf("host group '%s' is empty", g)
+		}
+		patterns = append(patterns, groupPatterns...)
+	}
+	for _, r := range s.Roles {
+		if !slices.Contains(HostRoles, r) {
+			return nil, fmt.Errorf("invalid host role: %s. Valid: %v", r, HostRoles)
+		}
+	}
+
+	matchers := make([]func(string) bool, 0, len(patterns))
+	for _, p := range patterns {
+		m, err := hostMatcher(p)
+		if err != nil {
+			return nil, err
+		}
+		matchers = append(matchers, m)
+	}
+
+	return hosts.Filter(
+		func(h *cluster.Host) bool {
+			if len(s.Roles) > 0 && !slices.Contains(s.Roles, h.Role) {
+				return false
+			}
+			if len(matchers) == 0 {
+				return true
+			}
+			for _, m := range matchers {
+				for _, v := range []string{h.Address(), h.Metadata.Hostname, h.HostnameOverride} {
+					if v != "" && m(v) {
+						return true
+					}
+				}
+			}
+			return false
+		},
+	), nil
+}
+
+func hostMatcher(pattern string) (func(string) bool, error) {
+	switch {
+	case len(pattern) > 1 && strings.HasPrefix(pattern, "/") && strings.HasSuffix(pattern, "/"):
+		re, err := regexp.Compile(pattern[1 : len(pattern)-1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid host pattern '%s': %v", pattern, err)
+		}
+		return re.MatchString, nil
+	case strings.ContainsAny(pattern, "*?["):
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid host pattern '%s': %v", pattern, err)
+		}
+		return func(v string) bool {
+			matched, _ := path.Match(pattern, v)
+			return matched
+		}, nil
+	}
+	return func(v string) bool {
+		return v == pattern
+	}, nil
+}
+
+// SelectHost returns the only host matching pattern. It is an error if none or more hosts match
+func SelectHost(hosts cluster.Hosts, pattern string) (*cluster.Host, error) {
+	selector := &HostSelector{Hosts: []string{pattern}}
+	selected, err := selector.Select(hosts)
+	if err != nil {
+		return nil, err
+	}
+	switch len(selected) {
+	case 0:
+		return nil, fmt.Errorf("host '%s' is not defined in the cluster", pattern)
+	case 1:
+		return selected[0], nil
+	}
+	addresses := make([]string, 0, len(selected))
+	for _, h := range selected {
+		addresses = append(addresses, h.Address())
+	}
+	return nil, fmt.Errorf("'%s' matches %d hosts: %s", pattern, len(selected), strings.Join(addresses, ", "))
+}
@@ -0,0 +1,251 @@
+package kubestrap
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/k0sproject/k0sctl/pkg/apis/k0sctl.k0sproject.io/v1beta1/cluster"
+	"github.com/k0sproject/rig"
+	"github.com/k0sproject/rig/pkg/ssh/hostkey"
+	"github.com/thedataflows/go-commons/pkg/log"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"golang.org/x/exp/slices"
+)
+
+const (
+	// KnownHostsTofu trusts and records the keys of unknown hosts on first use
+	KnownHostsTofu = "tofu"
+	// KnownHostsStrict refuses to connect to unknown hosts
+	KnownHostsStrict = "strict"
+)
+
+var KnownHostsModes = []string{KnownHostsTofu, KnownHostsStrict}
+
+const scanTimeout = 10 * time.Second
+
+// ErrHostKeyChanged is returned when the key of a host does not match the recorded one
+var ErrHostKeyChanged = errors.New("REMOTE HOST IDENTIFICATION HAS CHANGED")
+
+// KnownHosts verifies SSH host keys against a known_hosts file
+type KnownHosts struct {
+	path string
+	mode string
+	mu   sync.Mutex
+}
+
+// NewKnownHosts returns a KnownHosts backed by the file at path, that is created if missing
+func NewKnownHosts(path, mode string) (*KnownHosts, error) {
+	if !slices.Contains(KnownHostsModes, mode) {
+		return nil, fmt.Errorf("invalid known hosts mode: %s. Valid: %v", mode, KnownHostsModes)
+	}
+	// connections are made from the cluster bootstrap path
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := f.Close(); err != nil {
+		return nil, err
+	}
+	return &KnownHosts{
+		path: path,
+		mode: mode,
+	}, nil
+}
+
+// Path returns the path of the known_hosts file
+func (k *KnownHosts) Path() string {
+	return k.path
+}
+
+// Mode returns the verification mode
+func (k *KnownHosts) Mode() string {
+	return k.mode
+}
+
+// HostKeyCallback returns a callback verifying host keys. Unknown keys are recorded in tofu mode and refused in strict mode
+func (k *KnownHosts) HostKeyCallback() ssh.HostKeyCallback {
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		known, err := k.verify(hostname, key)
+		if err != nil || known {
+			return err
+		}
+		if k.mode == KnownHostsStrict {
+			return k.unknownError(hostname)
+		}
+		if err := k.Add(hostname, key); err != nil {
+			return err
+		}
+		log.Warnf("permanently added '%s' (%s) to '%s'", hostname, ssh.FingerprintSHA256(key), k.path)
+		return nil
+	}
+}
+
+// Known returns whether any key is recorded for address, in host:port form
+func (k *KnownHosts) Known(address string) (bool, error) {
+	// a throwaway key matches no entry, so the error tells whether the host is recorded
+	dummy, err := ssh.NewPublicKey(make(ed25519.PublicKey, ed25519.PublicKeySize))
+	if err != nil {
+		return false, err
+	}
+	_, err = k.verify(address, dummy)
+	if errors.Is(err, ErrHostKeyChanged) {
+		return true, nil
+	}
+	return false, err
+}
+
+// Verify checks key against the keys recorded for address, in host:port form.
+// Returns false if no key is recorded and ErrHostKeyChanged if a different key is recorded
+func (k *KnownHosts) Verify(address string, key ssh.PublicKey) (bool, error) {
+	return k.verify(address, key)
+}
+
+func (k *KnownHosts) verify(address string, key ssh.PublicKey) (bool, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	callback, err := knownhosts.New(k.path)
+	if err != nil {
+		return false, fmt.Errorf("invalid known hosts file '%s': %v", k.path, err)
+	}
+	_, port, _ := net.SplitHostPort(address)
+	p, _ := strconv.Atoi(port)
+	err = callback(address, &net.TCPAddr{Port: p}, key)
+	if err == nil {
+		return true, nil
+	}
+	var keyErr *knownhosts.KeyError
+	if errors.As(err, &keyErr) {
+		if len(keyErr.Want) == 0 {
+			return false, nil
+		}
+		recorded := make([]string, 0, len(keyErr.Want))
+		for _, w := range keyErr.Want {
+			recorded = append(recorded, fmt.Sprintf("%s:%d", w.Filename, w.Line))
+		}
+		return false, fmt.Errorf(
+			"%w for '%s'! Someone could be eavesdropping (man-in-the-middle attack), or the host key has just been changed. Offending key: %s %s, recorded in %s. If the change is expected, remove the recorded keys and scan the host again",
+			ErrHostKeyChanged,
+			address,
+			key.Type(),
+			ssh.FingerprintSHA256(key),
+			strings.Join(recorded, ", "),
+		)
+	}
+	return false, err
+}
+
+// Add records key for address, in host:port form
+func (k *KnownHosts) Add(address string, key ssh.PublicKey) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	f, err := os.OpenFile(k.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := fmt.Fprintln(f, knownhosts.Line([]string{knownhosts.Normalize(address)}, key)); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// errHostKeyScanned aborts the handshake once the host key is received
+var errHostKeyScanned = errors.New("host key scanned")
+
+// Scan retrieves the key of the SSH server at address, in host:port form, and records it if unknown.
+// Connects with dial if set, e.g. through a bastion, otherwise directly.
+// Returns the key and whether it was added. It is an error if a different key is recorded
+func (k *KnownHosts) Scan(address string, dial func(network, addr string) (net.Conn, error)) (ssh.PublicKey, bool, error) {
+	if dial == nil {
+		dial = (&net.Dialer{Timeout: scanTimeout}).Dial
+	}
+	conn, err := dial("tcp", address)
+	if err != nil {
+		return nil, false, err
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(scanTimeout))
+
+	var key ssh.PublicKey
+	_, _, _, err = ssh.NewClientConn(conn, address, &ssh.ClientConfig{
+		User: "kubestrap",
+		HostKeyCallback: func(hostname string, remote net.Addr, k ssh.PublicKey) error {
+			key = k
+			return errHostKeyScanned
+		},
+	})
+	if key == nil {
+		return nil, false, fmt.Errorf("failed to retrieve host key: %v", err)
+	}
+
+	known, err := k.verify(address, key)
+	if err != nil || known {
+		return key, false, err
+	}
+	return key, true, k.Add(address, key)
+}
+
+func (k *KnownHosts) unknownError(address string) error {
+	return fmt.Errorf("host key of '%s' is not known and known hosts mode is %s. Scan the host to record its key in '%s'", address, k.mode, k.path)
+}
+
+// UseForRig makes all rig SSH connections verify host keys against the known_hosts file. Rig records unknown keys
+func (k *KnownHosts) UseForRig() {
+	hostkey.KnownHostsPathFromEnv = func() (string, bool) {
+		return k.path, true
+	}
+}
+
+// Connect connects to the host, refusing unknown SSH hosts and bastions in strict mode.
+// Hosts and bastions with a certificate next to their key authenticate with it
+func (k *KnownHosts) Connect(h *cluster.Host) error {
+	if k.mode == KnownHostsStrict {
+		for s := h.SSH; s != nil; s = s.Bastion {
+			address := SSHAddress(s)
+			known, err := k.Known(address)
+			if err != nil {
+				return err
+			}
+			if !known {
+				return k.unknownError(address)
+			}
+		}
+	}
+	UseCertificates(h.SSH)
+	if err := h.Connect(); err != nil {
+		if errors.Is(err, hostkey.ErrHostKeyMismatch) {
+			address := h.Address()
+			if h.SSH != nil && h.SSH.Bastion != nil {
+				address += "' or its bastion '" + h.SSH.Bastion.Address
+			}
+			return fmt.Errorf("%w for '%s'! Someone could be eavesdropping (man-in-the-middle attack), or the host key has just been changed. If the change is expected, remove the recorded keys from '%s' and scan the host again: %v", ErrHostKeyChanged, address, k.path, err)
+		}
+		return err
+	}
+	return nil
+}
+
+// SSHAddress returns the host:port address of the SSH settings
+func SSHAddress(s *rig.SSH) string {
+	port := s.Port
+	if port == 0 {
+		port = 22
+	}
+	return net.JoinHostPort(s.Address, strconv.Itoa(port))
+}
@@ -0,0 +1,130 @@
+package kubestrap
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"sync"
+
+	"github.com/thedataflows/kubestrap/pkg/constants"
+)
+
+// PassphraseSource reads a passphrase without a terminal, from at most one of an environment variable, a file descriptor,
+// a file or the output of a command. Only the first line is used from file descriptors, files and commands,
+// so password managers printing metadata after the password, like 'pass show', work as is
+type PassphraseSource struct {
+	Env     string
+	Fd      int
+	File    string
+	Command string
+	// Stdin is the standard input if already read, used when Fd is 0
+	Stdin []byte
+
+	once       sync.Once
+	passphrase []byte
+	err        error
+}
+
+// IsSet returns whether a source is configured. Fd is ignored when negative
+func (p *PassphraseSource) IsSet() bool {
+	return p != nil && (p.Env != "" || p.Fd >= 0 || p.File != "" || p.Command != "")
+}
+
+// Validate checks that at most one source is configured
+func (p *PassphraseSource) Validate() error {
+	set := 0
+	for _, s := range []bool{p.Env != "", p.Fd >= 0, p.File != "", p.Command != ""} {
+		if s {
+			set++
+		}
+	}
+	if set > 1 {
+		return fmt.Errorf("only one passphrase source can be used, got %d", set)
+	}
+	return nil
+}
+
+// String describes the source, without the passphrase
+func (p *PassphraseSource) String() string {
+	switch {
+	case p.Env != "":
+		return "environment variable " + p.Env
+	case p.Fd >= 0:
+		return fmt.Sprintf("file descriptor %d", p.Fd)
+	case p.File != "":
+		return "file " + p.File
+	case p.Command != "":
+		return "command"
+	}
+	return "terminal"
+}
+
+// Read returns the passphrase. The source is read once, as file descriptors can only be read once
+func (p *PassphraseSource) Read() ([]byte, error) {
+	p.once.Do(func() {
+		p.passphrase, p.err = p.read()
+		if p.err == nil && len(p.passphrase) == 0 {
+			p.err = fmt.Errorf("empty passphrase from %s", p)
+		}
+	})
+	return p.passphrase, p.err
+}
+
+func (p *PassphraseSource) read() ([]byte, error) {
+	switch {
+	case p.Env != "":
+		passphrase, ok := os.LookupEnv(p.Env)
+		if !ok {
+			return nil, fmt.Errorf("environment variable %s is not set", p.Env)
+		}
+		return []byte(passphrase), nil
+	case p.Fd == 0 && len(p.Stdin) > 0:
+		return firstLine(p.Stdin), nil
+	case p.Fd >= 0:
+		f := os.NewFile(uintptr(p.Fd), fmt.Sprintf("fd%d", p.Fd))
+		if f == nil {
+			return nil, fmt.Errorf("invalid file descriptor %d", p.Fd)
+		}
+		if p.Fd > 0 {
+			// the standard input is still used by child processes
+			defer f.Close()
+		}
+		data, err := io.ReadAll(f)
+		if err != nil {
+			return nil, fmt.Errorf("error reading passphrase from file descriptor %d: %v", p.Fd, err)
+		}
+		return firstLine(data), nil
+	case p.File != "":
+		data, err := os.ReadFile(p.File)
+		if err != nil {
+			return nil, fmt.Errorf("error reading passphrase file: %v", err)
+		}
+		return firstLine(data), nil
+	case p.Command != "":
+		shell := []string{"sh", "-c"}
+		if runtime.GOOS == constants.Windows {
+			shell = []string{"cmd", "/C"}
+		}
+		c := exec.Command(shell[0], shell[1], p.Command)
+		c.Stderr = os.Stderr
+		out, err := c.Output()
+		if err != nil {
+			return nil, fmt.Errorf("error running passphrase command: %v", err)
+		}
+		return firstLine(out), nil
+	}
+	return nil, fmt.Errorf("no passphrase source")
+}
+
+func firstLine(data []byte) []byte {
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	if !scanner.Scan() {
+		return nil
+	}
+	return []byte(strings.TrimRight(scanner.Text(), "\r"))
+}
@@ -1,8 +1,11 @@
 package kubestrap
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"io"
+	"net/http"
 	"net/url"
 	"os"
 	"os/exec"
@@ -20,23 +23,32 @@ import (
 	"golang.org/x/exp/slices"
 )
 
+// PlatformUrls are url templates by os. {{release}}, {{os}}, {{arch}} and {{name}} are replaced
+type PlatformUrls struct {
+	Windows string `yaml:"windows"`
+	Linux   string `yaml:"linux"`
+	Darwin  string `yaml:"darwin"`
+}
+
 type RawCommand struct {
-	Name           string   `yaml:"name"`
-	Additional     []string `yaml:"additional"`
-	Command        []string `yaml:"command"`
-	VersionCommand string   `yaml:"version-command"`
-	Release        string   `yaml:"release"`
-	Url            struct {
-		Windows string `yaml:"windows"`
-		Linux   string `yaml:"linux"`
-		Darwin  string `yaml:"darwin"`
-	} `yaml:"url"`
-	Help      string `yaml:"help,omitempty"`
-	CachePath string `yaml:"cache-path,omitempty"`
-	Extract   struct {
+	Name           string       `yaml:"name"`
+	Additional     []string     `yaml:"additional"`
+	Command        []string     `yaml:"command"`
+	VersionCommand string       `yaml:"version-command"`
+	Release        string       `yaml:"release"`
+	Url            PlatformUrls `yaml:"url"`
+	Help           string       `yaml:"help,omitempty"`
+	CachePath      string       `yaml:"cache-path,omitempty"`
+	Extract        struct {
 		Pattern string   `yaml:"pattern"`
 		List    []string `yaml:"list"`
 	} `yaml:"extract,omitempty"`
+	Checksum struct {
+		// Url of a checksum file, either in the sha256sum format listing the release files or holding just the sha256 of the file
+		Url PlatformUrls `yaml:"url"`
+		// Sha256 of the file by '<os>-<arch>', taking precedence over the checksum file
+		Sha256 map[string]string `yaml:"sha256"`
+	} `yaml:"checksum,omitempty"`
 }
 
 // ExecuteCommand attempts to execute an instance of a subcommand
@@ -137,7 +149,6 @@ func (command *RawCommand) getExe() error {
 //
 // Returns list of files
 func (command *RawCommand) EnsureExe() ([]string, error) {
-	// check for error later, if we get to download
 	parsedUrl, errParseUrl := command.GetUrl()
 	if errParseUrl != nil {
 		return nil, errParseUrl
@@ -147,29 +158,31 @@ func (command *RawCommand) EnsureExe() ([]string, error) {
 		return nil, fmt.Errorf("at least one of 'url.%s' or 'cache-path' must be present in the raw command specs", runtime.GOOS)
 	}
 
-	download := false
-
 	exeDir, errExeDir := command.ExeDir()
 	if errExeDir != nil {
 		return nil, errExeDir
 	}
 	// Use cache first
 	cachePath := command.CachePath
-cache:
 	if !filepath.IsAbs(cachePath) {
 		cachePath = filepath.Join(exeDir, cachePath)
 	}
 	cachePathStat, errStat := os.Stat(cachePath)
+	switch {
 	// cache invalid
-	if errStat != nil {
+	case errStat != nil:
 		log.Warnf("%+v", errStat)
 		if parsedUrl.Path == "" {
 			return nil, fmt.Errorf("'cache-path=%s' is invalid and 'url.%s' is empty", cachePath, runtime.GOOS)
 		}
-		download = true
-	}
+		// downloaded as the cache file, kept for the next time
+		source, _, err := command.fetchFile(parsedUrl, runtime.GOOS, runtime.GOARCH, cachePath)
+		if err != nil {
+			return nil, err
+		}
+		return command.installFile(source, false, runtime.GOOS, exeDir)
 	// cache valid and is a directory
-	if cachePathStat != nil && cachePathStat.IsDir() {
+	case cachePathStat.IsDir():
 		commands := append([]string{command.Name}, command.Additional...)
 		for i, c := range commands {
 			if !file.IsAccessible(filepath.Join(cachePath, file.AppendExtension(c))) {
@@ -183,91 +196,223 @@ cache:
 		if parsedUrl.Path == "" {
 			return nil, fmt.Errorf("'cache-path=%s' is a directory but 'url.%s' is empty", cachePath, runtime.GOOS)
 		}
-		newCachePath := filepath.Join(cachePath, filepath.Base(parsedUrl.Path))
-		if file.IsAccessible(newCachePath) {
-			cachePath = newCachePath
-			goto cache
-		}
-		download = true
-	}
-	// cache valid and is a file
-	if cachePathStat != nil && !cachePathStat.IsDir() {
-		// speed up by checking for no extension or .exe on Windows
-		extensions := []string{""}
-		if runtime.GOOS == constants.Windows {
-			extensions = []string{".exe"}
-		}
-		if slices.Contains(extensions, filepath.Ext(cachePath)) {
-			exePath := filepath.Join(exeDir, file.AppendExtension(command.Name))
-			if cachePath == exePath {
-				return []string{exePath}, nil
-			}
-			var err error
-			if command.CachePath != "" || parsedUrl.Scheme == "file" {
-				log.Debugf("copying '%s' to '%s'", cachePath, exePath)
-				err = file.CopyFile(cachePath, exePath, constants.BUFFERSIZE, true)
-			} else {
-				log.Debugf("moving '%s' to '%s'", cachePath, exePath)
-				err = os.Rename(cachePath, exePath)
-			}
-			if err != nil {
+		// left by a previous run
+		previousDownload := filepath.Join(cachePath, filepath.Base(parsedUrl.Path))
+		if file.IsFile(previousDownload) {
+			if err := command.verifyChecksum(previousDownload, runtime.GOOS, runtime.GOARCH, filepath.Base(parsedUrl.Path)); err != nil {
 				return nil, err
 			}
-			return []string{exePath}, nil
+			return command.installFile(previousDownload, command.CachePath == "" && parsedUrl.Scheme != "file", runtime.GOOS, exeDir)
+		}
+		source, downloaded, err := command.fetchFile(parsedUrl, runtime.GOOS, runtime.GOARCH, cachePath)
+		if err != nil {
+			return nil, err
+		}
+		// downloads into a configured cache directory are kept for the next time
+		return command.installFile(source, downloaded && command.CachePath == "", runtime.GOOS, exeDir)
+	// cache valid and is a file, provided by the user
+	default:
+		return command.installFile(cachePath, false, runtime.GOOS, exeDir)
+	}
+}
+
+// Fetch will download and extract (if needed) the executable for the given target os and arch into outputDir.
+// Unlike EnsureExe, the local cache and PATH are not used
+//
+// Returns list of files
+func (command *RawCommand) Fetch(goos, goarch, outputDir string) ([]string, error) {
+	parsedUrl, err := command.GetPlatformUrl(goos, goarch)
+	if err != nil {
+		return nil, err
+	}
+	if parsedUrl.Path == "" {
+		return nil, fmt.Errorf("'url.%s' must be present in the raw command specs", goos)
+	}
+
+	if err := os.MkdirAll(outputDir, 0700); err != nil {
+		return nil, err
+	}
+	source, downloaded, err := command.fetchFile(parsedUrl, goos, goarch, outputDir)
+	if err != nil {
+		return nil, err
+	}
+	return command.installFile(source, downloaded, goos, outputDir)
+}
+
+// fetchFile downloads the release file at parsedUrl to destination, a file or a directory, or resolves it for the file scheme,
+// and verifies its checksum. Returns its path and whether it was downloaded
+func (command *RawCommand) fetchFile(parsedUrl *url.URL, goos, goarch, destination string) (string, bool, error) {
+	var (
+		source     string
+		downloaded bool
+		err        error
+	)
+	switch parsedUrl.Scheme {
+	case "file":
+		source, err = filepath.Abs(parsedUrl.Path)
+		if err != nil {
+			return "", false, err
+		}
+		if _, err := os.Stat(source); err != nil {
+			return "", false, err
+		}
+	case "http", "https":
+		log.Infof("downloading '%s' release '%s' for %s/%s", command.Name, command.Release, goos, goarch)
+		source, err = installer.DownloadFile(destination, parsedUrl.String())
+		if err != nil {
+			return "", false, err
 		}
-		// maybe is an archive?
-		goto extract
+		downloaded = true
+	default:
+		return "", false, fmt.Errorf("scheme '%s' not yet supported in '%s'. Please use 'file', 'http' or 'https'", parsedUrl.Scheme, parsedUrl.String())
+	}
+	if err := command.verifyChecksum(source, goos, goarch, filepath.Base(parsedUrl.Path)); err != nil {
+		if downloaded {
+			_ = os.Remove(source)
+		}
+		return "", false, err
 	}
+	return source, downloaded, nil
+}
 
-	if download {
-		switch parsedUrl.Scheme {
-		case "file":
+// installFile copies a plain executable into outputDir, or extracts the executables of an archive.
+// A temporary source, like a download, is moved or removed once extracted instead
+//
+// Returns list of files
+func (command *RawCommand) installFile(source string, temporary bool, goos, outputDir string) ([]string, error) {
+	exeName := PlatformExeName(command.Name, goos)
+	extensions := []string{""}
+	if goos == constants.Windows {
+		extensions = []string{".exe"}
+	}
+	// plain executable
+	if slices.Contains(extensions, filepath.Ext(source)) {
+		exePath := filepath.Join(outputDir, exeName)
+		if source != exePath {
 			var err error
-			cachePath, err = filepath.Abs(parsedUrl.Path)
-			if err != nil {
-				return nil, err
+			if temporary {
+				log.Debugf("moving '%s' to '%s'", source, exePath)
+				err = os.Rename(source, exePath)
+			} else {
+				log.Debugf("copying '%s' to '%s'", source, exePath)
+				err = file.CopyFile(source, exePath, constants.BUFFERSIZE, true)
 			}
-			_, err = os.Stat(cachePath)
 			if err != nil {
 				return nil, err
 			}
-			goto cache
-		case "http", "https":
-			log.Infof("downloading '%s' release '%s'", command.Name, command.Release)
-			var errDownload error
-			cachePath, errDownload = installer.DownloadFile(cachePath, parsedUrl.String())
-			if errDownload != nil {
-				return nil, errDownload
-			}
-			goto cache
-		default:
-			return nil, fmt.Errorf("scheme '%s' not yet supported in '%s'. Please use 'file', 'http' or 'https'", parsedUrl.Scheme, parsedUrl.String())
 		}
+		return []string{exePath}, os.Chmod(exePath, 0700)
 	}
 
-extract:
+	// archive
 	listToExtract := command.Extract.List
 	if len(command.Extract.List) == 0 {
-		listToExtract = []string{file.AppendExtension(command.Name)}
+		listToExtract = []string{exeName}
 	}
-	extractedFiles, errExtract := installer.ExtractFiles(
-		cachePath,
-		exeDir,
+	extractedFiles, err := installer.ExtractFiles(
+		source,
+		outputDir,
 		listToExtract,
 		command.Extract.Pattern,
 		true)
-	if errExtract != nil {
-		return nil, errExtract
+	if err != nil {
+		return nil, err
 	}
-
-	if download {
-		if err := os.Remove(cachePath); err != nil {
+	if temporary {
+		if err := os.Remove(source); err != nil {
 			return nil, err
 		}
 	}
+	for i, f := range extractedFiles {
+		extractedFiles[i] = filepath.Join(outputDir, f)
+	}
 	return extractedFiles, nil
 }
 
+// verifyChecksum checks the sha256 of the release file at path, named fileName in the checksum file.
+// Without a checksum for the platform, the file is not verified
+func (command *RawCommand) verifyChecksum(path, goos, goarch, fileName string) error {
+	expected := command.Checksum.Sha256[goos+"-"+goarch]
+	if expected == "" {
+		checksumUrl, err := resolveUrl(command.Checksum.Url, command.Name, command.Release, goos, goarch)
+		if err != nil {
+			return err
+		}
+		if checksumUrl.String() == "" {
+			log.Debugf("no checksum for '%s' release '%s' for %s/%s, not verifying '%s'", command.Name, command.Release, goos, goarch, path)
+			return nil
+		}
+		if expected, err = readChecksum(checksumUrl, fileName); err != nil {
+			return fmt.Errorf("error reading checksum of '%s' from '%s': %v", fileName, checksumUrl, err)
+		}
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	shasum := sha256.New()
+	if _, err := io.Copy(shasum, f); err != nil {
+		return err
+	}
+	if actual := hex.EncodeToString(shasum.Sum(nil)); !strings.EqualFold(actual, expected) {
+		return fmt.Errorf("checksum mismatch for '%s': expected sha256 %s, got %s", path, expected, actual)
+	}
+	log.Debugf("verified sha256 of '%s'", path)
+	return nil
+}
+
+// readChecksum returns the sha256 of fileName from a checksum file, local or http(s)
+func readChecksum(checksumUrl *url.URL, fileName string) (string, error) {
+	var (
+		data []byte
+		err  error
+	)
+	switch checksumUrl.Scheme {
+	case "http", "https":
+		log.Debugf("GET '%s'", checksumUrl)
+		resp, err := http.Get(checksumUrl.String()) // #nosec G107
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+			return "", fmt.Errorf("wrong status code %v. Expected 2xx", resp.Status)
+		}
+		data, err = io.ReadAll(resp.Body)
+		if err != nil {
+			return "", err
+		}
+	case "file":
+		data, err = os.ReadFile(checksumUrl.Path)
+	default:
+		data, err = os.ReadFile(checksumUrl.String())
+	}
+	if err != nil {
+		return "", err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		switch {
+		case len(fields) == 1:
+			// a checksum file for a single file
+			return fields[0], nil
+		case len(fields) >= 2 && strings.TrimPrefix(filepath.Base(fields[len(fields)-1]), "*") == fileName:
+			return fields[0], nil
+		}
+	}
+	return "", fmt.Errorf("'%s' not found", fileName)
+}
+
+// PlatformExeName appends exe to name if the target os is windows
+func PlatformExeName(name, goos string) string {
+	if goos == constants.Windows {
+		return name + ".exe"
+	}
+	return name
+}
+
 // ExeDir returns cleaned and created command directory
 func (command *RawCommand) ExeDir() (string, error) {
 	appHome, errHome := file.AppHome("")
@@ -286,24 +431,50 @@ func (command *RawCommand) ExeDir() (string, error) {
 	return dir, nil
 }
 
+// PlatformDir returns cleaned and created directory for fetching the command for the given target os and arch.
+// Unlike ExeDir, it is not added to the PATH
+func (command *RawCommand) PlatformDir(goos, goarch string) (string, error) {
+	appHome, errHome := file.AppHome("")
+	if errHome != nil {
+		return "", errHome
+	}
+	dir := filepath.Clean(fmt.Sprintf("%s/fetch/%s/%s/%s-%s", appHome, command.Name, command.Release, goos, goarch))
+	if !file.IsDirectory(dir) {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return "", err
+		}
+	}
+	return dir, nil
+}
+
 // GetUrl returns platform specific url
 func (command *RawCommand) GetUrl() (*url.URL, error) {
+	return command.GetPlatformUrl(runtime.GOOS, runtime.GOARCH)
+}
+
+// GetPlatformUrl returns the url for the given target os and arch
+func (command *RawCommand) GetPlatformUrl(goos, goarch string) (*url.URL, error) {
+	return resolveUrl(command.Url, command.Name, command.Release, goos, goarch)
+}
+
+// resolveUrl returns the url template for goos with the templates replaced
+func resolveUrl(urls PlatformUrls, name, release, goos, goarch string) (*url.URL, error) {
 	var retUrl string
-	switch runtime.GOOS {
+	switch goos {
 	case constants.Windows:
-		retUrl = command.Url.Windows
+		retUrl = urls.Windows
 	case constants.Linux:
-		retUrl = command.Url.Linux
+		retUrl = urls.Linux
 	case constants.Darwin:
-		retUrl = command.Url.Darwin
+		retUrl = urls.Darwin
 	default:
-		return nil, fmt.Errorf("unsupported platform '%s'", runtime.GOOS)
+		return nil, fmt.Errorf("unsupported platform '%s'", goos)
 	}
 	if retUrl != "" {
-		retUrl = strings.ReplaceAll(retUrl, "{{release}}", command.Release)
-		retUrl = strings.ReplaceAll(retUrl, "{{os}}", runtime.GOOS)
-		retUrl = strings.ReplaceAll(retUrl, "{{arch}}", runtime.GOARCH)
-		retUrl = strings.ReplaceAll(retUrl, "{{name}}", command.Name)
+		retUrl = strings.ReplaceAll(retUrl, "{{release}}", release)
+		retUrl = strings.ReplaceAll(retUrl, "{{os}}", goos)
+		retUrl = strings.ReplaceAll(retUrl, "{{arch}}", goarch)
+		retUrl = strings.ReplaceAll(retUrl, "{{name}}", name)
 	}
 	parsedUrl, errParseUrl := url.Parse(retUrl)
 	if errParseUrl != nil {
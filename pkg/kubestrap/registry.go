@@ -0,0 +1,172 @@
+package kubestrap
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/goccy/go-yaml"
+	"github.com/thedataflows/go-commons/pkg/file"
+	"github.com/thedataflows/go-commons/pkg/log"
+)
+
+// Registry is an index of curated raw command definitions
+type Registry struct {
+	Utilities []RawCommand `yaml:"utilities"`
+}
+
+// LoadRegistry reads a registry index from a local path or a http(s) url.
+// Remote indexes are cached locally and refreshed when older than maxAge
+func LoadRegistry(location string, maxAge time.Duration) (*Registry, error) {
+	var (
+		data []byte
+		err  error
+	)
+	parsedUrl, err := url.Parse(location)
+	if err != nil {
+		return nil, err
+	}
+	switch parsedUrl.Scheme {
+	case "http", "https":
+		data, err = readRemoteRegistry(parsedUrl.String(), maxAge)
+	case "file":
+		data, err = os.ReadFile(parsedUrl.Path)
+	default:
+		data, err = os.ReadFile(location)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading registry '%s': %v", location, err)
+	}
+
+	registry := &Registry{}
+	if err := yaml.Unmarshal(data, registry); err != nil {
+		return nil, fmt.Errorf("error parsing registry '%s': %v", location, err)
+	}
+	return registry, nil
+}
+
+func readRemoteRegistry(location string, maxAge time.Duration) ([]byte, error) {
+	appHome, err := file.AppHome("")
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256([]byte(location))
+	cachePath := filepath.Join(appHome, "registry", hex.EncodeToString(sum[:])+".yaml")
+	if stat, err := os.Stat(cachePath); err == nil && time.Since(stat.ModTime()) < maxAge {
+		log.Debugf("using cached registry '%s' for '%s'", cachePath, location)
+		return os.ReadFile(cachePath)
+	}
+
+	data, err := fetchRegistry(location, cachePath)
+	if err != nil {
+		// a stale copy is better than failing every raw command while offline
+		stat, errStat := os.Stat(cachePath)
+		if errStat != nil {
+			return nil, err
+		}
+		log.Warnf("error refreshing registry '%s': %v. Using the cached copy from %s", location, err, stat.ModTime().Format(time.RFC3339))
+		return os.ReadFile(cachePath)
+	}
+	return data, nil
+}
+
+// fetchRegistry downloads the registry at location and caches it at cachePath
+func fetchRegistry(location, cachePath string) ([]byte, error) {
+	log.Debugf("GET '%s'", location)
+	resp, err := http.Get(location) // #nosec G107
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("wrong status code %v. Expected 2xx", resp.Status)
+	}
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	// an invalid index must not replace a valid cached one
+	if err := yaml.Unmarshal(data, &Registry{}); err != nil {
+		return nil, fmt.Errorf("error parsing registry: %v", err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(cachePath), 0700); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(cachePath, data, 0600); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// Find returns the registry definition of name or nil if not found
+func (registry *Registry) Find(name string) *RawCommand {
+	for i := range registry.Utilities {
+		if registry.Utilities[i].Name == name {
+			return &registry.Utilities[i]
+		}
+	}
+	return nil
+}
+
+// Search returns the registry definitions whose name, additional executables or help contain term, case insensitive
+func (registry *Registry) Search(term string) []RawCommand {
+	term = strings.ToLower(term)
+	found := make([]RawCommand, 0, len(registry.Utilities))
+	for _, c := range registry.Utilities {
+		haystack := strings.ToLower(strings.Join(append([]string{c.Name, c.Help}, c.Additional...), " "))
+		if strings.Contains(haystack, term) {
+			found = append(found, c)
+		}
+	}
+	return found
+}
+
+// IsComplete returns whether the command has a url for goos and goarch or a cache path, so it needs no registry definition there
+func (command *RawCommand) IsComplete(goos, goarch string) bool {
+	if command.CachePath != "" {
+		return true
+	}
+	parsedUrl, err := command.GetPlatformUrl(goos, goarch)
+	return err == nil && parsedUrl.String() != ""
+}
+
+// Inherit fills the fields that are not set in command from a registry definition.
+// Name, release and checksums are never inherited
+func (command *RawCommand) Inherit(from *RawCommand) {
+	if from == nil {
+		return
+	}
+	if len(command.Additional) == 0 {
+		command.Additional = from.Additional
+	}
+	if command.VersionCommand == "" {
+		command.VersionCommand = from.VersionCommand
+	}
+	if command.Url.Windows == "" {
+		command.Url.Windows = from.Url.Windows
+	}
+	if command.Url.Linux == "" {
+		command.Url.Linux = from.Url.Linux
+	}
+	if command.Url.Darwin == "" {
+		command.Url.Darwin = from.Url.Darwin
+	}
+	if command.Help == "" {
+		command.Help = from.Help
+	}
+	if command.Extract.Pattern == "" && len(command.Extract.List) == 0 {
+		command.Extract = from.Extract
+	}
+	// checksums of a release are not, only the url template of the checksum file
+	if command.Checksum.Url == (PlatformUrls{}) && len(command.Checksum.Sha256) == 0 {
+		command.Checksum.Url = from.Checksum.Url
+	}
+}
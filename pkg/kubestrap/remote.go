@@ -0,0 +1,175 @@
+package kubestrap
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/k0sproject/k0sctl/pkg/apis/k0sctl.k0sproject.io/v1beta1/cluster"
+	"github.com/k0sproject/rig/exec"
+)
+
+// RemoteExitUnknown is the exit code reported when a remote command did not run or did not complete
+const RemoteExitUnknown = -1
+
+// RemoteExec runs command on a connected host, streaming its output to stdout and stderr, and waits for it to complete but not after specified timeout
+//
+// Returns the exit code of the remote command
+func RemoteExec(h *cluster.Host, command string, stdin io.Reader, stdout, stderr io.Writer, timeout time.Duration, opts ...exec.Option) (int, error) {
+	var in io.ReadCloser
+	if stdin != nil {
+		in = io.NopCloser(stdin)
+	}
+	waiter, err := h.ExecStreams(command, in, stdout, stderr, opts...)
+	if err != nil {
+		return RemoteExitUnknown, err
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- waiter.Wait()
+	}()
+
+	var timeoutChan <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		timeoutChan = timer.C
+	}
+
+	select {
+	case err := <-done:
+		if err == nil {
+			return 0, nil
+		}
+		return RemoteExitCode(err), err
+	case <-timeoutChan:
+		// closing the connection terminates the remote session
+		h.Disconnect()
+		return RemoteExitUnknown, fmt.Errorf("timeout running command after %v", timeout)
+	}
+}
+
+// UploadScript uploads a local script to a temporary file on a connected posix host, that must be removed by the caller.
+// The script is run by the interpreter in its shebang line, or sh if missing, with env as KEY=VAL and args
+//
+// Returns the remote script path and the command running it
+func UploadScript(h *cluster.Host, script string, env, args []string) (string, string, error) {
+	if h.IsWindows() {
+		return "", "", fmt.Errorf("scripts are supported only on posix hosts")
+	}
+	for _, e := range env {
+		if !strings.Contains(e, "=") || strings.HasPrefix(e, "=") {
+			return "", "", fmt.Errorf("invalid environment variable '%s'. Expected KEY=VAL", e)
+		}
+	}
+
+	content, err := os.ReadFile(script)
+	if err != nil {
+		return "", "", err
+	}
+	interpreter := "sh"
+	if firstLine, _, _ := strings.Cut(string(content), "\n"); strings.HasPrefix(firstLine, "#!") {
+		interpreter = strings.TrimSpace(strings.TrimPrefix(firstLine, "#!"))
+	}
+
+	remotePath, err := h.ExecOutput("mktemp")
+	if err != nil {
+		return "", "", fmt.Errorf("failed to create temporary file: %v", err)
+	}
+	remotePath = strings.TrimSpace(remotePath)
+	if err := h.Upload(script, remotePath); err != nil {
+		_ = h.Fsys().Remove(remotePath)
+		return "", "", err
+	}
+
+	command := make([]string, 0, len(env)+len(args)+3)
+	if len(env) > 0 {
+		command = append(command, "env")
+		for _, e := range env {
+			command = append(command, ShellQuote(e))
+		}
+	}
+	command = append(command, interpreter, ShellQuote(remotePath))
+	for _, a := range args {
+		command = append(command, ShellQuote(a))
+	}
+	return remotePath, strings.Join(command, " "), nil
+}
+
+// ShellQuote quotes s for posix shells
+func ShellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// RemoteExitCode returns the exit code carried by the, possibly wrapped, error of ssh, openssh, local or winrm commands
+func RemoteExitCode(err error) int {
+	var status interface{ ExitStatus() int }
+	if errors.As(err, &status) {
+		return status.ExitStatus()
+	}
+	var code interface{ ExitCode() int }
+	if errors.As(err, &code) {
+		return code.ExitCode()
+	}
+	return RemoteExitUnknown
+}
+
+// PrefixWriter writes complete lines to the underlying writer, each line prefixed.
+// Writers sharing the same mutex do not interleave lines
+type PrefixWriter struct {
+	mu     *sync.Mutex
+	w      io.Writer
+	prefix string
+	buf    []byte
+}
+
+// NewPrefixWriter returns a new PrefixWriter. If mu is nil, a new mutex is used
+func NewPrefixWriter(w io.Writer, prefix string, mu *sync.Mutex) *PrefixWriter {
+	if mu == nil {
+		mu = &sync.Mutex{}
+	}
+	return &PrefixWriter{
+		mu:     mu,
+		w:      w,
+		prefix: prefix,
+	}
+}
+
+// Write implements io.Writer. Incomplete lines are buffered until the next write or Flush
+func (p *PrefixWriter) Write(b []byte) (int, error) {
+	p.buf = append(p.buf, b...)
+	for {
+		i := bytes.IndexByte(p.buf, '\n')
+		if i < 0 {
+			break
+		}
+		if err := p.writeLine(p.buf[:i]); err != nil {
+			return 0, err
+		}
+		p.buf = p.buf[i+1:]
+	}
+	return len(b), nil
+}
+
+// Flush writes the buffered incomplete line, if any
+func (p *PrefixWriter) Flush() error {
+	if len(p.buf) == 0 {
+		return nil
+	}
+	err := p.writeLine(p.buf)
+	p.buf = nil
+	return err
+}
+
+func (p *PrefixWriter) writeLine(line []byte) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	_, err := fmt.Fprintf(p.w, "%s%s\n", p.prefix, bytes.TrimRight(line, "\r"))
+	return err
+}
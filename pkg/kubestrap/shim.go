@@ -0,0 +1,125 @@
+package kubestrap
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/thedataflows/kubestrap/pkg/constants"
+)
+
+var Shells = []string{"bash", "zsh", "fish", "powershell"}
+
+// shimMarker is in the header of every shim, identifying them in the PATH
+const shimMarker = "Generated by kubestrap. Do not edit"
+
+// WriteShim writes a wrapper executable in dir named after exeName, that resolves the pinned release via kubestrapArgs and runs it
+//
+// Returns the shim path
+func WriteShim(dir, exeName string, kubestrapArgs []string) (string, error) {
+	quoted := make([]string, 0, len(kubestrapArgs))
+	for _, a := range kubestrapArgs {
+		quoted = append(quoted, `"`+a+`"`)
+	}
+	var shimPath, content string
+	if runtime.GOOS == constants.Windows {
+		shimPath = filepath.Join(dir, exeName+".cmd")
+		content = strings.Join(
+			[]string{
+				"@echo off",
+				"rem " + shimMarker,
+				"setlocal",
+				fmt.Sprintf(`for /f "delims=" %%%%i in ('"%s <NUL"') do set "exe=%%%%i"`, strings.Join(quoted, " ")),
+				"if not defined exe exit /b 1",
+				`endlocal & "%exe%" %*`,
+				"",
+			},
+			"\r\n",
+		)
+	} else {
+		shimPath = filepath.Join(dir, exeName)
+		content = strings.Join(
+			[]string{
+				"#!/bin/sh",
+				"# " + shimMarker,
+				fmt.Sprintf(`exe="$(%s </dev/null)" || exit $?`, strings.Join(quoted, " ")),
+				`exec "$exe" "$@"`,
+				"",
+			},
+			"\n",
+		)
+	}
+	if err := os.WriteFile(shimPath, []byte(content), 0700); err != nil { // #nosec G306
+		return "", err
+	}
+	return shimPath, nil
+}
+
+// IsShim returns whether the file at path is a shim written by WriteShim
+func IsShim(path string) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	// the marker is in the first lines, so executables are not read whole
+	header := make([]byte, 128)
+	n, _ := io.ReadFull(f, header)
+	return strings.Contains(string(header[:n]), shimMarker)
+}
+
+// RemoveShimDirsFromPath removes the directories with a shim for exeName from PATH,
+// so looking it up finds the executable instead of the shim calling kubestrap again
+func RemoveShimDirsFromPath(exeName string) error {
+	names := []string{exeName}
+	if runtime.GOOS == constants.Windows {
+		names = append(names, exeName+".cmd")
+	}
+	dirs := []string{}
+	for _, dir := range filepath.SplitList(os.Getenv("PATH")) {
+		shimmed := false
+		for _, name := range names {
+			if IsShim(filepath.Join(dir, name)) {
+				shimmed = true
+				break
+			}
+		}
+		if !shimmed {
+			dirs = append(dirs, dir)
+		}
+	}
+	return os.Setenv("PATH", strings.Join(dirs, string(os.PathListSeparator)))
+}
+
+// EnvPath returns the shell statement prepending dirs to PATH
+func EnvPath(shell string, dirs []string) (string, error) {
+	if len(dirs) == 0 {
+		return "", nil
+	}
+	switch shell {
+	case "bash", "zsh":
+		return fmt.Sprintf(`export PATH="%s:$PATH"`, strings.Join(dirs, ":")), nil
+	case "fish":
+		return fmt.Sprintf(`set -gx PATH "%s" $PATH`, strings.Join(dirs, `" "`)), nil
+	case "powershell":
+		return fmt.Sprintf(`$env:PATH = "%s" + [IO.Path]::PathSeparator + $env:PATH`, strings.Join(dirs, `" + [IO.Path]::PathSeparator + "`)), nil
+	}
+	return "", fmt.Errorf("unsupported shell '%s'. Supported: %v", shell, Shells)
+}
+
+// DefaultShell returns the current user shell if supported, otherwise bash or powershell on windows
+func DefaultShell() string {
+	shell := strings.TrimSuffix(filepath.Base(os.Getenv("SHELL")), ".exe")
+	for _, s := range Shells {
+		if s == shell {
+			return s
+		}
+	}
+	if shell == "pwsh" || runtime.GOOS == constants.Windows {
+		return "powershell"
+	}
+	return "bash"
+}
@@ -0,0 +1,39 @@
+package kubestrap
+
+import (
+	"bytes"
+
+	rigAgent "github.com/k0sproject/rig/pkg/ssh/agent"
+	"github.com/thedataflows/go-commons/pkg/log"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// SSHAgent returns a client of the running SSH agent, found with SSH_AUTH_SOCK, or pageant and the OpenSSH agent pipe on windows.
+// It is the same agent used by rig connections
+func SSHAgent() (agent.Agent, error) {
+	return rigAgent.NewClient()
+}
+
+// AgentSigner returns the signer for key held by the running SSH agent, or nil if there is no agent or it does not hold the key
+func AgentSigner(key ssh.PublicKey) ssh.Signer {
+	if key == nil {
+		return nil
+	}
+	sshAgent, err := SSHAgent()
+	if err != nil {
+		log.Debugf("ssh agent: %v", err)
+		return nil
+	}
+	signers, err := sshAgent.Signers()
+	if err != nil {
+		log.Debugf("failed to list ssh agent keys: %v", err)
+		return nil
+	}
+	for _, s := range signers {
+		if bytes.Equal(s.PublicKey().Marshal(), key.Marshal()) {
+			return s
+		}
+	}
+	return nil
+}
@@ -0,0 +1,170 @@
+package kubestrap
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/k0sproject/rig"
+	"github.com/thedataflows/go-commons/pkg/log"
+	"golang.org/x/crypto/ssh"
+)
+
+// TrustedUserCAKeysPath is where the CA public key is installed on hosts, unless sshd already trusts CA keys from another file
+const TrustedUserCAKeysPath = "/etc/ssh/kubestrap_user_ca.pub"
+
+// UserCertificateExtensions are the permissions of issued user certificates, the same as the ssh-keygen defaults
+var UserCertificateExtensions = []string{
+	"permit-X11-forwarding",
+	"permit-agent-forwarding",
+	"permit-port-forwarding",
+	"permit-pty",
+	"permit-user-rc",
+}
+
+// IssueUserCertificate signs a user certificate for key with the CA, valid for the principals between validAfter and validBefore
+func IssueUserCertificate(ca ssh.Signer, key ssh.PublicKey, keyId string, principals []string, validAfter, validBefore time.Time) (*ssh.Certificate, error) {
+	if len(principals) == 0 {
+		return nil, fmt.Errorf("at least one principal is required")
+	}
+	if !validBefore.After(validAfter) {
+		return nil, fmt.Errorf("certificate validity ends before it starts")
+	}
+	serial := make([]byte, 8)
+	if _, err := rand.Read(serial); err != nil {
+		return nil, err
+	}
+	extensions := make(map[string]string, len(UserCertificateExtensions))
+	for _, e := range UserCertificateExtensions {
+		extensions[e] = ""
+	}
+	cert := &ssh.Certificate{
+		Key:             key,
+		Serial:          binary.BigEndian.Uint64(serial),
+		CertType:        ssh.UserCert,
+		KeyId:           keyId,
+		ValidPrincipals: principals,
+		ValidAfter:      uint64(validAfter.Unix()),
+		ValidBefore:     uint64(validBefore.Unix()),
+		Permissions: ssh.Permissions{
+			Extensions: extensions,
+		},
+	}
+	if err := cert.SignCert(rand.Reader, ca); err != nil {
+		return nil, err
+	}
+	return cert, nil
+}
+
+// CertificatePath returns the path of the certificate for a private or public key path, following the OpenSSH convention
+func CertificatePath(keyPath string) string {
+	return strings.TrimSuffix(keyPath, ".pub") + "-cert.pub"
+}
+
+// CertificateSigner returns a signer authenticating with the certificate found next to keyPath, or nil if there is none,
+// it is not valid now or it is not issued for the key of signer
+func CertificateSigner(signer ssh.Signer, keyPath string) ssh.Signer {
+	certPath := CertificatePath(keyPath)
+	data, err := os.ReadFile(certPath)
+	if err != nil {
+		return nil
+	}
+	pub, _, _, _, err := ssh.ParseAuthorizedKey(data)
+	if err != nil {
+		log.Warnf("ignoring invalid certificate '%s': %v", certPath, err)
+		return nil
+	}
+	cert, ok := pub.(*ssh.Certificate)
+	if !ok {
+		log.Warnf("ignoring '%s': not a certificate", certPath)
+		return nil
+	}
+	now := uint64(time.Now().Unix())
+	if now < cert.ValidAfter || now >= cert.ValidBefore {
+		log.Warnf("ignoring certificate '%s': not valid now, but from %s to %s. Issue a new one", certPath, time.Unix(int64(cert.ValidAfter), 0).Format(time.RFC3339), time.Unix(int64(cert.ValidBefore), 0).Format(time.RFC3339))
+		return nil
+	}
+	certSigner, err := ssh.NewCertSigner(cert, signer)
+	if err != nil {
+		log.Debugf("ignoring certificate '%s': %v", certPath, err)
+		return nil
+	}
+	log.Debugf("using certificate '%s' (%s)", certPath, cert.KeyId)
+	return certSigner
+}
+
+var (
+	// certificateHops are the SSH hops already given their certificate auth method, as hosts reconnect
+	certificateHops   = make(map[*rig.SSH]bool)
+	certificateHopsMu sync.Mutex
+)
+
+// UseCertificates makes rig authenticate each hop of the SSH connection with the certificate found next to its key, if any.
+// The private key must be unencrypted or held by the SSH agent. Each hop is only set up once
+func UseCertificates(s *rig.SSH) {
+	certificateHopsMu.Lock()
+	defer certificateHopsMu.Unlock()
+	for ; s != nil; s = s.Bastion {
+		if s.KeyPath == nil || certificateHops[s] {
+			continue
+		}
+		certificateHops[s] = true
+		keyPath := strings.TrimSuffix(*s.KeyPath, ".pub")
+		if _, err := os.Stat(CertificatePath(keyPath)); err != nil {
+			continue
+		}
+		data, err := os.ReadFile(keyPath)
+		if err != nil {
+			continue
+		}
+		signer, err := ssh.ParsePrivateKey(data)
+		if passphraseErr, ok := err.(*ssh.PassphraseMissingError); ok {
+			signer, err = AgentSigner(passphraseErr.PublicKey), nil
+			if signer == nil {
+				log.Warnf("ignoring certificate for '%s': the key is encrypted. Load it into the SSH agent first", keyPath)
+				continue
+			}
+		}
+		if err != nil {
+			continue
+		}
+		if certSigner := CertificateSigner(signer, keyPath); certSigner != nil {
+			s.AuthMethods = append(s.AuthMethods, ssh.PublicKeys(certSigner))
+		}
+	}
+}
+
+// TrustedUserCAScript returns a shell script, to run as root, making sshd trust user certificates signed by the CA.
+// If sshd already trusts CA keys from a file, caPubKey is added to it, otherwise it is configured with TrustedUserCAKeysPath.
+// The configuration is validated and restored on error, then sshd is reloaded. Prints 'exists' if the CA was already trusted
+func TrustedUserCAScript(caPubKey string) string {
+	return strings.Join(
+		[]string{
+			"set -e",
+			fmt.Sprintf("K=%s", ShellQuote(strings.TrimSpace(caPubKey))),
+			fmt.Sprintf("F=%s", ShellQuote(TrustedUserCAKeysPath)),
+			`C=/etc/ssh/sshd_config`,
+			`E="$(awk 'tolower($1) == "trustedusercakeys" { print $2; exit }' "$C")"`,
+			`[ -z "$E" ] || [ "$E" = none ] || F="$E"`,
+			`if [ -f "$F" ] && grep -qxF "$K" "$F"; then echo exists; exit 0; fi`,
+			`mkdir -p "$(dirname "$F")"`,
+			`echo "$K" >> "$F"`,
+			`chmod 0644 "$F"`,
+			`if [ "$F" != "$E" ]; then`,
+			`  cp -p "$C" "$C.kubestrap.bak"`,
+			// global directives must precede Match blocks
+			`  { echo "TrustedUserCAKeys $F"; grep -viE '^[[:space:]]*TrustedUserCAKeys[[:space:]]+none' "$C.kubestrap.bak"; } > "$C"`,
+			`  if ! "$(command -v sshd || echo /usr/sbin/sshd)" -t; then cp -p "$C.kubestrap.bak" "$C"; echo "invalid sshd configuration, restored" >&2; exit 1; fi`,
+			`fi`,
+			`if command -v systemctl >/dev/null 2>&1; then systemctl reload sshd 2>/dev/null || systemctl reload ssh`,
+			`elif command -v rc-service >/dev/null 2>&1; then rc-service sshd reload`,
+			`elif command -v service >/dev/null 2>&1; then service sshd reload 2>/dev/null || service ssh reload`,
+			`else kill -HUP "$(cat /var/run/sshd.pid)"; fi`,
+		},
+		"\n",
+	)
+}